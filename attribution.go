@@ -0,0 +1,262 @@
+package onion
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	// maxAttributableHops is the maximum number of hops that the
+	// attribution data of a failure can cover.
+	maxAttributableHops = 20
+
+	// holdTimeLen is the length of each hold time in the attribution data.
+	holdTimeLen = 4
+
+	// attrHmacLen is the length that the attribution HMACs are truncated
+	// to.
+	attrHmacLen = 4
+
+	// numAttrHmacs is the number of HMACs in the attribution data. Since a
+	// hop does not know its position in the route, it adds one HMAC for
+	// each position that it could be at. Every hop towards the sender then
+	// drops the HMAC for the first position from each downstream hop, so
+	// the hop in slot i only has maxAttributableHops - i HMACs left.
+	numAttrHmacs = maxAttributableHops * (maxAttributableHops + 1) / 2
+
+	// holdTimesLen is the length of the hold times in the attribution
+	// data.
+	holdTimesLen = maxAttributableHops * holdTimeLen
+
+	// AttributionDataLen is the length of the attribution data that is
+	// sent back along with an attributable failure.
+	AttributionDataLen = holdTimesLen + numAttrHmacs*attrHmacLen
+
+	// HoldTimeUnit is the unit that hold times are reported in.
+	HoldTimeUnit = 100 * time.Millisecond
+)
+
+// ErrInvalidAttribution is returned by DecryptAttributableError if the
+// attribution data shows that the failure was tampered with on its way back to
+// the sender. Either the hop at Index or the hop before it is responsible.
+type ErrInvalidAttribution struct {
+	// Index is the position of the first hop whose attribution HMAC is
+	// invalid.
+	Index int
+
+	// HoldTimes are the hold times reported by the hops before Index.
+	HoldTimes []time.Duration
+}
+
+func (e *ErrInvalidAttribution) Error() string {
+	if e.Index == 0 {
+		return "invalid failure attribution from hop 0"
+	}
+
+	return fmt.Sprintf("invalid failure attribution between hop %d and "+
+		"hop %d", e.Index-1, e.Index)
+}
+
+// attrHmacOffset returns the offset in the attribution data of the HMAC for
+// the given position belonging to the hop in the given slot. Slot 0 holds the
+// hop that last added to the data and the block of each slot starts at the
+// position of that slot.
+func attrHmacOffset(slot, position int) int {
+	prev := slot*maxAttributableHops - slot*(slot-1)/2
+
+	return holdTimesLen + (prev+position-slot)*attrHmacLen
+}
+
+// shiftAttributionData makes space for a new hop in slot 0 of the attribution
+// data by moving every hop down by one slot. The last slot and the HMAC for the
+// first position of each hop are dropped.
+func shiftAttributionData(data []byte) []byte {
+	shifted := make([]byte, AttributionDataLen)
+	copy(shifted[holdTimeLen:holdTimesLen], data[:holdTimesLen-holdTimeLen])
+
+	for slot := 0; slot < maxAttributableHops-1; slot++ {
+		copy(
+			shifted[attrHmacOffset(slot+1, slot+1):],
+			data[attrHmacOffset(slot, slot+1):attrHmacOffset(
+				slot+1, slot+1,
+			)],
+		)
+	}
+
+	return shifted
+}
+
+// unshiftAttributionData reverses shiftAttributionData. The data that was
+// dropped when it was shifted is zeroed.
+func unshiftAttributionData(data []byte) []byte {
+	unshifted := make([]byte, AttributionDataLen)
+	copy(unshifted[:holdTimesLen-holdTimeLen], data[holdTimeLen:holdTimesLen])
+
+	for slot := 0; slot < maxAttributableHops-1; slot++ {
+		copy(
+			unshifted[attrHmacOffset(slot, slot+1):],
+			data[attrHmacOffset(slot+1, slot+1):attrHmacOffset(
+				slot+2, slot+2,
+			)],
+		)
+	}
+
+	return unshifted
+}
+
+// attrHmac calculates the HMAC that a hop in slot 0 of the attribution data
+// adds for the given position. It covers the failure packet and the parts of
+// the attribution data that will still be around once position more hops have
+// shifted the data.
+func attrHmac(um [32]byte, packet, data []byte, position int) []byte {
+	covered := len(packet) + (maxAttributableHops-position)*holdTimeLen
+	msg := make([]byte, 0, covered+numAttrHmacs*attrHmacLen)
+	msg = append(msg, packet...)
+	msg = append(
+		msg, data[:(maxAttributableHops-position)*holdTimeLen]...,
+	)
+
+	for slot := 1; slot < maxAttributableHops-position; slot++ {
+		msg = append(
+			msg, data[attrHmacOffset(slot, slot+position):attrHmacOffset(
+				slot+1, slot+1,
+			)]...,
+		)
+	}
+
+	mac := calcMac(um, msg)
+
+	return mac[:attrHmacLen]
+}
+
+// addAttribution adds this hop's hold time and HMACs to the attribution data
+// received from the next hop and then obfuscates it. The packet is the failure
+// packet before this hop's obfuscation has been added.
+func (e *ErrorEncrypter) addAttribution(packet, data []byte,
+	holdTime time.Duration) []byte {
+
+	data = shiftAttributionData(data)
+	binary.BigEndian.PutUint32(
+		data[:holdTimeLen], uint32(holdTime/HoldTimeUnit),
+	)
+
+	for position := 0; position < maxAttributableHops; position++ {
+		copy(
+			data[attrHmacOffset(0, position):],
+			attrHmac(e.um, packet, data, position),
+		)
+	}
+
+	stream := pSByteStream(e.ammagext[:], AttributionDataLen)
+	xor(data, data, stream)
+
+	return data
+}
+
+// EncryptAttributableError creates a new failure packet containing the given
+// failure message along with attribution data that lets the sender find the
+// hop responsible if the failure is tampered with on its way back. The hold
+// time is the time that this hop held the HTLC for.
+func (e *ErrorEncrypter) EncryptAttributableError(msg []byte,
+	holdTime time.Duration) ([]byte, []byte, error) {
+
+	packet, err := e.failurePacket(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data := e.addAttribution(
+		packet, make([]byte, AttributionDataLen), holdTime,
+	)
+
+	return e.ObfuscateError(packet), data, nil
+}
+
+// ObfuscateAttributableError adds this hop's layer of obfuscation to an
+// attributable failure received from the next hop in the route along with its
+// hold time and HMACs.
+func (e *ErrorEncrypter) ObfuscateAttributableError(packet, data []byte,
+	holdTime time.Duration) ([]byte, []byte, error) {
+
+	if len(data) != AttributionDataLen {
+		return nil, nil, fmt.Errorf("invalid attribution data "+
+			"length: %d", len(data))
+	}
+
+	data = e.addAttribution(packet, data, holdTime)
+
+	return e.ObfuscateError(packet), data, nil
+}
+
+// DecryptAttributableError peels the obfuscation layers off of an attributable
+// failure one hop at a time, checking the attribution HMAC of each hop along
+// the way. If a hop's HMAC is invalid then an ErrInvalidAttribution is
+// returned that identifies where the failure was tampered with.
+func (d *ErrorDecrypter) DecryptAttributableError(packet,
+	data []byte) (*DecryptedError, error) {
+
+	if len(packet) < minFailurePacketLen {
+		return nil, fmt.Errorf("failure packet too short: %d",
+			len(packet))
+	}
+
+	if len(data) != AttributionDataLen {
+		return nil, fmt.Errorf("invalid attribution data length: %d",
+			len(data))
+	}
+
+	if len(d.Hops) > maxAttributableHops {
+		return nil, fmt.Errorf("route too long for attributable "+
+			"failures: %d hops", len(d.Hops))
+	}
+
+	var holdTimes []time.Duration
+	for i, hop := range d.Hops {
+		encrypter := NewErrorEncrypter(hop.SS)
+		packet = encrypter.ObfuscateError(packet)
+
+		if i > 0 {
+			data = unshiftAttributionData(data)
+		} else {
+			data = append([]byte{}, data...)
+		}
+		stream := pSByteStream(encrypter.ammagext[:], AttributionDataLen)
+		xor(data, data, stream)
+
+		mac := attrHmac(hop.Um, packet, data, i)
+		if !hmac.Equal(mac, data[attrHmacOffset(0, i):][:attrHmacLen]) {
+			return nil, &ErrInvalidAttribution{
+				Index:     i,
+				HoldTimes: holdTimes,
+			}
+		}
+
+		holdTimes = append(holdTimes, time.Duration(
+			binary.BigEndian.Uint32(data[:holdTimeLen]),
+		)*HoldTimeUnit)
+
+		msg, ok, err := readFailurePacket(hop.Um, packet)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		return &DecryptedError{
+			Index:     i,
+			Sender:    hop.P,
+			Message:   msg,
+			HoldTimes: holdTimes,
+		}, nil
+	}
+
+	// Every hop vouched for the failure but none of them created it, so
+	// the last hop must have sent back an invalid failure.
+	return nil, &ErrInvalidAttribution{
+		Index:     len(d.Hops) - 1,
+		HoldTimes: holdTimes,
+	}
+}
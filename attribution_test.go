@@ -0,0 +1,155 @@
+package onion
+
+import (
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestAttributionDataShift(t *testing.T) {
+	data := make([]byte, AttributionDataLen)
+	for i := range data {
+		data[i] = byte(i%255) + 1
+	}
+
+	// Shifting and then unshifting should only lose the last slot and the
+	// first HMAC of each hop.
+	unshifted := unshiftAttributionData(shiftAttributionData(data))
+	for slot := 0; slot < maxAttributableHops; slot++ {
+		holdTime := unshifted[slot*holdTimeLen : (slot+1)*holdTimeLen]
+		if slot == maxAttributableHops-1 {
+			require.Equal(t, make([]byte, holdTimeLen), holdTime)
+		} else {
+			require.Equal(
+				t, data[slot*holdTimeLen:(slot+1)*holdTimeLen],
+				holdTime,
+			)
+		}
+
+		for position := slot; position < maxAttributableHops; position++ {
+			offset := attrHmacOffset(slot, position)
+			mac := unshifted[offset : offset+attrHmacLen]
+			if position == slot {
+				require.Equal(t, make([]byte, attrHmacLen), mac)
+			} else {
+				require.Equal(
+					t, data[offset:offset+attrHmacLen], mac,
+				)
+			}
+		}
+	}
+
+	require.Equal(
+		t, AttributionDataLen,
+		attrHmacOffset(maxAttributableHops, maxAttributableHops),
+	)
+}
+
+func TestAttributableFailure(t *testing.T) {
+	sessionKey, _ := btcec.NewPrivateKey()
+
+	hopsData := []*HopData{
+		{
+			PubKey:    Users[Bob].PubKey,
+			ClearData: []byte("Hi Bob"),
+		},
+		{
+			PubKey:    Users[Charlie].PubKey,
+			ClearData: []byte("Hi Charlie"),
+		},
+		{
+			PubKey:    Users[Dave].PubKey,
+			ClearData: []byte("Hi Dave"),
+		},
+		{
+			PubKey:    Users[Eve].PubKey,
+			ClearData: []byte("Hi Eve"),
+		},
+	}
+	users := []*User{Users[Bob], Users[Charlie], Users[Dave], Users[Eve]}
+
+	onion, hops, err := BuildOnion(sessionKey, hopsData)
+	require.NoError(t, err)
+
+	payloads := make([]*HopPayload, len(hopsData))
+	for i := range hopsData {
+		payloads[i], onion, err = Peel(users[i], onion)
+		require.NoError(t, err)
+	}
+
+	// sendBack creates a failure at the failing hop and passes it back to
+	// the sender. If corruptAt is set, that hop flips a bit in the
+	// failure before adding its own layer.
+	sendBack := func(failingHop, corruptAt int) ([]byte, []byte) {
+		packet, data, err := payloads[failingHop].ErrorEncrypter().
+			EncryptAttributableError(
+				[]byte("oh no"),
+				time.Duration(failingHop+1)*time.Second,
+			)
+		require.NoError(t, err)
+
+		for i := failingHop - 1; i >= 0; i-- {
+			if i == corruptAt {
+				packet[40] ^= 1
+			}
+
+			packet, data, err = payloads[i].ErrorEncrypter().
+				ObfuscateAttributableError(
+					packet, data,
+					time.Duration(i+1)*time.Second,
+				)
+			require.NoError(t, err)
+		}
+
+		return packet, data
+	}
+
+	decrypter := NewErrorDecrypter(hops)
+	for failingHop := range hopsData {
+		packet, data := sendBack(failingHop, -1)
+
+		decrypted, err := decrypter.DecryptAttributableError(
+			packet, data,
+		)
+		require.NoError(t, err)
+		require.Equal(t, failingHop, decrypted.Index)
+		require.Equal(t, []byte("oh no"), decrypted.Message)
+
+		require.Len(t, decrypted.HoldTimes, failingHop+1)
+		for i, holdTime := range decrypted.HoldTimes {
+			require.Equal(t, time.Duration(i+1)*time.Second, holdTime)
+		}
+
+		// The packet is still a normal failure.
+		decrypted, err = decrypter.DecryptError(packet)
+		require.NoError(t, err)
+		require.Equal(t, failingHop, decrypted.Index)
+	}
+
+	// If Charlie corrupts Eve's failure before passing it back, the
+	// sender should find that the failure was corrupted between Charlie
+	// and Dave.
+	packet, data := sendBack(3, 1)
+	_, err = decrypter.DecryptAttributableError(packet, data)
+
+	var attrErr *ErrInvalidAttribution
+	require.ErrorAs(t, err, &attrErr)
+	require.Equal(t, 2, attrErr.Index)
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second},
+		attrErr.HoldTimes)
+
+	// The normal failure can no longer be attributed at all.
+	_, err = decrypter.DecryptError(packet)
+	require.ErrorIs(t, err, ErrUnattributableFailure)
+
+	// Attribution data that is corrupted after Bob added his layer is
+	// blamed on Bob since his HMACs cover the data of every downstream
+	// hop.
+	packet, data = sendBack(3, -1)
+	data[attrHmacOffset(3, 3)] ^= 1
+	_, err = decrypter.DecryptAttributableError(packet, data)
+	require.ErrorAs(t, err, &attrErr)
+	require.Equal(t, 0, attrErr.Index)
+	require.Empty(t, attrErr.HoldTimes)
+}
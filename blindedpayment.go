@@ -0,0 +1,232 @@
+package onion
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"sort"
+)
+
+// SelectedPath is a blinded path that the sender picked to pay the recipient
+// along with how the sender reaches it.
+type SelectedPath struct {
+	// Path is the blinded path from the recipient.
+	Path *BlindedPath
+
+	// Route is the route from the sender to the introduction node of the
+	// path. It holds the nodes after the sender and ends with the
+	// introduction node.
+	Route []*btcec.PublicKey
+
+	// IntroAmount is the amount of the HTLC that must reach the
+	// introduction node.
+	IntroAmount uint64
+
+	// IntroCLTV is the CLTV expiry of the HTLC that must reach the
+	// introduction node.
+	IntroCLTV uint32
+}
+
+// numHops returns the number of hops between the sender and the recipient.
+func (s *SelectedPath) numHops() int {
+	return len(s.Route) + len(s.Path.BlindedNodeIDs)
+}
+
+// SelectBlindedPath picks the path that the sender should use to pay the given
+// amount and CLTV expiry to a recipient that hides behind several blinded
+// paths. Only paths whose introduction node the sender can reach over its
+// channel table and whose pay info allows the amount are considered. Of those,
+// the path with the lowest fee is picked, then the lowest CLTV delta and then
+// the fewest hops. The entry nodes of paths in the compact form are resolved
+// from the channel table too.
+//
+// If the sender is the introduction node of a path, it processes its own hop
+// with AdvanceBlindedPath and the selected path starts at the next node.
+func SelectBlindedPath(sender *User, paths []*BlindedPath, amt uint64,
+	cltv uint32) (*SelectedPath, error) {
+
+	channels := sender.Channels
+
+	var candidates []*SelectedPath
+	for _, path := range paths {
+		if path.PayInfo == nil || path.ResolveEntryNode(channels) != nil {
+			continue
+		}
+
+		introAmt, introCLTV, err := path.PayInfo.IntroductionHTLC(
+			amt, cltv,
+		)
+		if err != nil {
+			continue
+		}
+
+		if path.EntryNodeID.IsEqual(sender.PubKey) {
+			path, introAmt, introCLTV, err = advanceSelectedPath(
+				sender, path, introAmt, introCLTV,
+			)
+			if err != nil {
+				continue
+			}
+		}
+
+		route, ok := channels.Route(sender.PubKey, path.EntryNodeID)
+		if !ok {
+			continue
+		}
+
+		candidates = append(candidates, &SelectedPath{
+			Path:        path,
+			Route:       route,
+			IntroAmount: introAmt,
+			IntroCLTV:   introCLTV,
+		})
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("none of the %d blinded paths can be "+
+			"used to pay %d msat", len(paths), amt)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+
+		switch {
+		case a.IntroAmount != b.IntroAmount:
+			return a.IntroAmount < b.IntroAmount
+
+		case a.IntroCLTV != b.IntroCLTV:
+			return a.IntroCLTV < b.IntroCLTV
+
+		default:
+			return a.numHops() < b.numHops()
+		}
+	})
+
+	return candidates[0], nil
+}
+
+// advanceSelectedPath processes the sender's own hop of a path that it is the
+// introduction node of. The HTLC for the next node is what the sender's relay
+// policy in the path would forward for the HTLC to the introduction node.
+func advanceSelectedPath(sender *User, path *BlindedPath, introAmt uint64,
+	introCLTV uint32) (*BlindedPath, uint64, uint32, error) {
+
+	next, data, err := AdvanceBlindedPath(
+		sender, path, introAmt, introCLTV,
+	)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	if data.PaymentRelay == nil {
+		return next, introAmt, introCLTV, nil
+	}
+
+	amt, cltv, err := data.PaymentRelay.Forward(introAmt, introCLTV)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return next, amt, cltv, nil
+}
+
+// AdvanceBlindedPath lets the introduction node of a blinded path process its
+// own hop of the path, for when it is also the sender of an onion over the
+// path. The returned path holds the rest of the hops with the next node as its
+// entry node, so it can be used like any other blinded path. The data that the
+// recipient left for the introduction node is returned along with it. The
+// amount and CLTV expiry of the HTLC that the introduction node would have
+// received must meet the recipient's payment constraints for its hop.
+func AdvanceBlindedPath(user *User, path *BlindedPath, amt uint64,
+	cltv uint32) (*BlindedPath, *RecipientData, error) {
+
+	if !path.EntryNodeID.IsEqual(user.PubKey) {
+		return nil, nil, fmt.Errorf("not the entry node of the path")
+	}
+
+	if user.Signer == nil {
+		return nil, nil, fmt.Errorf("%s: %w", user.Name, ErrNoSigner)
+	}
+
+	if len(path.BlindedNodeIDs) == 0 {
+		return nil, nil, fmt.Errorf("the path ends at its entry node")
+	}
+
+	if len(path.EncryptedData) != len(path.BlindedNodeIDs)+1 {
+		return nil, nil, fmt.Errorf("path has encrypted data for %d "+
+			"of %d hops", len(path.EncryptedData),
+			len(path.BlindedNodeIDs)+1)
+	}
+
+	pathKey := path.FirstBlindingEphemeralKey
+	ssR, err := user.Signer.ECDH(pathKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to derive shared secret: "+
+			"%w", err)
+	}
+
+	recipient, err := openRecipientData(
+		user, ssR, pathKey, path.EncryptedData[0], amt, cltv,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Dummy hops point back to the recipient, so a path that carries on
+	// at the entry node must end there too.
+	if recipient.next == nil || recipient.next.IsEqual(user.PubKey) {
+		return nil, nil, fmt.Errorf("the path ends at its entry node")
+	}
+
+	return &BlindedPath{
+		EntryNodeID:               recipient.next,
+		BlindedNodeIDs:            path.BlindedNodeIDs[1:],
+		EncryptedData:             path.EncryptedData[1:],
+		FirstBlindingEphemeralKey: recipient.nextPathKey,
+		EntryBlindedNodeID:        path.BlindedNodeIDs[0],
+	}, recipient.data, nil
+}
+
+// BuildOnion builds the onion for a payment over the selected path. The final
+// hop gives the data for the recipient, such as the amount and CLTV that were
+// given to SelectBlindedPath and the payment secret, and its pub key and
+// encrypted data are filled in from the path. The channel table has no fee
+// policies, so the hops before the introduction node forward the HTLC for the
+// introduction node as it is.
+func (s *SelectedPath) BuildOnion(sessionKey *btcec.PrivateKey,
+	finalHop *HopData, opts ...BuildOption) (*Onion, []*Hop, error) {
+
+	if len(s.Route) == 0 {
+		return nil, nil, fmt.Errorf("no route to the entry node")
+	}
+
+	path := s.Path
+	hopsData := make([]*HopData, 0, s.numHops())
+	for _, node := range s.Route[:len(s.Route)-1] {
+		hopsData = append(hopsData, &HopData{
+			PubKey:       node,
+			AmtToForward: s.IntroAmount,
+			OutgoingCLTV: s.IntroCLTV,
+		})
+	}
+
+	hopsData = append(hopsData, &HopData{
+		PubKey:        path.EntryNodeID,
+		EncryptedData: path.EncryptedData[0],
+		EphemeralKey:  path.FirstBlindingEphemeralKey,
+	})
+
+	for i, id := range path.BlindedNodeIDs {
+		hopsData = append(hopsData, &HopData{
+			PubKey:        id,
+			EncryptedData: path.EncryptedData[i+1],
+		})
+	}
+
+	recipient := *finalHop
+	recipient.PubKey = hopsData[len(hopsData)-1].PubKey
+	recipient.EncryptedData = hopsData[len(hopsData)-1].EncryptedData
+	recipient.EphemeralKey = hopsData[len(hopsData)-1].EphemeralKey
+	hopsData[len(hopsData)-1] = &recipient
+
+	return BuildOnion(sessionKey, hopsData, opts...)
+}
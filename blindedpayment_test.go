@@ -0,0 +1,248 @@
+package onion
+
+import (
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSelectBlindedPath(t *testing.T) {
+	charlieRelay := &PaymentRelay{
+		FeeBaseMsat:               1000,
+		FeeProportionalMillionths: 100,
+		CltvExpiryDelta:           40,
+	}
+	daveRelay := &PaymentRelay{
+		FeeBaseMsat:               500,
+		FeeProportionalMillionths: 200,
+		CltvExpiryDelta:           20,
+	}
+
+	buildPath := func(hopsData ...*HopData) *BlindedPath {
+		sessionKey, _ := btcec.NewPrivateKey()
+		path, err := BuildBlindedPath(sessionKey, hopsData)
+		require.NoError(t, err)
+
+		return path
+	}
+
+	// Eve hides behind Charlie, behind Dave for larger payments and
+	// behind a node that Alice has no route to.
+	viaCharlie := buildPath(
+		&HopData{
+			PubKey:       Users[Charlie].PubKey,
+			PaymentRelay: charlieRelay,
+		},
+		&HopData{
+			PubKey:       Users[Dave].PubKey,
+			PaymentRelay: daveRelay,
+		},
+		&HopData{PubKey: Users[Eve].PubKey},
+	)
+	viaDave := buildPath(
+		&HopData{
+			PubKey:       Users[Dave].PubKey,
+			PaymentRelay: daveRelay,
+			PaymentConstraints: &PaymentConstraints{
+				MaxCltvExpiry:   2000,
+				HtlcMinimumMsat: 50000,
+			},
+		},
+		&HopData{PubKey: Users[Eve].PubKey},
+	)
+	unknown, _ := btcec.NewPrivateKey()
+	viaUnknown := buildPath(
+		&HopData{PubKey: unknown.PubKey()},
+		&HopData{PubKey: Users[Eve].PubKey},
+	)
+
+	// The path through Charlie identifies Charlie by one of his channels,
+	// which Alice resolves from her own channel table.
+	viaCharlie.EntrySCIDDir = &SCIDDir{}
+	*viaCharlie.EntrySCIDDir, _ = Channels.SCIDDir(Users[Charlie].PubKey)
+
+	// The paths survive being encoded for the sender.
+	paths, err := DecodeBlindedPaths(EncodeBlindedPaths(
+		[]*BlindedPath{viaUnknown, viaCharlie, viaDave},
+	))
+	require.NoError(t, err)
+	require.Equal(t, viaDave.PayInfo, paths[2].PayInfo)
+
+	alice := Users[Alice]
+	selected, err := SelectBlindedPath(
+		alice, paths, 100000, 1000,
+	)
+	require.NoError(t, err)
+	require.Equal(t, paths[2], selected.Path)
+	require.Len(t, selected.Route, 3)
+	require.True(t, selected.Route[2].IsEqual(Users[Dave].PubKey))
+
+	// Small payments can't go through Dave.
+	selected, err = SelectBlindedPath(
+		alice, paths, 10000, 1000,
+	)
+	require.NoError(t, err)
+	require.Equal(t, paths[1], selected.Path)
+	require.True(t, selected.Path.EntryNodeID.IsEqual(
+		Users[Charlie].PubKey,
+	))
+
+	_, err = SelectBlindedPath(
+		alice, paths[:1], 10000, 1000,
+	)
+	require.Error(t, err)
+
+	// Alice pays Eve over the path through Charlie.
+	sessionKey, _ := btcec.NewPrivateKey()
+	onion, _, err := selected.BuildOnion(sessionKey, &HopData{
+		ClearData:    []byte("Hi Eve"),
+		AmtToForward: 10000,
+		OutgoingCLTV: 1000,
+	})
+	require.NoError(t, err)
+	onion.IncomingAmount = selected.IntroAmount
+	onion.IncomingCLTV = selected.IntroCLTV
+
+	for _, name := range []string{Bob, Charlie, Dave} {
+		payload, next, err := Peel(Users[name], onion)
+		require.NoError(t, err)
+		require.NotNil(t, payload.FwdTo)
+
+		next.IncomingAmount = payload.Data.AmtToForward
+		next.IncomingCLTV = payload.Data.OutgoingCLTV
+		onion = next
+	}
+	require.GreaterOrEqual(t, onion.IncomingAmount, uint64(10000))
+	require.EqualValues(t, 1000, onion.IncomingCLTV)
+
+	payload, _, err := Peel(Users[Eve], onion)
+	require.NoError(t, err)
+	require.Nil(t, payload.FwdTo)
+	require.Equal(t, []byte("Hi Eve"), payload.Data.ClearData)
+	require.EqualValues(t, 10000, payload.Data.AmtToForward)
+}
+
+func TestSelectBlindedPathNextToSender(t *testing.T) {
+	pathStore := NewMemoryPathStore()
+	buildPath := func(hopsData ...*HopData) *BlindedPath {
+		pathID, err := NewPathID()
+		require.NoError(t, err)
+		require.NoError(t, pathStore.Add(pathID, 2000))
+
+		sessionKey, _ := btcec.NewPrivateKey()
+		path, err := BuildBlindedPath(
+			sessionKey, hopsData, WithPathID(pathID),
+		)
+		require.NoError(t, err)
+
+		return path
+	}
+
+	viaCharlie := buildPath(
+		&HopData{
+			PubKey: Users[Charlie].PubKey,
+			PaymentRelay: &PaymentRelay{
+				FeeBaseMsat:     1000,
+				CltvExpiryDelta: 40,
+			},
+			PaymentConstraints: &PaymentConstraints{
+				MaxCltvExpiry:   1100,
+				HtlcMinimumMsat: 1000,
+			},
+		},
+		&HopData{
+			PubKey: Users[Dave].PubKey,
+			PaymentRelay: &PaymentRelay{
+				FeeBaseMsat:     500,
+				CltvExpiryDelta: 20,
+			},
+		},
+		&HopData{PubKey: Users[Eve].PubKey},
+	)
+
+	// In the degenerate path, Eve is her own introduction node.
+	eveOnly := buildPath(&HopData{PubKey: Users[Eve].PubKey})
+	require.Empty(t, eveOnly.BlindedNodeIDs)
+
+	eve := *Users[Eve]
+	eve.PathStore = pathStore
+
+	// payEve peels the onion for the selected path along its hops.
+	payEve := func(selected *SelectedPath, hops ...string) {
+		sessionKey, _ := btcec.NewPrivateKey()
+		onion, _, err := selected.BuildOnion(sessionKey, &HopData{
+			AmtToForward: 10000,
+			OutgoingCLTV: 1000,
+		})
+		require.NoError(t, err)
+		onion.IncomingAmount = selected.IntroAmount
+		onion.IncomingCLTV = selected.IntroCLTV
+
+		for _, name := range hops {
+			payload, next, err := Peel(Users[name], onion)
+			require.NoError(t, err)
+			require.NotNil(t, payload.FwdTo)
+
+			next.IncomingAmount = payload.Data.AmtToForward
+			next.IncomingCLTV = payload.Data.OutgoingCLTV
+			onion = next
+		}
+
+		payload, _, err := Peel(&eve, onion)
+		require.NoError(t, err)
+		require.Nil(t, payload.FwdTo)
+		require.NotNil(t, payload.PathID)
+		require.EqualValues(t, 10000, payload.Data.AmtToForward)
+	}
+
+	// Charlie is the introduction node of the path, so he processes his
+	// own hop and sends the onion straight to Dave, who becomes the
+	// introduction node.
+	selected, err := SelectBlindedPath(
+		Users[Charlie], []*BlindedPath{viaCharlie}, 10000, 1000,
+	)
+	require.NoError(t, err)
+	require.True(t, selected.Path.EntryNodeID.IsEqual(Users[Dave].PubKey))
+	require.Len(t, selected.Route, 1)
+	require.EqualValues(t, 10500, selected.IntroAmount)
+	require.EqualValues(t, 1020, selected.IntroCLTV)
+	payEve(selected, Dave)
+
+	// Only the introduction node can process its hop.
+	_, _, err = AdvanceBlindedPath(Users[Dave], viaCharlie, 11500, 1060)
+	require.Error(t, err)
+
+	// Charlie's own hop must meet the constraints of the path, which
+	// the pay info doesn't tell about the CLTV expiry.
+	_, _, err = AdvanceBlindedPath(Users[Charlie], viaCharlie, 500, 1060)
+	require.Error(t, err)
+	_, _, err = AdvanceBlindedPath(Users[Charlie], viaCharlie, 11500, 1101)
+	require.Error(t, err)
+	_, err = SelectBlindedPath(
+		Users[Charlie], []*BlindedPath{viaCharlie}, 10000, 1050,
+	)
+	require.Error(t, err)
+
+	// Dave is next to Eve, who is her own introduction node.
+	selected, err = SelectBlindedPath(
+		Users[Dave], []*BlindedPath{eveOnly}, 10000, 1000,
+	)
+	require.NoError(t, err)
+	require.Len(t, selected.Route, 1)
+	require.EqualValues(t, 10000, selected.IntroAmount)
+	payEve(selected)
+
+	// Alice reaches Eve over the rest of the channels.
+	selected, err = SelectBlindedPath(
+		Users[Alice], []*BlindedPath{eveOnly}, 10000, 1000,
+	)
+	require.NoError(t, err)
+	require.Len(t, selected.Route, 4)
+	payEve(selected, Bob, Charlie, Dave)
+
+	// Eve can't pay herself over her own path.
+	_, err = SelectBlindedPath(
+		Users[Eve], []*BlindedPath{eveOnly}, 10000, 1000,
+	)
+	require.Error(t, err)
+}
@@ -0,0 +1,215 @@
+package onion
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"sort"
+)
+
+// Channel is a channel between two nodes.
+type Channel struct {
+	SCID  ShortChannelID
+	Node1 *btcec.PublicKey
+	Node2 *btcec.PublicKey
+}
+
+// SCIDDir identifies a node as one end of a channel. It is the compact form
+// that BOLT 12 allows for the introduction node of a blinded path.
+type SCIDDir struct {
+	SCID ShortChannelID
+
+	// Direction is 0 for the node of the channel with the lesser pub key
+	// and 1 for the node with the greater pub key.
+	Direction uint8
+}
+
+// String returns the short channel ID and direction of the SCIDDir.
+func (s SCIDDir) String() string {
+	return fmt.Sprintf("%s/%d", s.SCID, s.Direction)
+}
+
+// ChannelTable is a local table of channels that can be used to resolve the
+// short channel ID in a hop payload to the peer that the onion should be
+// forwarded to.
+type ChannelTable struct {
+	channels map[ShortChannelID]*Channel
+}
+
+// NewChannelTable creates an empty ChannelTable.
+func NewChannelTable() *ChannelTable {
+	return &ChannelTable{
+		channels: make(map[ShortChannelID]*Channel),
+	}
+}
+
+// AddChannel adds a channel between the two given nodes to the table.
+func (c *ChannelTable) AddChannel(scid ShortChannelID, node1,
+	node2 *btcec.PublicKey) {
+
+	c.channels[scid] = &Channel{
+		SCID:  scid,
+		Node1: node1,
+		Node2: node2,
+	}
+}
+
+// Channels returns all the channels in the table that the given node is a
+// part of, ordered by short channel ID.
+func (c *ChannelTable) Channels(node *btcec.PublicKey) []*Channel {
+	if c == nil {
+		return nil
+	}
+
+	var channels []*Channel
+	for _, channel := range c.channels {
+		if channel.Node1.IsEqual(node) || channel.Node2.IsEqual(node) {
+			channels = append(channels, channel)
+		}
+	}
+
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].SCID.ToUint64() < channels[j].SCID.ToUint64()
+	})
+
+	return channels
+}
+
+// Peer returns the node on the other end of the given channel from self.
+func (c *ChannelTable) Peer(scid ShortChannelID,
+	self *btcec.PublicKey) (*btcec.PublicKey, error) {
+
+	if c == nil {
+		return nil, fmt.Errorf("unknown channel %s", scid)
+	}
+
+	channel, ok := c.channels[scid]
+	if !ok {
+		return nil, fmt.Errorf("unknown channel %s", scid)
+	}
+
+	switch {
+	case channel.Node1.IsEqual(self):
+		return channel.Node2, nil
+	case channel.Node2.IsEqual(self):
+		return channel.Node1, nil
+	default:
+		return nil, fmt.Errorf("not a party to channel %s", scid)
+	}
+}
+
+// ChannelBetween returns the short channel ID of a channel between the two
+// given nodes.
+func (c *ChannelTable) ChannelBetween(a,
+	b *btcec.PublicKey) (ShortChannelID, bool) {
+
+	for _, channel := range c.Channels(a) {
+		if channel.Node1.IsEqual(b) || channel.Node2.IsEqual(b) {
+			return channel.SCID, true
+		}
+	}
+
+	return ShortChannelID{}, false
+}
+
+// Route returns the shortest route of channels from one node to another. The
+// route holds the nodes after from, ending with to. False is returned if there
+// is no route between the nodes.
+func (c *ChannelTable) Route(from, to *btcec.PublicKey) ([]*btcec.PublicKey,
+	bool) {
+
+	if from.IsEqual(to) {
+		return nil, true
+	}
+
+	// Search outwards from the sender, remembering how each node was
+	// reached so that the route can be walked back from the destination.
+	key := func(k *btcec.PublicKey) string {
+		return string(k.SerializeCompressed())
+	}
+	prev := map[string]*btcec.PublicKey{key(from): nil}
+	queue := []*btcec.PublicKey{from}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+
+		for _, channel := range c.Channels(node) {
+			peer := channel.Node1
+			if peer.IsEqual(node) {
+				peer = channel.Node2
+			}
+
+			if _, ok := prev[key(peer)]; ok {
+				continue
+			}
+			prev[key(peer)] = node
+
+			if !peer.IsEqual(to) {
+				queue = append(queue, peer)
+				continue
+			}
+
+			var route []*btcec.PublicKey
+			for n := peer; !n.IsEqual(from); n = prev[key(n)] {
+				route = append([]*btcec.PublicKey{n}, route...)
+			}
+
+			return route, true
+		}
+	}
+
+	return nil, false
+}
+
+// SCIDDir returns the SCIDDir that identifies the given node by the first of
+// its channels. False is returned if the node has no channels.
+func (c *ChannelTable) SCIDDir(node *btcec.PublicKey) (SCIDDir, bool) {
+	channels := c.Channels(node)
+	if len(channels) == 0 {
+		return SCIDDir{}, false
+	}
+
+	channel := channels[0]
+	dir := SCIDDir{SCID: channel.SCID}
+	if !node.IsEqual(lesserNode(channel)) {
+		dir.Direction = 1
+	}
+
+	return dir, true
+}
+
+// Node returns the node that the SCIDDir identifies.
+func (c *ChannelTable) Node(dir SCIDDir) (*btcec.PublicKey, error) {
+	if c == nil {
+		return nil, fmt.Errorf("unknown channel %s", dir.SCID)
+	}
+
+	channel, ok := c.channels[dir.SCID]
+	if !ok {
+		return nil, fmt.Errorf("unknown channel %s", dir.SCID)
+	}
+
+	lesser := lesserNode(channel)
+	switch {
+	case dir.Direction == 0:
+		return lesser, nil
+	case dir.Direction != 1:
+		return nil, fmt.Errorf("invalid direction %d", dir.Direction)
+	case lesser == channel.Node1:
+		return channel.Node2, nil
+	default:
+		return channel.Node1, nil
+	}
+}
+
+// lesserNode returns the node of the channel with the lexicographically lesser
+// compressed pub key.
+func lesserNode(channel *Channel) *btcec.PublicKey {
+	if bytes.Compare(channel.Node1.SerializeCompressed(),
+		channel.Node2.SerializeCompressed()) < 0 {
+
+		return channel.Node1
+	}
+
+	return channel.Node2
+}
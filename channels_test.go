@@ -0,0 +1,114 @@
+package onion
+
+import (
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestChannelTable(t *testing.T) {
+	a, _ := btcec.NewPrivateKey()
+	b, _ := btcec.NewPrivateKey()
+	c, _ := btcec.NewPrivateKey()
+
+	table := NewChannelTable()
+	ab := ShortChannelID{BlockHeight: 1}
+	bc := ShortChannelID{BlockHeight: 2}
+	table.AddChannel(ab, a.PubKey(), b.PubKey())
+	table.AddChannel(bc, b.PubKey(), c.PubKey())
+
+	peer, err := table.Peer(ab, a.PubKey())
+	require.NoError(t, err)
+	require.True(t, peer.IsEqual(b.PubKey()))
+
+	peer, err = table.Peer(bc, c.PubKey())
+	require.NoError(t, err)
+	require.True(t, peer.IsEqual(b.PubKey()))
+
+	// A is not part of the B-C channel.
+	_, err = table.Peer(bc, a.PubKey())
+	require.Error(t, err)
+
+	_, err = table.Peer(ShortChannelID{BlockHeight: 3}, a.PubKey())
+	require.Error(t, err)
+
+	scid, ok := table.ChannelBetween(c.PubKey(), b.PubKey())
+	require.True(t, ok)
+	require.Equal(t, bc, scid)
+
+	_, ok = table.ChannelBetween(a.PubKey(), c.PubKey())
+	require.False(t, ok)
+
+	require.Len(t, table.Channels(b.PubKey()), 2)
+}
+
+func TestChannelTableRoute(t *testing.T) {
+	a, _ := btcec.NewPrivateKey()
+	b, _ := btcec.NewPrivateKey()
+	c, _ := btcec.NewPrivateKey()
+	d, _ := btcec.NewPrivateKey()
+	e, _ := btcec.NewPrivateKey()
+
+	// A - B - C - D
+	//  \_______/
+	table := NewChannelTable()
+	table.AddChannel(ShortChannelID{BlockHeight: 1}, a.PubKey(), b.PubKey())
+	table.AddChannel(ShortChannelID{BlockHeight: 2}, b.PubKey(), c.PubKey())
+	table.AddChannel(ShortChannelID{BlockHeight: 3}, c.PubKey(), d.PubKey())
+	table.AddChannel(ShortChannelID{BlockHeight: 4}, a.PubKey(), c.PubKey())
+
+	route, ok := table.Route(a.PubKey(), d.PubKey())
+	require.True(t, ok)
+	require.Len(t, route, 2)
+	require.True(t, route[0].IsEqual(c.PubKey()))
+	require.True(t, route[1].IsEqual(d.PubKey()))
+
+	route, ok = table.Route(d.PubKey(), b.PubKey())
+	require.True(t, ok)
+	require.Len(t, route, 2)
+	require.True(t, route[1].IsEqual(b.PubKey()))
+
+	route, ok = table.Route(a.PubKey(), a.PubKey())
+	require.True(t, ok)
+	require.Empty(t, route)
+
+	_, ok = table.Route(a.PubKey(), e.PubKey())
+	require.False(t, ok)
+}
+
+func TestChannelTableSCIDDir(t *testing.T) {
+	a, _ := btcec.NewPrivateKey()
+	b, _ := btcec.NewPrivateKey()
+	c, _ := btcec.NewPrivateKey()
+
+	table := NewChannelTable()
+	ab := ShortChannelID{BlockHeight: 1}
+	table.AddChannel(ab, a.PubKey(), b.PubKey())
+
+	// Each end of the channel gets its own direction, whichever order the
+	// nodes were added in.
+	dirA, ok := table.SCIDDir(a.PubKey())
+	require.True(t, ok)
+	dirB, ok := table.SCIDDir(b.PubKey())
+	require.True(t, ok)
+	require.Equal(t, ab, dirA.SCID)
+	require.Equal(t, ab, dirB.SCID)
+	require.NotEqual(t, dirA.Direction, dirB.Direction)
+
+	node, err := table.Node(dirA)
+	require.NoError(t, err)
+	require.True(t, node.IsEqual(a.PubKey()))
+
+	node, err = table.Node(dirB)
+	require.NoError(t, err)
+	require.True(t, node.IsEqual(b.PubKey()))
+
+	_, ok = table.SCIDDir(c.PubKey())
+	require.False(t, ok)
+
+	_, err = table.Node(SCIDDir{SCID: ab, Direction: 2})
+	require.Error(t, err)
+
+	_, err = table.Node(SCIDDir{SCID: ShortChannelID{BlockHeight: 2}})
+	require.Error(t, err)
+}
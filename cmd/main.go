@@ -3,32 +3,133 @@ package main
 import (
 	"bufio"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/urfave/cli"
 	"log"
+	"math"
 	"onion"
+	"onion/tlv"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
+// onionFlags are the flags needed to peel an onion.
+var onionFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:     "payload",
+		Required: true,
+	},
+	cli.StringFlag{
+		Name: "ephemeral",
+	},
+}
+
+var holdTimeFlag = cli.DurationFlag{
+	Name:  "holdTime",
+	Usage: "how long the user held the HTLC for, eg: 1.5s",
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "onion"
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name: "user",
-			Usage: "The user the command is for. Options " +
-				"include: alice, bob, charlie, dave",
-			Required: true,
+			Usage: "The user the command is for, either the " +
+				"alias or the pub key of a user. The " +
+				"example users are alice, bob, charlie, " +
+				"dave and eve. See the keys command for " +
+				"adding more",
+		},
+		cli.StringFlag{
+			Name: "signer",
+			Usage: "The unix socket of a signer process that " +
+				"holds the user's key, see the signer command",
+		},
+		cli.StringFlag{
+			Name: "passphrase",
+			Usage: "The passphrase of any encrypted key files " +
+				"in the keystore",
+			EnvVar: "ONION_PASSPHRASE",
+		},
+		cli.StringFlag{
+			Name: "seed",
+			Usage: "A hex encoded seed of at least 16 bytes that " +
+				"new node and session keys are derived from " +
+				"instead of being random",
+		},
+		cli.UintFlag{
+			Name: "keyIndex",
+			Usage: "The index of the key to derive from the " +
+				"seed",
+		},
+		cli.StringFlag{
+			Name: "dataDir",
+			Usage: "The directory that the keystore and each " +
+				"user's replay log and issued blinded paths " +
+				"are stored in",
+			Value: ".onion",
 		},
 	}
+	app.Before = loadKeystore
 	app.Commands = []cli.Command{
+		{
+			Name:  "keys",
+			Usage: "manage the users in the keystore",
+			Subcommands: cli.Commands{
+				{
+					Name:   "new",
+					Usage:  "create a new user",
+					Action: newKey,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:     "alias",
+							Usage:    "the alias of the user",
+							Required: true,
+						},
+						cli.BoolFlag{
+							Name: "encrypt",
+							Usage: "encrypt the key with " +
+								"the passphrase",
+						},
+					},
+				},
+				{
+					Name:   "list",
+					Usage:  "list all known users",
+					Action: listKeys,
+				},
+			},
+		},
 		{
 			Name:   "info",
 			Action: nodeInfo,
 		},
+		{
+			Name: "signer",
+			Usage: "run a signer process for the user that " +
+				"other commands can use with --signer",
+			Action: runSigner,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "socket",
+					Usage:    "the unix socket to listen on",
+					Required: true,
+				},
+			},
+		},
+		{
+			Name:   "channels",
+			Usage:  "list the user's channels",
+			Action: listChannels,
+		},
 		{
 			Name: "build",
 			Subcommands: cli.Commands{
@@ -37,9 +138,14 @@ func main() {
 					Action: buildOnion,
 					Flags: []cli.Flag{
 						cli.StringFlag{
-							Name:     "hops",
-							Usage:    "structure: hop1_alias,hop2_alias,...",
-							Required: true,
+							Name: "hops",
+							Usage: "structure: hop1_alias," +
+								"hop2_alias,... not needed " +
+								"with blindedRoutes, and " +
+								"may be left out with " +
+								"blindedRoute if the user " +
+								"is next to or is its " +
+								"entry node",
 						},
 						cli.StringFlag{
 							Name:  "payloads",
@@ -49,19 +155,161 @@ func main() {
 							Name:  "blindedRoute",
 							Usage: "encoded blinded route",
 						},
+						cli.StringFlag{
+							Name: "blindedRoutes",
+							Usage: "encoded list of blinded " +
+								"routes to pick one from, " +
+								"the route to it is found " +
+								"from the user's channels " +
+								"and the other flags are " +
+								"only for the final hop",
+						},
+						cli.StringFlag{
+							Name: "payInfo",
+							Usage: "encoded pay info of the " +
+								"blinded route, used to " +
+								"work out the amount " +
+								"and CLTV for the entry " +
+								"node from those of the " +
+								"final hop",
+						},
+						cli.StringFlag{
+							Name: "amounts",
+							Usage: "amt_to_forward in msat for " +
+								"each hop. structure: amt 1,amt 2,...",
+						},
+						cli.StringFlag{
+							Name: "cltvs",
+							Usage: "outgoing_cltv_value for each " +
+								"hop. structure: cltv 1,cltv 2,...",
+						},
+						cli.StringFlag{
+							Name:  "paymentSecret",
+							Usage: "hex payment secret for the final hop",
+						},
+						cli.Uint64Flag{
+							Name: "totalAmount",
+							Usage: "total payment amount in msat for " +
+								"the final hop's payment_data",
+						},
+						cli.StringFlag{
+							Name:  "paymentMetadata",
+							Usage: "hex payment metadata for the final hop",
+						},
+						cli.BoolFlag{
+							Name: "fwdBySCID",
+							Usage: "tell each hop which channel to " +
+								"forward over instead of including " +
+								"the next node's pub key",
+						},
+						cli.IntFlag{
+							Name: "packetSize",
+							Usage: "the size of the hop " +
+								"payloads of the onion",
+							Value: onion.PaymentPacketSize,
+						},
 					},
 				},
 				{
 					Name: "blindedRoute",
 					Flags: []cli.Flag{
 						cli.StringFlag{
-							Name:     "hops",
-							Usage:    "structure: hop1_alias,hop2_alias,...",
+							Name: "hops",
+							Usage: "structure: hop1_alias," +
+								"hop2_alias,... with the " +
+								"hops of each path " +
+								"separated by ;",
 							Required: true,
 						},
 						cli.StringFlag{
-							Name:  "payloads",
-							Usage: "structure: payload 1,payload 2,...",
+							Name: "payloads",
+							Usage: "structure: payload 1," +
+								"payload 2,... with the " +
+								"payloads of each path " +
+								"separated by ;",
+						},
+						cli.BoolFlag{
+							Name: "fwdBySCID",
+							Usage: "tell each hop which channel to " +
+								"forward over instead of including " +
+								"the next node's pub key",
+						},
+						cli.IntFlag{
+							Name: "dummyHops",
+							Usage: "the number of dummy hops " +
+								"to add to the end of the " +
+								"path to hide its length",
+						},
+						cli.BoolFlag{
+							Name: "pad",
+							Usage: "pad the encrypted data " +
+								"for each hop to the " +
+								"same length",
+						},
+						cli.StringFlag{
+							Name: "nextPath",
+							Usage: "encoded blinded route " +
+								"to join to the end of " +
+								"the path, the hops then " +
+								"lead up to its entry " +
+								"node and --relays has " +
+								"a relay for each of " +
+								"them",
+						},
+						cli.StringFlag{
+							Name: "nextPayInfo",
+							Usage: "encoded pay info of " +
+								"the next path",
+						},
+						cli.BoolFlag{
+							Name: "compact",
+							Usage: "identify the entry node " +
+								"by one of its channels " +
+								"instead of its pub key",
+						},
+						cli.UintFlag{
+							Name: "expiry",
+							Usage: "the block height after " +
+								"which the path is no " +
+								"longer accepted, 0 " +
+								"means never",
+						},
+						cli.StringFlag{
+							Name: "relays",
+							Usage: "the payment relay for " +
+								"each hop except the " +
+								"last. structure: " +
+								"fee_base:fee_rate:" +
+								"cltv_delta,... with the " +
+								"relays of each path " +
+								"separated by ;",
+						},
+						cli.UintFlag{
+							Name: "maxCltv",
+							Usage: "the largest CLTV expiry " +
+								"of an HTLC that each " +
+								"hop accepts over the " +
+								"path",
+						},
+						cli.Uint64Flag{
+							Name: "minHtlc",
+							Usage: "the smallest HTLC in " +
+								"msat that each hop " +
+								"accepts over the path",
+						},
+						cli.Uint64Flag{
+							Name: "maxHtlc",
+							Usage: "the largest HTLC in " +
+								"msat that each hop " +
+								"can forward over the " +
+								"path",
+						},
+						cli.StringFlag{
+							Name: "allowedFeatures",
+							Usage: "hex feature bit vector " +
+								"of the features that " +
+								"each hop allows the " +
+								"sender to use",
 						},
 					}, Action: buildBlindedRoute,
 				},
@@ -70,303 +318,1830 @@ func main() {
 		{
 			Name:   "parse",
 			Action: parseOnion,
-			Flags: []cli.Flag{
-				cli.StringFlag{
-					Name:     "payload",
+			Flags: append([]cli.Flag{
+				cli.UintFlag{
+					Name: "incomingCltv",
+					Usage: "the CLTV expiry of the HTLC " +
+						"that carried the onion, " +
+						"the onion is kept in the " +
+						"replay log until it expires",
 					Required: true,
 				},
-				cli.StringFlag{
-					Name: "ephemeral",
+				cli.Uint64Flag{
+					Name: "incomingAmt",
+					Usage: "the amount in msat of the " +
+						"HTLC that carried the onion",
+				},
+				cli.UintFlag{
+					Name: "currentHeight",
+					Usage: "the current block height, " +
+						"replay log entries and " +
+						"blinded paths that expired " +
+						"before it are removed",
+				},
+			}, onionFlags...),
+		},
+		{
+			Name:  "message",
+			Usage: "send and parse onion messages",
+			Subcommands: cli.Commands{
+				{
+					Name: "send",
+					Usage: "build an onion message from the " +
+						"user to the last of the hops",
+					Action: sendMessage,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:     "hops",
+							Usage:    "structure: hop1_alias,hop2_alias,...",
+							Required: true,
+						},
+						cli.StringFlag{
+							Name: "message",
+							Usage: "the text message for " +
+								"the final hop",
+						},
+						cli.StringFlag{
+							Name: "replyHops",
+							Usage: "the hops of a reply " +
+								"path back to the user, " +
+								"structure: hop1_alias," +
+								"hop2_alias,...",
+						},
+					},
+				},
+				{
+					Name: "reply",
+					Usage: "reply to an onion message along " +
+						"the reply path that came with it",
+					Action: replyToMessage,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:     "replyPath",
+							Usage:    "the encoded reply path",
+							Required: true,
+						},
+						cli.StringFlag{
+							Name: "message",
+							Usage: "the text message for " +
+								"the sender",
+						},
+					},
+				},
+				{
+					Name: "parse",
+					Usage: "process an onion message as the " +
+						"user, the ephemeral flag is the " +
+						"path key given with the message",
+					Action: parseMessage,
+					Flags:  onionFlags,
+				},
+			},
+		},
+		{
+			Name:  "error",
+			Usage: "create, forward and decrypt onion failures",
+			Subcommands: cli.Commands{
+				{
+					Name: "create",
+					Usage: "create a failure for the onion " +
+						"received by the user",
+					Action: createError,
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name: "failure",
+							Usage: "the BOLT 4 name of the " +
+								"failure, eg: " +
+								"temporary_node_failure",
+						},
+						cli.StringFlag{
+							Name: "message",
+							Usage: "a free form failure " +
+								"message to send instead " +
+								"of a BOLT 4 failure",
+						},
+						cli.BoolFlag{
+							Name: "attributable",
+							Usage: "add attribution data " +
+								"to the failure",
+						},
+						holdTimeFlag,
+					}, onionFlags...),
+				},
+				{
+					Name: "forward",
+					Usage: "add the user's obfuscation layer to " +
+						"a failure received from the next hop",
+					Action: forwardError,
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:     "error",
+							Usage:    "the failure from the next hop",
+							Required: true,
+						},
+						cli.StringFlag{
+							Name: "attribution",
+							Usage: "the attribution data " +
+								"from the next hop",
+						},
+						holdTimeFlag,
+					}, onionFlags...),
+				},
+				{
+					Name: "decrypt",
+					Usage: "decrypt a failure as the sender of " +
+						"the onion",
+					Action: decryptError,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:     "error",
+							Usage:    "the failure to decrypt",
+							Required: true,
+						},
+						cli.StringFlag{
+							Name: "sessionKey",
+							Usage: "the session key used to " +
+								"build the onion",
+							Required: true,
+						},
+						cli.StringFlag{
+							Name: "hops",
+							Usage: "structure: hop1_alias," +
+								"hop2_alias,... may be left " +
+								"out with blindedRoute if " +
+								"the user is next to or is " +
+								"its entry node",
+						},
+						cli.StringFlag{
+							Name:  "blindedRoute",
+							Usage: "encoded blinded route",
+						},
+						cli.StringFlag{
+							Name: "attribution",
+							Usage: "the attribution data " +
+								"of the failure",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "vectors",
+			Usage: "work with the BOLT 4 test vectors",
+			Subcommands: cli.Commands{
+				{
+					Name: "verify",
+					Usage: "check that the library matches " +
+						"a JSON test vector",
+					ArgsUsage: "<file>",
+					Action:    verifyVectors,
+				},
+				{
+					Name: "generate",
+					Usage: "generate a JSON test vector " +
+						"from a scenario file",
+					ArgsUsage: "<scenario file>",
+					Action:    generateVectors,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "out",
+							Usage: "the file to write " +
+								"the test vector to " +
+								"instead of stdout",
+						},
+					},
 				},
 			},
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		log.Fatalln(err)
+	if err := app.Run(os.Args); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// keystoreDir returns the directory that users are loaded from.
+func keystoreDir(ctx *cli.Context) string {
+	return filepath.Join(ctx.GlobalString("dataDir"), "keys")
+}
+
+// passphrase returns the keystore passphrase or nil if there is none.
+func passphrase(ctx *cli.Context) []byte {
+	if ctx.GlobalString("passphrase") == "" {
+		return nil
+	}
+
+	return []byte(ctx.GlobalString("passphrase"))
+}
+
+// loadKeystore adds the users in the keystore to the default registry.
+func loadKeystore(ctx *cli.Context) error {
+	return onion.DefaultRegistry.LoadKeystore(
+		keystoreDir(ctx), passphrase(ctx),
+	)
+}
+
+// seedDeriver returns the deriver for the seed flag or nil if it isn't set.
+func seedDeriver(ctx *cli.Context) (*onion.SeedDeriver, error) {
+	if ctx.GlobalString("seed") == "" {
+		return nil, nil
+	}
+
+	seed, err := hex.DecodeString(ctx.GlobalString("seed"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid seed: %w", err)
+	}
+
+	return onion.NewSeedDeriver(seed)
+}
+
+// newSessionKey returns a random session key, or the session key derived from
+// the seed at the key index if the seed flag is set.
+func newSessionKey(ctx *cli.Context) (*btcec.PrivateKey, error) {
+	deriver, err := seedDeriver(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if deriver == nil {
+		return btcec.NewPrivateKey()
+	}
+
+	return deriver.SessionKey(uint32(ctx.GlobalUint("keyIndex"))), nil
+}
+
+func newKey(ctx *cli.Context) error {
+	deriver, err := seedDeriver(ctx)
+	if err != nil {
+		return err
+	}
+
+	var privKey *btcec.PrivateKey
+	if deriver != nil {
+		privKey = deriver.NodeKey(uint32(ctx.GlobalUint("keyIndex")))
+	} else {
+		privKey, err = btcec.NewPrivateKey()
+		if err != nil {
+			return err
+		}
+	}
+
+	var pass []byte
+	if ctx.Bool("encrypt") {
+		pass = passphrase(ctx)
+		if pass == nil {
+			return errors.New("a passphrase is needed to encrypt " +
+				"the key")
+		}
+	}
+
+	user := onion.NewUser(ctx.String("alias"), onion.NewPrivKeySigner(
+		privKey,
+	))
+	if err := onion.DefaultRegistry.Add(user); err != nil {
+		return err
+	}
+
+	path, err := onion.WriteKeyFile(
+		keystoreDir(ctx), ctx.String("alias"), privKey, pass,
+	)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %s with public key %x in %s\n", user.Name,
+		user.PubKey.SerializeCompressed(), path)
+
+	return nil
+}
+
+func listKeys(_ *cli.Context) error {
+	for _, alias := range onion.DefaultRegistry.Aliases() {
+		fmt.Printf("%s: %x\n", alias,
+			onion.Users[alias].PubKey.SerializeCompressed())
+	}
+
+	return nil
+}
+
+// getSigningUser returns the user given by the global user flag. If the signer
+// flag is set, the user's key operations are done by the signer process
+// listening on that socket.
+func getSigningUser(ctx *cli.Context) (*onion.User, error) {
+	user, err := onion.GetUser(ctx.GlobalString("user"))
+	if err != nil {
+		return nil, err
+	}
+
+	socket := ctx.GlobalString("signer")
+	if socket == "" {
+		if user.Signer == nil {
+			return nil, fmt.Errorf("no key for %s, use --signer",
+				user.Name)
+		}
+
+		return user, nil
+	}
+
+	signer, err := onion.NewRemoteSigner(socket)
+	if err != nil {
+		return nil, err
+	}
+
+	if !signer.PubKey().IsEqual(user.PubKey) {
+		signer.Close()
+		return nil, fmt.Errorf("signer at %s does not hold %s's key",
+			socket, user.Name)
+	}
+	user.Signer = signer
+
+	return user, nil
+}
+
+func runSigner(ctx *cli.Context) error {
+	user, err := onion.GetUser(ctx.GlobalString("user"))
+	if err != nil {
+		return err
+	}
+
+	// A signer can only serve a key that it holds.
+	if user.Signer == nil {
+		return fmt.Errorf("no key for %s, load it from the keystore",
+			user.Name)
+	}
+
+	server, err := onion.NewSignerServer(user.Signer, ctx.String("socket"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Signing for %s on %s, press ctrl-c to stop\n", user.Name,
+		ctx.String("socket"))
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	<-interrupt
+
+	return server.Stop()
+}
+
+func nodeInfo(ctx *cli.Context) error {
+	// Get user.
+	user, err := onion.GetUser(ctx.GlobalString("user"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s's public key is: %s\n", user.Name,
+		hex.EncodeToString(user.PubKey.SerializeCompressed()))
+
+	return nil
+}
+
+func listChannels(ctx *cli.Context) error {
+	user, err := onion.GetUser(ctx.GlobalString("user"))
+	if err != nil {
+		return err
+	}
+
+	for _, channel := range user.Channels.Channels(user.PubKey) {
+		peer, err := user.Channels.Peer(channel.SCID, user.PubKey)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s -> %s\n", channel.SCID,
+			onion.DefaultRegistry.Alias(peer))
+	}
+
+	return nil
+}
+
+// setForwardingChannels tells each hop which channel to use to forward to the
+// following hop by looking up the channel between them in the user's channel
+// table.
+func setForwardingChannels(user *onion.User, hopsData []*onion.HopData) error {
+	for i := 0; i < len(hopsData)-1; i++ {
+		scid, ok := user.Channels.ChannelBetween(
+			hopsData[i].PubKey, hopsData[i+1].PubKey,
+		)
+		if !ok {
+			return fmt.Errorf("no channel between hop %d and hop %d",
+				i, i+1)
+		}
+
+		hopsData[i].ShortChannelID = &scid
+	}
+
+	return nil
+}
+
+func buildBlindedRoute(ctx *cli.Context) error {
+	user, err := onion.GetUser(ctx.GlobalString("user"))
+	if err != nil {
+		return err
+	}
+
+	// Each of the paths is given by its own list of hops, payloads and
+	// relays, separated by semicolons.
+	hopsList := strings.Split(ctx.String("hops"), ";")
+	payloadsList, err := splitPaths(ctx.String("payloads"), len(hopsList))
+	if err != nil {
+		return err
+	}
+
+	relaysList, err := splitPaths(ctx.String("relays"), len(hopsList))
+	if err != nil {
+		return err
+	}
+
+	var nextPath *onion.BlindedPath
+	if ctx.String("nextPath") != "" {
+		if len(hopsList) > 1 {
+			return fmt.Errorf("only one path can be joined to the " +
+				"next path")
+		}
+
+		nextPath, err = parseNextPath(ctx, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	pathStore, err := openPathStore(ctx, user)
+	if err != nil {
+		return err
+	}
+	defer pathStore.Close()
+
+	paths := make([]*onion.BlindedPath, len(hopsList))
+	for i, hops := range hopsList {
+		hopsData, err := parseHops(hops, payloadsList[i])
+		if err != nil {
+			return err
+		}
+
+		// The hops of a path that is joined to the next path lead up
+		// to its entry node. It is added as the last hop so that the
+		// relays and channels of our hops are worked out as usual.
+		if nextPath != nil {
+			hopsData = append(hopsData, &onion.HopData{
+				PubKey: nextPath.EntryNodeID,
+			})
+		}
+
+		if nextPath == nil &&
+			!hopsData[len(hopsData)-1].PubKey.IsEqual(user.PubKey) {
+
+			return fmt.Errorf("last hop must be same as user")
+		}
+
+		if ctx.Bool("fwdBySCID") {
+			err := setForwardingChannels(user, hopsData)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = addPaymentPolicy(ctx, hopsData, relaysList[i])
+		if err != nil {
+			return err
+		}
+
+		paths[i], err = buildPath(
+			ctx, user, hopsData, pathStore, nextPath,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, path := range paths {
+		fmt.Println(path)
+	}
+
+	if len(paths) > 1 {
+		fmt.Printf("Encoded Paths: %x\n",
+			onion.EncodeBlindedPaths(paths))
+	}
+
+	return nil
+}
+
+// splitPaths splits a flag value into the values for each of the paths. An
+// empty value gives an empty value for every path.
+func splitPaths(value string, numPaths int) ([]string, error) {
+	if value == "" {
+		return make([]string, numPaths), nil
+	}
+
+	values := strings.Split(value, ";")
+	if len(values) != numPaths {
+		return nil, fmt.Errorf("num values (%d) does not match num "+
+			"paths (%d): %s", len(values), numPaths, value)
+	}
+
+	return values, nil
+}
+
+// buildPath builds a blinded path to the user over the given hops and adds
+// its path ID to the user's path store. If there is a next path, then the last
+// of the hops is its entry node and the path is joined to it instead.
+func buildPath(ctx *cli.Context, user *onion.User, hopsData []*onion.HopData,
+	pathStore onion.PathStore,
+	nextPath *onion.BlindedPath) (*onion.BlindedPath, error) {
+
+	ephemeralKey, err := newSessionKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		opts   []onion.BlindedPathOption
+		pathID []byte
+	)
+	if nextPath != nil {
+		hopsData = hopsData[:len(hopsData)-1]
+		opts = append(opts, onion.WithNextPath(nextPath))
+	} else {
+		// Remember the path so that we only accept onions built from
+		// it.
+		pathID, err = onion.NewPathID()
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts,
+			onion.WithDummyHops(ctx.Int("dummyHops")),
+			onion.WithPathID(pathID),
+		)
+	}
+
+	expiry := uint32(ctx.Uint("expiry"))
+	if expiry == 0 {
+		expiry = math.MaxUint32
+	}
+
+	if ctx.Bool("pad") {
+		opts = append(opts, onion.WithPadding())
+	}
+	if ctx.Bool("compact") {
+		opts = append(
+			opts, onion.WithCompactEntryNode(user.Channels),
+		)
+	}
+
+	blindedPath, err := onion.BuildBlindedPath(
+		ephemeralKey, hopsData, opts...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if pathID == nil {
+		return blindedPath, nil
+	}
+
+	if err := pathStore.Add(pathID, expiry); err != nil {
+		return nil, err
+	}
+
+	return blindedPath, nil
+}
+
+// parseNextPath decodes the blinded path from the nextPath flag along with its
+// pay info from the nextPayInfo flag.
+func parseNextPath(ctx *cli.Context,
+	user *onion.User) (*onion.BlindedPath, error) {
+
+	nextPathB, err := hex.DecodeString(ctx.String("nextPath"))
+	if err != nil {
+		return nil, err
+	}
+
+	nextPath, err := onion.DecodeBlindedPath(nextPathB)
+	if err != nil {
+		return nil, err
+	}
+
+	err = nextPath.ResolveEntryNode(user.Channels)
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx.String("nextPayInfo") == "" {
+		return nextPath, nil
+	}
+
+	payInfoB, err := hex.DecodeString(ctx.String("nextPayInfo"))
+	if err != nil {
+		return nil, err
+	}
+
+	nextPath.PayInfo, err = onion.DecodeBlindedPayInfo(payInfoB)
+	if err != nil {
+		return nil, err
+	}
+
+	return nextPath, nil
+}
+
+// addPaymentPolicy adds the given payment relays and the constraints from the
+// flags to the hops of a blinded path.
+func addPaymentPolicy(ctx *cli.Context, hopsData []*onion.HopData,
+	r string) error {
+
+	if r != "" {
+		relays := strings.Split(r, ",")
+		if len(relays) != len(hopsData)-1 {
+			return fmt.Errorf("num relays (%d) does not match num "+
+				"hops before the recipient (%d)", len(relays),
+				len(hopsData)-1)
+		}
+
+		for i, relay := range relays {
+			parts := strings.Split(strings.TrimSpace(relay), ":")
+			if len(parts) != 3 {
+				return fmt.Errorf("invalid relay: %s", relay)
+			}
+
+			var values [3]uint64
+			for j, bits := range []int{32, 32, 16} {
+				v, err := strconv.ParseUint(parts[j], 10, bits)
+				if err != nil {
+					return err
+				}
+				values[j] = v
+			}
+
+			hopsData[i].PaymentRelay = &onion.PaymentRelay{
+				FeeBaseMsat:               uint32(values[0]),
+				FeeProportionalMillionths: uint32(values[1]),
+				CltvExpiryDelta:           uint16(values[2]),
+			}
+		}
+	}
+
+	features, err := hex.DecodeString(ctx.String("allowedFeatures"))
+	if err != nil {
+		return fmt.Errorf("invalid allowed features: %w", err)
+	}
+
+	for _, hop := range hopsData {
+		hop.HtlcMaximumMsat = ctx.Uint64("maxHtlc")
+		if len(features) != 0 {
+			hop.AllowedFeatures = features
+		}
+	}
+
+	if !ctx.IsSet("maxCltv") && !ctx.IsSet("minHtlc") {
+		return nil
+	}
+
+	maxCltv := uint32(ctx.Uint("maxCltv"))
+	if !ctx.IsSet("maxCltv") {
+		maxCltv = math.MaxUint32
+	}
+
+	for _, hop := range hopsData {
+		hop.PaymentConstraints = &onion.PaymentConstraints{
+			MaxCltvExpiry:   maxCltv,
+			HtlcMinimumMsat: ctx.Uint64("minHtlc"),
+		}
+	}
+
+	return nil
+}
+
+func parseHopData(ctx *cli.Context) ([]*onion.HopData, error) {
+	return parseHops(ctx.String("hops"), ctx.String("payloads"))
+}
+
+// parseHops looks up the users in the comma separated list of hops and gives
+// each the matching payload. The user is asked for the payloads if there are
+// none.
+func parseHops(hopsStr, pl string) ([]*onion.HopData, error) {
+	hops := strings.Split(hopsStr, ",")
+
+	var payloads []string
+	if pl != "" {
+		payloads = strings.Split(pl, ",")
+		if len(payloads) != len(hops) {
+			return nil, errors.New(fmt.Sprintf("num payloads (%d) "+
+				"does not match num hops (%d)", len(payloads),
+				len(hops)))
+		}
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	hopsData := make([]*onion.HopData, len(hops))
+	for i, hop := range hops {
+		user, err := onion.GetUser(hop)
+		if err != nil {
+			return nil, err
+		}
+
+		payload := ""
+		if len(payloads) == 0 {
+			fmt.Printf("Enter message for %s: ", user.Name)
+			payload, err = reader.ReadString('\n')
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			payload = payloads[i]
+		}
+
+		hopsData[i] = &onion.HopData{
+			PubKey:    user.PubKey,
+			ClearData: []byte(payload),
+		}
+	}
+
+	return hopsData, nil
+}
+
+// addPaymentInfo sets the per-hop forwarding amounts and CLTV values along with
+// the final hop's payment data from the command line flags.
+func addPaymentInfo(ctx *cli.Context, hopsData []*onion.HopData) error {
+	if amts := ctx.String("amounts"); amts != "" {
+		amounts := strings.Split(amts, ",")
+		if len(amounts) != len(hopsData) {
+			return fmt.Errorf("num amounts (%d) does not match num "+
+				"hops (%d)", len(amounts), len(hopsData))
+		}
+
+		for i, amt := range amounts {
+			a, err := strconv.ParseUint(strings.TrimSpace(amt), 10, 64)
+			if err != nil {
+				return err
+			}
+
+			hopsData[i].AmtToForward = a
+		}
+	}
+
+	if c := ctx.String("cltvs"); c != "" {
+		cltvs := strings.Split(c, ",")
+		if len(cltvs) != len(hopsData) {
+			return fmt.Errorf("num cltvs (%d) does not match num "+
+				"hops (%d)", len(cltvs), len(hopsData))
+		}
+
+		for i, cltv := range cltvs {
+			c, err := strconv.ParseUint(strings.TrimSpace(cltv), 10, 32)
+			if err != nil {
+				return err
+			}
+
+			hopsData[i].OutgoingCLTV = uint32(c)
+		}
+	}
+
+	finalHop := hopsData[len(hopsData)-1]
+
+	if secret := ctx.String("paymentSecret"); secret != "" {
+		secretB, err := hex.DecodeString(secret)
+		if err != nil {
+			return err
+		}
+
+		if len(secretB) != 32 {
+			return fmt.Errorf("payment secret must be 32 bytes")
+		}
+
+		finalHop.PaymentData = &onion.PaymentData{
+			TotalMsat: ctx.Uint64("totalAmount"),
+		}
+		copy(finalHop.PaymentData.PaymentSecret[:], secretB)
+	}
+
+	if metadata := ctx.String("paymentMetadata"); metadata != "" {
+		metadataB, err := hex.DecodeString(metadata)
+		if err != nil {
+			return err
+		}
+
+		finalHop.PaymentMetadata = metadataB
+	}
+
+	return nil
+}
+
+func buildOnion(ctx *cli.Context) error {
+	if ctx.String("blindedRoutes") != "" {
+		return buildOnionWithBlindedPaths(ctx)
+	}
+
+	blindedRoute := ctx.String("blindedRoute")
+	if blindedRoute != "" {
+		return buildOnionWithBlindedPath(ctx)
+	}
+
+	if ctx.String("hops") == "" {
+		return fmt.Errorf("hops must be given")
+	}
+
+	hopsData, err := parseHopData(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := addPaymentInfo(ctx, hopsData); err != nil {
+		return err
+	}
+
+	if ctx.Bool("fwdBySCID") {
+		user, err := onion.GetUser(ctx.GlobalString("user"))
+		if err != nil {
+			return err
+		}
+
+		if err := setForwardingChannels(user, hopsData); err != nil {
+			return err
+		}
+	}
+
+	sessionKey, err := newSessionKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	leOnion, _, err := onion.BuildOnion(
+		sessionKey, hopsData, onion.WithPacketSize(ctx.Int("packetSize")),
+	)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Onion: %s\n", hex.EncodeToString(leOnion.Serialize()))
+	fmt.Printf("Session key (needed to decrypt errors): %x\n",
+		sessionKey.Serialize())
+	fmt.Printf("Give this onion to: %s\n",
+		onion.DefaultRegistry.Alias(hopsData[0].PubKey))
+
+	return nil
+}
+
+func buildOnionWithBlindedPath(ctx *cli.Context) error {
+	blindedRouteB, err := hex.DecodeString(ctx.String("blindedRoute"))
+	if err != nil {
+		return err
+	}
+
+	blindedPath, err := onion.DecodeBlindedPath(blindedRouteB)
+	if err != nil {
+		return err
+	}
+
+	// A compact path only gives the channel of the entry node, so the
+	// sender looks it up in its own channels.
+	sender, err := onion.GetUser(ctx.GlobalString("user"))
+	if err != nil {
+		return err
+	}
+
+	err = blindedPath.ResolveEntryNode(sender.Channels)
+	if err != nil {
+		return err
+	}
+
+	// With the pay info, we can work out the HTLC that must reach the
+	// entry node for the final hop to get its amount and CLTV.
+	introAmt, introCLTV, err := introductionHTLC(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Get clear-text hops.
+	hops, blindedPath, entryData, err := blindedRouteStart(
+		ctx, sender, blindedPath, introAmt, introCLTV,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Get the payloads for each hop (the payload from the sender hop).
+	// Ensure that the number of payloads == number of blinded hops + num
+	// clear text hops.
+	pl := ctx.String("payloads")
+	var payloads []string
+	payloads = strings.Split(pl, ",")
+	if len(payloads) != len(hops)+len(blindedPath.BlindedNodeIDs) {
+		return errors.New(fmt.Sprintf("num payloads (%d) does not "+
+			"match num hops (%d)", len(payloads),
+			len(hops)+len(blindedPath.BlindedNodeIDs)))
+	}
+
+	// Before we continue, ensure that the last clear-text hop is the same
+	// as the entry point hop in the blinded path.
+	user, err := onion.GetUser(hops[len(hops)-1])
+	if err != nil {
+		return err
+	}
+
+	if !user.PubKey.IsEqual(blindedPath.EntryNodeID) {
+		return fmt.Errorf("last clear text hop is not equal to the " +
+			"blinded path entry point hop")
+	}
+
+	// Gather all the info for each hop along the full path.
+	hopsData := make(
+		[]*onion.HopData,
+		len(hops)+len(blindedPath.BlindedNodeIDs),
+	)
+
+	hopIndex := 0
+	// First, add all the clear text hops (all the ones before the entry
+	// point hop).
+	for _, hop := range hops[:len(hops)-1] {
+		user, err := onion.GetUser(hop)
+		if err != nil {
+			return err
+		}
+
+		payload := payloads[hopIndex]
+
+		hopsData[hopIndex] = &onion.HopData{
+			PubKey:    user.PubKey,
+			ClearData: []byte(payload),
+		}
+
+		hopIndex++
+	}
+
+	// Now we add the entry node hop. This is the only hop to which we
+	// also need to add the ephemeral point.
+	hopsData[hopIndex] = &onion.HopData{
+		PubKey:        blindedPath.EntryNodeID,
+		ClearData:     []byte(payloads[hopIndex]),
+		EncryptedData: blindedPath.EncryptedData[0],
+		EphemeralKey:  blindedPath.FirstBlindingEphemeralKey,
+	}
+
+	hopIndex++
+
+	// Now we can add the blinded hops. For these, we need to include the
+	// encrypted data from the recipient.
+	for i, id := range blindedPath.BlindedNodeIDs {
+		hopsData[hopIndex] = &onion.HopData{
+			PubKey:        id,
+			ClearData:     []byte(payloads[hopIndex]),
+			EncryptedData: blindedPath.EncryptedData[i+1],
+		}
+
+		hopIndex++
+	}
+
+	if err := addPaymentInfo(ctx, hopsData); err != nil {
+		return err
+	}
+
+	if ctx.String("payInfo") != "" {
+		// If we are the entry node, then the next node gets what our
+		// own relay policy in the path forwards.
+		if entryData != nil && entryData.PaymentRelay != nil {
+			introAmt, introCLTV, err = entryData.PaymentRelay.Forward(
+				introAmt, introCLTV,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The hop before the entry node forwards that HTLC.
+		if len(hops) > 1 {
+			hopsData[len(hops)-2].AmtToForward = introAmt
+			hopsData[len(hops)-2].OutgoingCLTV = introCLTV
+		}
+	}
+
+	// Only the clear text hops up to the entry node can be told which
+	// channel to use.
+	if ctx.Bool("fwdBySCID") {
+		sender, err := onion.GetUser(ctx.GlobalString("user"))
+		if err != nil {
+			return err
+		}
+
+		err = setForwardingChannels(sender, hopsData[:len(hops)])
+		if err != nil {
+			return err
+		}
+	}
+
+	sessionKey, err := newSessionKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	leOnion, _, err := onion.BuildOnion(
+		sessionKey, hopsData, onion.WithPacketSize(ctx.Int("packetSize")),
+	)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("-------------------------------------------------------")
+	fmt.Println("Onion: ", hex.EncodeToString(leOnion.Serialize()))
+	fmt.Printf("Session key (needed to decrypt errors): %x\n",
+		sessionKey.Serialize())
+	fmt.Printf("Give this onion to: %s\n",
+		onion.DefaultRegistry.Alias(hopsData[0].PubKey))
+	if introAmt != 0 {
+		fmt.Printf("Entry node HTLC: %d msat with CLTV %d\n",
+			introAmt, introCLTV)
+	}
+	fmt.Println("-------------------------------------------------------")
+
+	return nil
+}
+
+// introductionHTLC works out the HTLC that must reach the entry node of a
+// blinded path from the pay info flag, for the final hop to get the last of the
+// amounts and CLTVs from the flags. Without pay info, the HTLC is unknown and
+// zero is returned.
+func introductionHTLC(ctx *cli.Context) (uint64, uint32, error) {
+	if ctx.String("payInfo") == "" {
+		return 0, 0, nil
+	}
+
+	payInfoB, err := hex.DecodeString(ctx.String("payInfo"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	payInfo, err := onion.DecodeBlindedPayInfo(payInfoB)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var amt uint64
+	if amts := ctx.String("amounts"); amts != "" {
+		amounts := strings.Split(amts, ",")
+		amt, err = strconv.ParseUint(
+			strings.TrimSpace(amounts[len(amounts)-1]), 10, 64,
+		)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var cltv uint64
+	if c := ctx.String("cltvs"); c != "" {
+		cltvs := strings.Split(c, ",")
+		cltv, err = strconv.ParseUint(
+			strings.TrimSpace(cltvs[len(cltvs)-1]), 10, 32,
+		)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return payInfo.IntroductionHTLC(amt, uint32(cltv))
+}
+
+// blindedRouteStart returns the clear text hops from the hops flag, which end
+// with the entry node of the blinded path. If the flag is not set, then the
+// sender is either next to the entry node or is the entry node itself. In the
+// latter case, the sender processes its own hop of the path for the given HTLC
+// and the rest of the path is returned, with the next node as its entry node,
+// along with the data from the recipient for the sender's hop.
+func blindedRouteStart(ctx *cli.Context, sender *onion.User,
+	path *onion.BlindedPath, amt uint64, cltv uint32) ([]string,
+	*onion.BlindedPath, *onion.RecipientData, error) {
+
+	if ctx.String("hops") != "" {
+		return strings.Split(ctx.String("hops"), ","), path, nil, nil
+	}
+
+	var entryData *onion.RecipientData
+	if path.EntryNodeID.IsEqual(sender.PubKey) {
+		var err error
+		path, entryData, err = onion.AdvanceBlindedPath(
+			sender, path, amt, cltv,
+		)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	entryNode := hex.EncodeToString(path.EntryNodeID.SerializeCompressed())
+
+	return []string{entryNode}, path, entryData, nil
+}
+
+func buildOnionWithBlindedPaths(ctx *cli.Context) error {
+	blindedRoutesB, err := hex.DecodeString(ctx.String("blindedRoutes"))
+	if err != nil {
+		return err
+	}
+
+	paths, err := onion.DecodeBlindedPaths(blindedRoutesB)
+	if err != nil {
+		return err
+	}
+
+	sender, err := onion.GetUser(ctx.GlobalString("user"))
+	if err != nil {
+		return err
+	}
+
+	// All the flags are for the final hop, the pub key and encrypted data
+	// of which come from the path that we pick.
+	finalHop := &onion.HopData{
+		ClearData: []byte(ctx.String("payloads")),
+	}
+	err = addPaymentInfo(ctx, []*onion.HopData{finalHop})
+	if err != nil {
+		return err
+	}
+
+	selected, err := onion.SelectBlindedPath(
+		sender, paths, finalHop.AmtToForward, finalHop.OutgoingCLTV,
+	)
+	if err != nil {
+		return err
+	}
+
+	sessionKey, err := newSessionKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	leOnion, _, err := selected.BuildOnion(
+		sessionKey, finalHop,
+		onion.WithPacketSize(ctx.Int("packetSize")),
+	)
+	if err != nil {
+		return err
+	}
+
+	var route []string
+	for _, node := range selected.Route {
+		route = append(route, onion.DefaultRegistry.Alias(node))
+	}
+
+	fmt.Println("-------------------------------------------------------")
+	fmt.Println("Onion: ", hex.EncodeToString(leOnion.Serialize()))
+	fmt.Printf("Session key (needed to decrypt errors): %x\n",
+		sessionKey.Serialize())
+	fmt.Printf("Picked the blinded route from %s of %d hops, reached "+
+		"over: %s\n",
+		onion.DefaultRegistry.Alias(selected.Path.EntryNodeID),
+		len(selected.Path.BlindedNodeIDs)+1, strings.Join(route, ","))
+	fmt.Printf("Give this onion to: %s\n", route[0])
+	fmt.Printf("Entry node HTLC: %d msat with CLTV %d\n",
+		selected.IntroAmount, selected.IntroCLTV)
+	fmt.Println("-------------------------------------------------------")
+
+	return nil
+}
+
+// peelOnion peels the onion given by the payload and ephemeral flags as the
+// user given by the global user flag.
+func peelOnion(ctx *cli.Context) (*onion.HopPayload, *onion.Onion, error) {
+	payload, err := hex.DecodeString(ctx.String("payload"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	onionPacket, err := onion.DeserializeOnion(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := getSigningUser(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ep := ctx.String("ephemeral")
+	if ep != "" {
+		epb, err := hex.DecodeString(ep)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		nextEphemeral, err := btcec.ParsePubKey(epb)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		onionPacket.EphemeralKey = nextEphemeral
+	}
+	onionPacket.IncomingCLTV = uint32(ctx.Uint("incomingCltv"))
+	onionPacket.IncomingAmount = ctx.Uint64("incomingAmt")
+
+	return onion.Peel(user, onionPacket)
+}
+
+// openReplayLog opens the user's replay log in the data directory and removes
+// any entries that have expired.
+func openReplayLog(ctx *cli.Context, user *onion.User) (*onion.FileReplayLog,
+	error) {
+
+	dataDir := ctx.GlobalString("dataDir")
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+
+	replayLog, err := onion.OpenFileReplayLog(filepath.Join(
+		dataDir, strings.ToLower(user.Name)+".replay",
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	err = replayLog.Expire(uint32(ctx.Uint("currentHeight")))
+	if err != nil {
+		replayLog.Close()
+		return nil, err
+	}
+
+	return replayLog, nil
+}
+
+// openPathStore opens the store of the blinded paths that the user issued in
+// the data directory.
+func openPathStore(ctx *cli.Context, user *onion.User) (*onion.FilePathStore,
+	error) {
+
+	dataDir := ctx.GlobalString("dataDir")
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+
+	return onion.OpenFilePathStore(filepath.Join(
+		dataDir, strings.ToLower(user.Name)+".paths",
+	))
+}
+
+func parseOnion(ctx *cli.Context) error {
+	user, err := onion.GetUser(ctx.GlobalString("user"))
+	if err != nil {
+		return err
+	}
+
+	replayLog, err := openReplayLog(ctx, user)
+	if err != nil {
+		return err
+	}
+	defer replayLog.Close()
+	user.ReplayLog = replayLog
+
+	pathStore, err := openPathStore(ctx, user)
+	if err != nil {
+		return err
+	}
+	defer pathStore.Close()
+
+	err = pathStore.Expire(uint32(ctx.Uint("currentHeight")))
+	if err != nil {
+		return err
+	}
+	user.PathStore = pathStore
+
+	myPayload, nextOnion, err := peelOnion(ctx)
+	if errors.Is(err, onion.ErrReplayedPacket) {
+		return fmt.Errorf("%s has already processed this onion, it "+
+			"should be failed back to the sender", user.Name)
+	}
+	var failure onion.FailureMessage
+	if errors.As(err, &failure) && failure.Code().IsBadOnion() {
+		// We couldn't derive the shared secret so the failure can only
+		// be reported to the previous hop in the clear.
+		fmt.Println("Unable to process onion, send " +
+			"update_fail_malformed_htlc to the previous hop with:")
+		fmt.Printf("Failure code: %d\n", uint16(failure.Code()))
+		fmt.Println("Failure: ", failure)
+
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	hopData := myPayload.Data
+
+	fmt.Println("-------------------------------------------------------")
+	fmt.Println("Payload from Sender: \"", string(hopData.ClearData), "\"")
+	fmt.Println("Payload from Recipient: \"",
+		string(myPayload.DecryptedDataFromRecipient), "\"")
+
+	if hopData.AmtToForward != 0 {
+		fmt.Println("Amount to forward (msat): ", hopData.AmtToForward)
+	}
+	if hopData.OutgoingCLTV != 0 {
+		fmt.Println("Outgoing CLTV: ", hopData.OutgoingCLTV)
+	}
+	if hopData.ShortChannelID != nil {
+		fmt.Println("Short channel ID: ", hopData.ShortChannelID)
+	}
+	if hopData.PaymentData != nil {
+		fmt.Printf("Payment secret: %x\n",
+			hopData.PaymentData.PaymentSecret)
+		fmt.Println("Total amount (msat): ",
+			hopData.PaymentData.TotalMsat)
+	}
+	if len(hopData.PaymentMetadata) != 0 {
+		fmt.Printf("Payment metadata: %x\n", hopData.PaymentMetadata)
+	}
+	if len(myPayload.PathID) != 0 {
+		fmt.Printf("Path ID: %x\n", myPayload.PathID)
+	}
+
+	if myPayload.FwdTo == nil {
+		fmt.Println("Final hop! Can chill now")
+		return nil
+	}
+
+	fmt.Println("Onion: ", hex.EncodeToString(nextOnion.Serialize()))
+	fmt.Println("Should forward onion onto: ",
+		onion.DefaultRegistry.Alias(myPayload.FwdTo))
+
+	if nextOnion.EphemeralKey != nil {
+		fmt.Printf("Next Ephemeral: %x\n",
+			nextOnion.EphemeralKey.SerializeCompressed())
+	}
+	fmt.Println("-------------------------------------------------------")
+
+	return nil
+}
+
+func sendMessage(ctx *cli.Context) error {
+	var route []*btcec.PublicKey
+	for _, hop := range strings.Split(ctx.String("hops"), ",") {
+		user, err := onion.GetUser(hop)
+		if err != nil {
+			return err
+		}
+
+		route = append(route, user.PubKey)
+	}
+
+	content := tlv.Stream{
+		onion.TextContentType: []byte(ctx.String("message")),
+	}
+
+	sessionKey, err := newSessionKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	pathKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		return err
+	}
+
+	var opts []onion.MessageOption
+	if ctx.String("replyHops") != "" {
+		replyPath, err := buildReplyPath(ctx)
+		if err != nil {
+			return err
+		}
+
+		opts = append(opts, onion.WithReplyPath(replyPath))
+	}
+
+	msg, err := onion.BuildOnionMessage(
+		sessionKey, pathKey, route, content, opts...,
+	)
+	if err != nil {
+		return err
+	}
+
+	printMessage(msg, route[0])
+
+	return nil
+}
+
+// buildReplyPath builds a blinded path from the reply hops back to the user.
+func buildReplyPath(ctx *cli.Context) (*onion.BlindedPath, error) {
+	user, err := onion.GetUser(ctx.GlobalString("user"))
+	if err != nil {
+		return nil, err
+	}
+
+	var hopsData []*onion.HopData
+	for _, hop := range strings.Split(ctx.String("replyHops"), ",") {
+		hopUser, err := onion.GetUser(hop)
+		if err != nil {
+			return nil, err
+		}
+
+		hopsData = append(hopsData, &onion.HopData{
+			PubKey: hopUser.PubKey,
+		})
+	}
+	hopsData = append(hopsData, &onion.HopData{
+		PubKey: user.PubKey,
+	})
+
+	pathKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return onion.BuildBlindedPath(pathKey, hopsData)
+}
+
+func replyToMessage(ctx *cli.Context) error {
+	replyPathB, err := hex.DecodeString(ctx.String("replyPath"))
+	if err != nil {
+		return err
+	}
+
+	replyPath, err := onion.DecodeBlindedPath(replyPathB)
+	if err != nil {
+		return fmt.Errorf("invalid reply path: %w", err)
 	}
-}
 
-func nodeInfo(ctx *cli.Context) error {
-	// Get user.
 	user, err := onion.GetUser(ctx.GlobalString("user"))
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("%s's public key is: %s\n", user.Name,
-		hex.EncodeToString(user.PubKey.SerializeCompressed()))
+	if err := replyPath.ResolveEntryNode(user.Channels); err != nil {
+		return err
+	}
+
+	content := tlv.Stream{
+		onion.TextContentType: []byte(ctx.String("message")),
+	}
+
+	sessionKey, err := newSessionKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	msg, err := onion.BuildMessageReply(sessionKey, replyPath, content)
+	if err != nil {
+		return err
+	}
+
+	printMessage(msg, replyPath.EntryNodeID)
 
 	return nil
 }
 
-func buildBlindedRoute(ctx *cli.Context) error {
-	hopsData, err := parseHopData(ctx)
+// printMessage prints a new onion message along with the path key and the
+// node that they should be given to.
+func printMessage(msg *onion.Onion, firstHop *btcec.PublicKey) {
+	fmt.Printf("Onion: %s\n", hex.EncodeToString(msg.Serialize()))
+	fmt.Printf("Path key: %x\n", msg.EphemeralKey.SerializeCompressed())
+	fmt.Printf("Give this onion and path key to: %s\n",
+		onion.DefaultRegistry.Alias(firstHop))
+}
+
+// printMessageHandler prints the onion messages that the user receives.
+type printMessageHandler struct{}
+
+func (printMessageHandler) HandleMessage(content tlv.Stream,
+	replyPath *onion.BlindedPath) error {
+
+	fmt.Println("Final hop! Received message:")
+	for _, t := range content.Types() {
+		if t == onion.TextContentType {
+			fmt.Printf("Text: \"%s\"\n", content[t])
+			continue
+		}
+
+		fmt.Printf("Record %d: %x\n", t, content[t])
+	}
+
+	if replyPath != nil {
+		fmt.Println("Reply path:")
+		fmt.Print(replyPath)
+	}
+
+	return nil
+}
+
+func parseMessage(ctx *cli.Context) error {
+	payload, err := hex.DecodeString(ctx.String("payload"))
 	if err != nil {
 		return err
 	}
 
-	user, err := onion.GetUser(ctx.GlobalString("user"))
+	msg, err := onion.DeserializeOnion(payload)
 	if err != nil {
 		return err
 	}
 
-	if !hopsData[len(hopsData)-1].PubKey.IsEqual(user.PubKey) {
-		return fmt.Errorf("last hop must be same as user")
+	if ctx.String("ephemeral") == "" {
+		return errors.New("the path key given with the message is " +
+			"needed")
 	}
 
-	ephemeralKey, err := btcec.NewPrivateKey()
+	pathKeyB, err := hex.DecodeString(ctx.String("ephemeral"))
 	if err != nil {
 		return err
 	}
 
-	blindedPath, err := onion.BuildBlindedPath(ephemeralKey, hopsData)
+	msg.EphemeralKey, err = btcec.ParsePubKey(pathKeyB)
+	if err != nil {
+		return fmt.Errorf("invalid path key: %w", err)
+	}
+
+	user, err := getSigningUser(ctx)
 	if err != nil {
 		return err
 	}
+	user.MessageHandler = printMessageHandler{}
+
+	fmt.Println("-------------------------------------------------------")
+
+	myPayload, next, err := onion.PeelMessage(user, msg)
+	if err != nil {
+		return fmt.Errorf("dropping message: %w", err)
+	}
+
+	if len(myPayload.RecipientData.Payload) != 0 {
+		fmt.Println("Payload from Recipient: \"",
+			string(myPayload.RecipientData.Payload), "\"")
+	}
+
+	if next != nil {
+		fmt.Println("Onion: ", hex.EncodeToString(next.Serialize()))
+		fmt.Printf("Path key: %x\n",
+			next.EphemeralKey.SerializeCompressed())
+		fmt.Println("Should forward onion and path key onto: ",
+			onion.DefaultRegistry.Alias(myPayload.NextNodeID))
+	}
+	fmt.Println("-------------------------------------------------------")
 
-	fmt.Println(blindedPath)
 	return nil
 }
 
-func parseHopData(ctx *cli.Context) ([]*onion.HopData, error) {
-	hopsStr := ctx.String("hops")
-	hops := strings.Split(hopsStr, ",")
-
-	pl := ctx.String("payloads")
-	var payloads []string
-	if pl != "" {
-		payloads = strings.Split(pl, ",")
-		if len(payloads) != len(hops) {
-			return nil, errors.New(fmt.Sprintf("num payloads (%d) "+
-				"does not match num hops (%d)", len(payloads),
-				len(hops)))
-		}
+func createError(ctx *cli.Context) error {
+	myPayload, _, err := peelOnion(ctx)
+	if err != nil {
+		return err
 	}
 
-	reader := bufio.NewReader(os.Stdin)
-	hopsData := make([]*onion.HopData, len(hops))
-	for i, hop := range hops {
-		user, err := onion.GetUser(hop)
+	var msg []byte
+	switch {
+	case ctx.String("failure") != "":
+		code, err := onion.ParseFailCode(ctx.String("failure"))
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		payload := ""
-		if len(payloads) == 0 {
-			fmt.Printf("Enter message for %s: ", user.Name)
-			payload, err = reader.ReadString('\n')
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			payload = payloads[i]
+		failure, err := onion.NewFailureMessage(code)
+		if err != nil {
+			return err
 		}
 
-		hopsData[i] = &onion.HopData{
-			PubKey:    user.PubKey,
-			ClearData: []byte(payload),
+		// Let the sender know which amount we were asked to accept.
+		details, ok := failure.(*onion.FailIncorrectOrUnknownPaymentDetails)
+		if ok {
+			details.HtlcMsat = myPayload.Data.AmtToForward
 		}
-	}
 
-	return hopsData, nil
-}
+		msg = onion.EncodeFailureMessage(failure)
 
-func buildOnion(ctx *cli.Context) error {
-	blindedRoute := ctx.String("blindedRoute")
-	if blindedRoute != "" {
-		return buildOnionWithBlindedPath(ctx)
-	}
+	case ctx.String("message") != "":
+		msg = []byte(ctx.String("message"))
 
-	hopsData, err := parseHopData(ctx)
-	if err != nil {
-		return err
+	default:
+		return errors.New("either failure or message must be set")
 	}
 
-	sessionKey, err := btcec.NewPrivateKey()
-	if err != nil {
-		return err
+	encrypter := myPayload.ErrorEncrypter()
+	if ctx.Bool("attributable") {
+		failure, attribution, err := encrypter.EncryptAttributableError(
+			msg, ctx.Duration("holdTime"),
+		)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Error: %x\n", failure)
+		fmt.Printf("Attribution: %x\n", attribution)
+		fmt.Println("Send this error and attribution back to the hop " +
+			"that you received the onion from")
+
+		return nil
 	}
 
-	leOnion, err := onion.BuildOnion(sessionKey, hopsData)
+	failure, err := encrypter.EncryptError(msg)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Onion: %s\n", hex.EncodeToString(leOnion.Serialize()))
-	fmt.Printf("Give this onion to: %s\n",
-		onion.UserIndex[string(hopsData[0].PubKey.SerializeCompressed())])
+	fmt.Printf("Error: %x\n", failure)
+	fmt.Println("Send this error back to the hop that you received the " +
+		"onion from")
 
 	return nil
 }
 
-func buildOnionWithBlindedPath(ctx *cli.Context) error {
-	blindedRouteB, err := hex.DecodeString(ctx.String("blindedRoute"))
+func forwardError(ctx *cli.Context) error {
+	failure, err := hex.DecodeString(ctx.String("error"))
 	if err != nil {
 		return err
 	}
 
-	blindedPath, err := onion.DecodeBlindedPath(blindedRouteB)
+	myPayload, _, err := peelOnion(ctx)
 	if err != nil {
 		return err
 	}
 
-	// Get clear-text hops.
-	hopsStr := ctx.String("hops")
-	hops := strings.Split(hopsStr, ",")
+	encrypter := myPayload.ErrorEncrypter()
+	if ctx.String("attribution") != "" {
+		attribution, err := hex.DecodeString(ctx.String("attribution"))
+		if err != nil {
+			return err
+		}
 
-	// Get the payloads for each hop (the payload from the sender hop).
-	// Ensure that the number of payloads == number of blinded hops + num
-	// clear text hops.
-	pl := ctx.String("payloads")
-	var payloads []string
-	payloads = strings.Split(pl, ",")
-	if len(payloads) != len(hops)+len(blindedPath.BlindedNodeIDs) {
-		return errors.New(fmt.Sprintf("num payloads (%d) does not "+
-			"match num hops (%d)", len(payloads),
-			len(hops)+len(blindedPath.BlindedNodeIDs)))
+		failure, attribution, err = encrypter.ObfuscateAttributableError(
+			failure, attribution, ctx.Duration("holdTime"),
+		)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Error: %x\n", failure)
+		fmt.Printf("Attribution: %x\n", attribution)
+		fmt.Println("Send this error and attribution back to the hop " +
+			"that you received the onion from")
+
+		return nil
 	}
 
-	// Before we continue, ensure that the last clear-text hop is the same
-	// as the entry point hop in the blinded path.
-	user, err := onion.GetUser(hops[len(hops)-1])
+	fmt.Printf("Error: %x\n", encrypter.ObfuscateError(failure))
+	fmt.Println("Send this error back to the hop that you received the " +
+		"onion from")
+
+	return nil
+}
+
+func decryptError(ctx *cli.Context) error {
+	failure, err := hex.DecodeString(ctx.String("error"))
 	if err != nil {
 		return err
 	}
 
-	if !user.PubKey.IsEqual(blindedPath.EntryNodeID) {
-		return fmt.Errorf("last clear text hop is not equal to the " +
-			"blinded path entry point hop")
+	sessionKeyB, err := hex.DecodeString(ctx.String("sessionKey"))
+	if err != nil {
+		return err
 	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(sessionKeyB)
 
-	// Gather all the info for each hop along the full path.
-	hopsData := make(
-		[]*onion.HopData,
-		len(hops)+len(blindedPath.BlindedNodeIDs),
-	)
+	// Gather the pub keys of the route: the clear text hops followed by
+	// the blinded hops if there are any.
+	hops := strings.Split(ctx.String("hops"), ",")
+	var blindedPath *onion.BlindedPath
+	if ctx.String("blindedRoute") != "" {
+		blindedRouteB, err := hex.DecodeString(ctx.String("blindedRoute"))
+		if err != nil {
+			return err
+		}
 
-	hopIndex := 0
-	// First, add all the clear text hops (all the ones before the entry
-	// point hop).
-	for _, hop := range hops[:len(hops)-1] {
-		user, err := onion.GetUser(hop)
+		blindedPath, err = onion.DecodeBlindedPath(blindedRouteB)
 		if err != nil {
 			return err
 		}
 
-		payload := payloads[hopIndex]
+		sender, err := onion.GetUser(ctx.GlobalString("user"))
+		if err != nil {
+			return err
+		}
 
-		hopsData[hopIndex] = &onion.HopData{
-			PubKey:    user.PubKey,
-			ClearData: []byte(payload),
+		err = blindedPath.ResolveEntryNode(sender.Channels)
+		if err != nil {
+			return err
 		}
 
-		hopIndex++
+		// Only the route matters here, so the sender's own hop is
+		// given an HTLC that meets any payment constraints.
+		hops, blindedPath, _, err = blindedRouteStart(
+			ctx, sender, blindedPath, math.MaxUint64, 0,
+		)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Now we add the entry node hop. This is the only hop to which we
-	// also need to add the ephemeral point.
-	hopsData[hopIndex] = &onion.HopData{
-		PubKey:        blindedPath.EntryNodeID,
-		ClearData:     []byte(payloads[hopIndex]),
-		EncryptedData: blindedPath.EncryptedData[0],
-		EphemeralKey:  blindedPath.FirstBlindingEphemeralKey,
+	var route []*btcec.PublicKey
+	for _, hop := range hops {
+		user, err := onion.GetUser(hop)
+		if err != nil {
+			return err
+		}
+
+		route = append(route, user.PubKey)
 	}
 
-	hopIndex++
+	if blindedPath != nil {
+		route = append(route, blindedPath.BlindedNodeIDs...)
+	}
 
-	// Now we can add the blinded hops. For these, we need to include the
-	// encrypted data from the recipient.
-	for i, id := range blindedPath.BlindedNodeIDs {
-		hopsData[hopIndex] = &onion.HopData{
-			PubKey:        id,
-			ClearData:     []byte(payloads[hopIndex]),
-			EncryptedData: blindedPath.EncryptedData[i+1],
+	decrypter := onion.NewErrorDecrypter(
+		onion.DeriveHops(sessionKey, route),
+	)
+	var decrypted *onion.DecryptedError
+	if ctx.String("attribution") != "" {
+		attribution, err := hex.DecodeString(ctx.String("attribution"))
+		if err != nil {
+			return err
 		}
 
-		hopIndex++
-	}
-
-	sessionKey, err := btcec.NewPrivateKey()
-	if err != nil {
-		return err
+		decrypted, err = decrypter.DecryptAttributableError(
+			failure, attribution,
+		)
+		if err != nil {
+			return err
+		}
+	} else {
+		decrypted, err = decrypter.DecryptError(failure)
+		if err != nil {
+			return err
+		}
 	}
 
-	leOnion, err := onion.BuildOnion(sessionKey, hopsData)
-	if err != nil {
-		return err
+	sender, ok := onion.UserIndex[string(decrypted.Sender.SerializeCompressed())]
+	if !ok {
+		sender = fmt.Sprintf("blinded hop %x",
+			decrypted.Sender.SerializeCompressed())
 	}
 
 	fmt.Println("-------------------------------------------------------")
-	fmt.Println("Onion: ", hex.EncodeToString(leOnion.Serialize()))
-	fmt.Printf("Give this onion to: %s\n",
-		onion.UserIndex[string(hopsData[0].PubKey.SerializeCompressed())])
+	fmt.Printf("Failure from hop %d: %s\n", decrypted.Index, sender)
+	if failure, err := decrypted.Failure(); err == nil {
+		fmt.Println("Failure: ", failure)
+	} else {
+		fmt.Printf("Message: \"%s\"\n", decrypted.Message)
+	}
+	for i, holdTime := range decrypted.HoldTimes {
+		fmt.Printf("Hop %d held the HTLC for %v\n", i, holdTime)
+	}
 	fmt.Println("-------------------------------------------------------")
 
 	return nil
 }
 
-func parseOnion(ctx *cli.Context) error {
-	payload, err := hex.DecodeString(ctx.String("payload"))
+func verifyVectors(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("expected the test vector file")
+	}
+
+	b, err := os.ReadFile(ctx.Args().First())
 	if err != nil {
 		return err
 	}
 
-	onionPacket, err := onion.DeserializeOnion(payload)
+	vector, err := onion.ParseTestVector(b)
 	if err != nil {
 		return err
 	}
 
-	// Get user.
-	user, err := onion.GetUser(ctx.GlobalString("user"))
+	err = vector.Verify()
+	var mismatch *onion.VectorMismatch
+	if errors.As(err, &mismatch) {
+		fmt.Printf("Expected: %s\n", mismatch.Expected)
+		fmt.Printf("Actual:   %s\n", mismatch.Actual)
+	}
 	if err != nil {
 		return err
 	}
 
-	ep := ctx.String("ephemeral")
-	if ep != "" {
-		epb, err := hex.DecodeString(ep)
-		if err != nil {
-			return err
-		}
+	fmt.Println("All values match the test vector")
 
-		nextEphemeral, err := btcec.ParsePubKey(epb)
-		if err != nil {
-			return err
-		}
+	return nil
+}
 
-		onionPacket.EphemeralKey = nextEphemeral
+func generateVectors(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("expected the scenario file")
 	}
 
-	myPayload, nextOnion, err := onion.Peel(user, onionPacket)
+	b, err := os.ReadFile(ctx.Args().First())
 	if err != nil {
 		return err
 	}
 
-	hopData, err := onion.DecodeHopDataPayload(myPayload.Payload)
+	scenario, err := onion.ParseScenario(b)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("-------------------------------------------------------")
-	fmt.Println("Payload from Sender: \"", string(hopData.ClearData), "\"")
-	fmt.Println("Payload from Recipient: \"",
-		string(myPayload.DecryptedDataFromRecipient), "\"")
-
-	if myPayload.FwdTo == nil {
-		fmt.Println("Final hop! Can chill now")
-		return nil
+	vector, err := scenario.GenerateTestVector()
+	if err != nil {
+		return err
 	}
 
-	fmt.Println("Onion: ", hex.EncodeToString(nextOnion.Serialize()))
-	fmt.Println("Should forward onion onto: ",
-		onion.UserIndex[string(myPayload.FwdTo.SerializeCompressed())])
+	b, err = json.MarshalIndent(vector, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
 
-	if nextOnion.EphemeralKey != nil {
-		fmt.Printf("Next Ephemeral: %x\n",
-			nextOnion.EphemeralKey.SerializeCompressed())
+	if ctx.String("out") == "" {
+		_, err := os.Stdout.Write(b)
+		return err
 	}
-	fmt.Println("-------------------------------------------------------")
 
-	return nil
+	return os.WriteFile(ctx.String("out"), b, 0644)
 }
@@ -0,0 +1,191 @@
+package onion
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"time"
+)
+
+const (
+	// minFailurePacketLen is the smallest valid failure packet: the HMAC
+	// followed by the failure and padding length fields.
+	minFailurePacketLen = 32 + 2 + 2
+
+	// failureMsgPadLen is the length that failure messages are padded to
+	// so that the length of a failure packet does not reveal the failure.
+	failureMsgPadLen = 256
+)
+
+// ErrUnattributableFailure is returned by the ErrorDecrypter if none of the
+// hops in the route could be identified as the creator of a failure packet.
+var ErrUnattributableFailure = errors.New("unable to attribute failure to " +
+	"any hop")
+
+// ErrorEncrypter is used by a hop to create a failure packet to send back
+// towards the origin of an onion, or to add its layer of obfuscation to a
+// failure packet received from further along the route.
+type ErrorEncrypter struct {
+	um       [32]byte
+	ammag    [32]byte
+	ammagext [32]byte
+}
+
+// NewErrorEncrypter creates an ErrorEncrypter from the shared secret that the
+// hop derived while peeling the onion.
+func NewErrorEncrypter(ss [32]byte) *ErrorEncrypter {
+	return &ErrorEncrypter{
+		um:       genKey(ss, umType),
+		ammag:    genKey(ss, ammagType),
+		ammagext: genKey(ss, ammagextType),
+	}
+}
+
+// EncryptError creates a new failure packet containing the given failure
+// message. The packet is structured as:
+//   - 32 byte HMAC over the rest of the packet using the um key
+//   - 2 byte failure message length
+//   - failure message
+//   - 2 byte padding length
+//   - padding
+//
+// and is then obfuscated with the ammag key stream.
+func (e *ErrorEncrypter) EncryptError(msg []byte) ([]byte, error) {
+	packet, err := e.failurePacket(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.ObfuscateError(packet), nil
+}
+
+// failurePacket creates the failure packet for the given message before it is
+// obfuscated.
+func (e *ErrorEncrypter) failurePacket(msg []byte) ([]byte, error) {
+	if len(msg) > 0xffff {
+		return nil, fmt.Errorf("failure message too long: %d", len(msg))
+	}
+
+	padLen := 0
+	if len(msg) < failureMsgPadLen {
+		padLen = failureMsgPadLen - len(msg)
+	}
+
+	payload := make([]byte, 2+len(msg)+2+padLen)
+	binary.BigEndian.PutUint16(payload[:2], uint16(len(msg)))
+	copy(payload[2:], msg)
+	binary.BigEndian.PutUint16(
+		payload[2+len(msg):4+len(msg)], uint16(padLen),
+	)
+
+	mac := calcMac(e.um, payload)
+
+	return append(mac[:], payload...), nil
+}
+
+// EncryptFailure creates a new failure packet containing the encoded failure
+// message.
+func (e *ErrorEncrypter) EncryptFailure(msg FailureMessage) ([]byte, error) {
+	return e.EncryptError(EncodeFailureMessage(msg))
+}
+
+// ObfuscateError adds this hop's layer of obfuscation to a failure packet
+// that was received from the next hop in the route.
+func (e *ErrorEncrypter) ObfuscateError(packet []byte) []byte {
+	stream := pSByteStream(e.ammag[:], len(packet))
+
+	obfuscated := make([]byte, len(packet))
+	xor(obfuscated, packet, stream)
+
+	return obfuscated
+}
+
+// DecryptedError is a failure that has been attributed to a hop in the route.
+type DecryptedError struct {
+	// Index is the position of the failing hop in the route.
+	Index int
+
+	// Sender is the pub key of the failing hop.
+	Sender *btcec.PublicKey
+
+	// Message is the failure message created by the failing hop.
+	Message []byte
+
+	// HoldTimes are the times that each hop up to and including the
+	// failing hop reported holding the HTLC for. This is only set for
+	// attributable failures.
+	HoldTimes []time.Duration
+}
+
+// Failure decodes the failure message created by the failing hop.
+func (d *DecryptedError) Failure() (FailureMessage, error) {
+	return DecodeFailureMessage(d.Message)
+}
+
+// ErrorDecrypter is used by the origin of an onion to work out which hop
+// created a failure packet and to read the failure message.
+type ErrorDecrypter struct {
+	// Hops are the hops of the route that the onion was sent along as
+	// returned by BuildOnion.
+	Hops []*Hop
+}
+
+// NewErrorDecrypter creates an ErrorDecrypter for the given route.
+func NewErrorDecrypter(hops []*Hop) *ErrorDecrypter {
+	return &ErrorDecrypter{
+		Hops: hops,
+	}
+}
+
+// DecryptError peels the obfuscation layers off of the failure packet one hop
+// at a time until it finds the hop whose um key produces a valid HMAC.
+func (d *ErrorDecrypter) DecryptError(packet []byte) (*DecryptedError,
+	error) {
+
+	if len(packet) < minFailurePacketLen {
+		return nil, fmt.Errorf("failure packet too short: %d",
+			len(packet))
+	}
+
+	for i, hop := range d.Hops {
+		packet = NewErrorEncrypter(hop.SS).ObfuscateError(packet)
+
+		msg, ok, err := readFailurePacket(hop.Um, packet)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		return &DecryptedError{
+			Index:   i,
+			Sender:  hop.P,
+			Message: msg,
+		}, nil
+	}
+
+	return nil, ErrUnattributableFailure
+}
+
+// readFailurePacket checks the HMAC of a de-obfuscated failure packet with the
+// given um key and returns the failure message if it is valid.
+func readFailurePacket(um [32]byte, packet []byte) ([]byte, bool, error) {
+	mac := calcMac(um, packet[32:])
+	if !hmac.Equal(mac[:], packet[:32]) {
+		return nil, false, nil
+	}
+
+	msgLen := int(binary.BigEndian.Uint16(packet[32:34]))
+	if 34+msgLen+2 > len(packet) {
+		return nil, false, fmt.Errorf("invalid failure message "+
+			"length: %d", msgLen)
+	}
+
+	msg := make([]byte, msgLen)
+	copy(msg, packet[34:34+msgLen])
+
+	return msg, true, nil
+}
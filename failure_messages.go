@@ -0,0 +1,625 @@
+package onion
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"onion/tlv"
+)
+
+// FailCode is the code of a BOLT 4 failure message. The top bits of the code
+// are flags that describe the failure.
+type FailCode uint16
+
+const (
+	// FlagBadOnion is set if the onion was unparsable by the failing
+	// node.
+	FlagBadOnion FailCode = 0x8000
+
+	// FlagPerm is set if the failure is permanent.
+	FlagPerm FailCode = 0x4000
+
+	// FlagNode is set if the failure is with the node itself rather than
+	// one of its channels.
+	FlagNode FailCode = 0x2000
+
+	// FlagUpdate is set if the failure includes a channel_update.
+	FlagUpdate FailCode = 0x1000
+)
+
+// The BOLT 4 failure codes.
+const (
+	CodeInvalidRealm                     = FlagPerm | 1
+	CodeTemporaryNodeFailure             = FlagNode | 2
+	CodePermanentNodeFailure             = FlagPerm | FlagNode | 2
+	CodeRequiredNodeFeatureMissing       = FlagPerm | FlagNode | 3
+	CodeInvalidOnionVersion              = FlagBadOnion | FlagPerm | 4
+	CodeInvalidOnionHmac                 = FlagBadOnion | FlagPerm | 5
+	CodeInvalidOnionKey                  = FlagBadOnion | FlagPerm | 6
+	CodeTemporaryChannelFailure          = FlagUpdate | 7
+	CodePermanentChannelFailure          = FlagPerm | 8
+	CodeRequiredChannelFeatureMissing    = FlagPerm | 9
+	CodeUnknownNextPeer                  = FlagPerm | 10
+	CodeAmountBelowMinimum               = FlagUpdate | 11
+	CodeFeeInsufficient                  = FlagUpdate | 12
+	CodeIncorrectCltvExpiry              = FlagUpdate | 13
+	CodeExpiryTooSoon                    = FlagUpdate | 14
+	CodeIncorrectOrUnknownPaymentDetails = FlagPerm | 15
+	CodeFinalIncorrectCltvExpiry         = FailCode(18)
+	CodeFinalIncorrectHtlcAmount         = FailCode(19)
+	CodeChannelDisabled                  = FlagUpdate | 20
+	CodeExpiryTooFar                     = FailCode(21)
+	CodeInvalidOnionPayload              = FlagPerm | 22
+	CodeMPPTimeout                       = FailCode(23)
+	CodeInvalidOnionBlinding             = FlagBadOnion | FlagPerm | 24
+)
+
+// failCodeNames maps each failure code to its name in BOLT 4.
+var failCodeNames = map[FailCode]string{
+	CodeInvalidRealm:                     "invalid_realm",
+	CodeTemporaryNodeFailure:             "temporary_node_failure",
+	CodePermanentNodeFailure:             "permanent_node_failure",
+	CodeRequiredNodeFeatureMissing:       "required_node_feature_missing",
+	CodeInvalidOnionVersion:              "invalid_onion_version",
+	CodeInvalidOnionHmac:                 "invalid_onion_hmac",
+	CodeInvalidOnionKey:                  "invalid_onion_key",
+	CodeTemporaryChannelFailure:          "temporary_channel_failure",
+	CodePermanentChannelFailure:          "permanent_channel_failure",
+	CodeRequiredChannelFeatureMissing:    "required_channel_feature_missing",
+	CodeUnknownNextPeer:                  "unknown_next_peer",
+	CodeAmountBelowMinimum:               "amount_below_minimum",
+	CodeFeeInsufficient:                  "fee_insufficient",
+	CodeIncorrectCltvExpiry:              "incorrect_cltv_expiry",
+	CodeExpiryTooSoon:                    "expiry_too_soon",
+	CodeIncorrectOrUnknownPaymentDetails: "incorrect_or_unknown_payment_details",
+	CodeFinalIncorrectCltvExpiry:         "final_incorrect_cltv_expiry",
+	CodeFinalIncorrectHtlcAmount:         "final_incorrect_htlc_amount",
+	CodeChannelDisabled:                  "channel_disabled",
+	CodeExpiryTooFar:                     "expiry_too_far",
+	CodeInvalidOnionPayload:              "invalid_onion_payload",
+	CodeMPPTimeout:                       "mpp_timeout",
+	CodeInvalidOnionBlinding:             "invalid_onion_blinding",
+}
+
+func (c FailCode) String() string {
+	name, ok := failCodeNames[c]
+	if !ok {
+		return fmt.Sprintf("unknown_failure_%d", uint16(c))
+	}
+
+	return name
+}
+
+// IsBadOnion returns true if the BADONION flag is set. Failures with this flag
+// can't be encrypted by the failing node since it could not derive the shared
+// secret. Instead, they are reported to the previous hop in the clear along
+// with the hash of the onion so that it can create the failure.
+func (c FailCode) IsBadOnion() bool {
+	return c&FlagBadOnion != 0
+}
+
+// IsPermanent returns true if the PERM flag is set.
+func (c FailCode) IsPermanent() bool {
+	return c&FlagPerm != 0
+}
+
+// IsNode returns true if the NODE flag is set.
+func (c FailCode) IsNode() bool {
+	return c&FlagNode != 0
+}
+
+// HasUpdate returns true if the UPDATE flag is set.
+func (c FailCode) HasUpdate() bool {
+	return c&FlagUpdate != 0
+}
+
+// ParseFailCode returns the failure code with the given BOLT 4 name.
+func ParseFailCode(name string) (FailCode, error) {
+	for code, n := range failCodeNames {
+		if n == name {
+			return code, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown failure: %s", name)
+}
+
+// FailureMessage is a BOLT 4 failure message. Each failure message is also an
+// error so that it can be returned by Peel.
+type FailureMessage interface {
+	error
+
+	// Code returns the failure code of the message.
+	Code() FailCode
+
+	encode(w *bytes.Buffer)
+	decode(r *bytes.Reader) error
+}
+
+// NewFailureMessage returns an empty failure message of the type identified by
+// the given code.
+func NewFailureMessage(code FailCode) (FailureMessage, error) {
+	var msg FailureMessage
+	switch code {
+	case CodeInvalidRealm:
+		msg = &FailInvalidRealm{}
+	case CodeTemporaryNodeFailure:
+		msg = &FailTemporaryNodeFailure{}
+	case CodePermanentNodeFailure:
+		msg = &FailPermanentNodeFailure{}
+	case CodeRequiredNodeFeatureMissing:
+		msg = &FailRequiredNodeFeatureMissing{}
+	case CodeInvalidOnionVersion:
+		msg = &FailInvalidOnionVersion{}
+	case CodeInvalidOnionHmac:
+		msg = &FailInvalidOnionHmac{}
+	case CodeInvalidOnionKey:
+		msg = &FailInvalidOnionKey{}
+	case CodeTemporaryChannelFailure:
+		msg = &FailTemporaryChannelFailure{}
+	case CodePermanentChannelFailure:
+		msg = &FailPermanentChannelFailure{}
+	case CodeRequiredChannelFeatureMissing:
+		msg = &FailRequiredChannelFeatureMissing{}
+	case CodeUnknownNextPeer:
+		msg = &FailUnknownNextPeer{}
+	case CodeAmountBelowMinimum:
+		msg = &FailAmountBelowMinimum{}
+	case CodeFeeInsufficient:
+		msg = &FailFeeInsufficient{}
+	case CodeIncorrectCltvExpiry:
+		msg = &FailIncorrectCltvExpiry{}
+	case CodeExpiryTooSoon:
+		msg = &FailExpiryTooSoon{}
+	case CodeIncorrectOrUnknownPaymentDetails:
+		msg = &FailIncorrectOrUnknownPaymentDetails{}
+	case CodeFinalIncorrectCltvExpiry:
+		msg = &FailFinalIncorrectCltvExpiry{}
+	case CodeFinalIncorrectHtlcAmount:
+		msg = &FailFinalIncorrectHtlcAmount{}
+	case CodeChannelDisabled:
+		msg = &FailChannelDisabled{}
+	case CodeExpiryTooFar:
+		msg = &FailExpiryTooFar{}
+	case CodeInvalidOnionPayload:
+		msg = &FailInvalidOnionPayload{}
+	case CodeMPPTimeout:
+		msg = &FailMPPTimeout{}
+	case CodeInvalidOnionBlinding:
+		msg = &FailInvalidOnionBlinding{}
+	default:
+		return nil, fmt.Errorf("unknown failure code: %d", uint16(code))
+	}
+
+	return msg, nil
+}
+
+// EncodeFailureMessage serialises the failure message as the 2 byte failure
+// code followed by the failure's data fields.
+func EncodeFailureMessage(msg FailureMessage) []byte {
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.BigEndian, msg.Code())
+	msg.encode(&b)
+
+	return b.Bytes()
+}
+
+// DecodeFailureMessage parses a failure message created by
+// EncodeFailureMessage.
+func DecodeFailureMessage(b []byte) (FailureMessage, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("failure message too short: %d", len(b))
+	}
+
+	msg, err := NewFailureMessage(FailCode(binary.BigEndian.Uint16(b)))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := msg.decode(bytes.NewReader(b[2:])); err != nil {
+		return nil, fmt.Errorf("unable to decode %v: %w", msg.Code(),
+			err)
+	}
+
+	return msg, nil
+}
+
+// writeUpdate writes the length prefixed channel_update.
+func writeUpdate(w *bytes.Buffer, update []byte) {
+	_ = binary.Write(w, binary.BigEndian, uint16(len(update)))
+	w.Write(update)
+}
+
+// readUpdate reads a length prefixed channel_update.
+func readUpdate(r *bytes.Reader) ([]byte, error) {
+	var l uint16
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+
+	update := make([]byte, l)
+	if _, err := io.ReadFull(r, update); err != nil {
+		return nil, err
+	}
+
+	return update, nil
+}
+
+// noData can be embedded in failure messages that don't carry any data.
+type noData struct{}
+
+func (noData) encode(*bytes.Buffer) {}
+
+func (noData) decode(*bytes.Reader) error {
+	return nil
+}
+
+// onionHash can be embedded in failure messages that only carry the hash of
+// the onion that the failing node received.
+type onionHash struct {
+	// OnionSHA256 is the SHA256 hash of the onion.
+	OnionSHA256 [32]byte
+}
+
+func (o *onionHash) encode(w *bytes.Buffer) {
+	w.Write(o.OnionSHA256[:])
+}
+
+func (o *onionHash) decode(r *bytes.Reader) error {
+	_, err := io.ReadFull(r, o.OnionSHA256[:])
+	return err
+}
+
+// FailInvalidRealm is returned if the realm byte is unknown.
+type FailInvalidRealm struct{ noData }
+
+func (f *FailInvalidRealm) Code() FailCode { return CodeInvalidRealm }
+func (f *FailInvalidRealm) Error() string  { return f.Code().String() }
+
+// FailTemporaryNodeFailure is returned for a temporary failure of the node.
+type FailTemporaryNodeFailure struct{ noData }
+
+func (f *FailTemporaryNodeFailure) Code() FailCode {
+	return CodeTemporaryNodeFailure
+}
+func (f *FailTemporaryNodeFailure) Error() string { return f.Code().String() }
+
+// FailPermanentNodeFailure is returned for a permanent failure of the node.
+type FailPermanentNodeFailure struct{ noData }
+
+func (f *FailPermanentNodeFailure) Code() FailCode {
+	return CodePermanentNodeFailure
+}
+func (f *FailPermanentNodeFailure) Error() string { return f.Code().String() }
+
+// FailRequiredNodeFeatureMissing is returned if the node requires a feature
+// that was not present in the onion.
+type FailRequiredNodeFeatureMissing struct{ noData }
+
+func (f *FailRequiredNodeFeatureMissing) Code() FailCode {
+	return CodeRequiredNodeFeatureMissing
+}
+func (f *FailRequiredNodeFeatureMissing) Error() string {
+	return f.Code().String()
+}
+
+// FailInvalidOnionVersion is returned if the onion version is unknown.
+type FailInvalidOnionVersion struct{ onionHash }
+
+func (f *FailInvalidOnionVersion) Code() FailCode {
+	return CodeInvalidOnionVersion
+}
+func (f *FailInvalidOnionVersion) Error() string {
+	return fmt.Sprintf("%v(onion_sha256=%x)", f.Code(), f.OnionSHA256)
+}
+
+// FailInvalidOnionHmac is returned if the HMAC of the onion is invalid.
+type FailInvalidOnionHmac struct{ onionHash }
+
+func (f *FailInvalidOnionHmac) Code() FailCode { return CodeInvalidOnionHmac }
+func (f *FailInvalidOnionHmac) Error() string {
+	return fmt.Sprintf("%v(onion_sha256=%x)", f.Code(), f.OnionSHA256)
+}
+
+// FailInvalidOnionKey is returned if the ephemeral key of the onion is
+// unparsable.
+type FailInvalidOnionKey struct{ onionHash }
+
+func (f *FailInvalidOnionKey) Code() FailCode { return CodeInvalidOnionKey }
+func (f *FailInvalidOnionKey) Error() string {
+	return fmt.Sprintf("%v(onion_sha256=%x)", f.Code(), f.OnionSHA256)
+}
+
+// FailTemporaryChannelFailure is returned if the outgoing channel is
+// temporarily unable to handle the HTLC.
+type FailTemporaryChannelFailure struct {
+	Update []byte
+}
+
+func (f *FailTemporaryChannelFailure) Code() FailCode {
+	return CodeTemporaryChannelFailure
+}
+func (f *FailTemporaryChannelFailure) Error() string {
+	return f.Code().String()
+}
+func (f *FailTemporaryChannelFailure) encode(w *bytes.Buffer) {
+	writeUpdate(w, f.Update)
+}
+func (f *FailTemporaryChannelFailure) decode(r *bytes.Reader) error {
+	var err error
+	f.Update, err = readUpdate(r)
+	return err
+}
+
+// FailPermanentChannelFailure is returned if the outgoing channel is
+// permanently unable to handle HTLCs.
+type FailPermanentChannelFailure struct{ noData }
+
+func (f *FailPermanentChannelFailure) Code() FailCode {
+	return CodePermanentChannelFailure
+}
+func (f *FailPermanentChannelFailure) Error() string {
+	return f.Code().String()
+}
+
+// FailRequiredChannelFeatureMissing is returned if the outgoing channel
+// requires a feature that was not present in the onion.
+type FailRequiredChannelFeatureMissing struct{ noData }
+
+func (f *FailRequiredChannelFeatureMissing) Code() FailCode {
+	return CodeRequiredChannelFeatureMissing
+}
+func (f *FailRequiredChannelFeatureMissing) Error() string {
+	return f.Code().String()
+}
+
+// FailUnknownNextPeer is returned if the next peer specified by the onion is
+// unknown.
+type FailUnknownNextPeer struct{ noData }
+
+func (f *FailUnknownNextPeer) Code() FailCode { return CodeUnknownNextPeer }
+func (f *FailUnknownNextPeer) Error() string  { return f.Code().String() }
+
+// FailAmountBelowMinimum is returned if the HTLC amount is below the minimum
+// of the outgoing channel.
+type FailAmountBelowMinimum struct {
+	HtlcMsat uint64
+	Update   []byte
+}
+
+func (f *FailAmountBelowMinimum) Code() FailCode {
+	return CodeAmountBelowMinimum
+}
+func (f *FailAmountBelowMinimum) Error() string {
+	return fmt.Sprintf("%v(htlc_msat=%d)", f.Code(), f.HtlcMsat)
+}
+func (f *FailAmountBelowMinimum) encode(w *bytes.Buffer) {
+	_ = binary.Write(w, binary.BigEndian, f.HtlcMsat)
+	writeUpdate(w, f.Update)
+}
+func (f *FailAmountBelowMinimum) decode(r *bytes.Reader) error {
+	err := binary.Read(r, binary.BigEndian, &f.HtlcMsat)
+	if err != nil {
+		return err
+	}
+
+	f.Update, err = readUpdate(r)
+	return err
+}
+
+// FailFeeInsufficient is returned if the fee paid by the HTLC is too low for
+// the outgoing channel.
+type FailFeeInsufficient struct {
+	HtlcMsat uint64
+	Update   []byte
+}
+
+func (f *FailFeeInsufficient) Code() FailCode { return CodeFeeInsufficient }
+func (f *FailFeeInsufficient) Error() string {
+	return fmt.Sprintf("%v(htlc_msat=%d)", f.Code(), f.HtlcMsat)
+}
+func (f *FailFeeInsufficient) encode(w *bytes.Buffer) {
+	_ = binary.Write(w, binary.BigEndian, f.HtlcMsat)
+	writeUpdate(w, f.Update)
+}
+func (f *FailFeeInsufficient) decode(r *bytes.Reader) error {
+	err := binary.Read(r, binary.BigEndian, &f.HtlcMsat)
+	if err != nil {
+		return err
+	}
+
+	f.Update, err = readUpdate(r)
+	return err
+}
+
+// FailIncorrectCltvExpiry is returned if the CLTV expiry of the HTLC does not
+// leave enough room for the CLTV delta of the outgoing channel.
+type FailIncorrectCltvExpiry struct {
+	CltvExpiry uint32
+	Update     []byte
+}
+
+func (f *FailIncorrectCltvExpiry) Code() FailCode {
+	return CodeIncorrectCltvExpiry
+}
+func (f *FailIncorrectCltvExpiry) Error() string {
+	return fmt.Sprintf("%v(cltv_expiry=%d)", f.Code(), f.CltvExpiry)
+}
+func (f *FailIncorrectCltvExpiry) encode(w *bytes.Buffer) {
+	_ = binary.Write(w, binary.BigEndian, f.CltvExpiry)
+	writeUpdate(w, f.Update)
+}
+func (f *FailIncorrectCltvExpiry) decode(r *bytes.Reader) error {
+	err := binary.Read(r, binary.BigEndian, &f.CltvExpiry)
+	if err != nil {
+		return err
+	}
+
+	f.Update, err = readUpdate(r)
+	return err
+}
+
+// FailExpiryTooSoon is returned if the CLTV expiry of the HTLC is too close
+// to the current block height.
+type FailExpiryTooSoon struct {
+	Update []byte
+}
+
+func (f *FailExpiryTooSoon) Code() FailCode { return CodeExpiryTooSoon }
+func (f *FailExpiryTooSoon) Error() string  { return f.Code().String() }
+func (f *FailExpiryTooSoon) encode(w *bytes.Buffer) {
+	writeUpdate(w, f.Update)
+}
+func (f *FailExpiryTooSoon) decode(r *bytes.Reader) error {
+	var err error
+	f.Update, err = readUpdate(r)
+	return err
+}
+
+// FailIncorrectOrUnknownPaymentDetails is returned by the final node if the
+// payment hash is unknown, the payment secret doesn't match, the amount is
+// incorrect or the CLTV expiry is too soon.
+type FailIncorrectOrUnknownPaymentDetails struct {
+	HtlcMsat uint64
+	Height   uint32
+}
+
+func (f *FailIncorrectOrUnknownPaymentDetails) Code() FailCode {
+	return CodeIncorrectOrUnknownPaymentDetails
+}
+func (f *FailIncorrectOrUnknownPaymentDetails) Error() string {
+	return fmt.Sprintf("%v(htlc_msat=%d, height=%d)", f.Code(),
+		f.HtlcMsat, f.Height)
+}
+func (f *FailIncorrectOrUnknownPaymentDetails) encode(w *bytes.Buffer) {
+	_ = binary.Write(w, binary.BigEndian, f.HtlcMsat)
+	_ = binary.Write(w, binary.BigEndian, f.Height)
+}
+func (f *FailIncorrectOrUnknownPaymentDetails) decode(r *bytes.Reader) error {
+	err := binary.Read(r, binary.BigEndian, &f.HtlcMsat)
+	if err != nil {
+		return err
+	}
+
+	return binary.Read(r, binary.BigEndian, &f.Height)
+}
+
+// FailFinalIncorrectCltvExpiry is returned by the final node if the CLTV
+// expiry of the HTLC does not match the one in the onion.
+type FailFinalIncorrectCltvExpiry struct {
+	CltvExpiry uint32
+}
+
+func (f *FailFinalIncorrectCltvExpiry) Code() FailCode {
+	return CodeFinalIncorrectCltvExpiry
+}
+func (f *FailFinalIncorrectCltvExpiry) Error() string {
+	return fmt.Sprintf("%v(cltv_expiry=%d)", f.Code(), f.CltvExpiry)
+}
+func (f *FailFinalIncorrectCltvExpiry) encode(w *bytes.Buffer) {
+	_ = binary.Write(w, binary.BigEndian, f.CltvExpiry)
+}
+func (f *FailFinalIncorrectCltvExpiry) decode(r *bytes.Reader) error {
+	return binary.Read(r, binary.BigEndian, &f.CltvExpiry)
+}
+
+// FailFinalIncorrectHtlcAmount is returned by the final node if the amount of
+// the HTLC does not match the one in the onion.
+type FailFinalIncorrectHtlcAmount struct {
+	IncomingHtlcAmt uint64
+}
+
+func (f *FailFinalIncorrectHtlcAmount) Code() FailCode {
+	return CodeFinalIncorrectHtlcAmount
+}
+func (f *FailFinalIncorrectHtlcAmount) Error() string {
+	return fmt.Sprintf("%v(incoming_htlc_amt=%d)", f.Code(),
+		f.IncomingHtlcAmt)
+}
+func (f *FailFinalIncorrectHtlcAmount) encode(w *bytes.Buffer) {
+	_ = binary.Write(w, binary.BigEndian, f.IncomingHtlcAmt)
+}
+func (f *FailFinalIncorrectHtlcAmount) decode(r *bytes.Reader) error {
+	return binary.Read(r, binary.BigEndian, &f.IncomingHtlcAmt)
+}
+
+// FailChannelDisabled is returned if the outgoing channel has been disabled.
+type FailChannelDisabled struct {
+	Flags  uint16
+	Update []byte
+}
+
+func (f *FailChannelDisabled) Code() FailCode { return CodeChannelDisabled }
+func (f *FailChannelDisabled) Error() string {
+	return fmt.Sprintf("%v(flags=%d)", f.Code(), f.Flags)
+}
+func (f *FailChannelDisabled) encode(w *bytes.Buffer) {
+	_ = binary.Write(w, binary.BigEndian, f.Flags)
+	writeUpdate(w, f.Update)
+}
+func (f *FailChannelDisabled) decode(r *bytes.Reader) error {
+	err := binary.Read(r, binary.BigEndian, &f.Flags)
+	if err != nil {
+		return err
+	}
+
+	f.Update, err = readUpdate(r)
+	return err
+}
+
+// FailExpiryTooFar is returned if the CLTV expiry of the HTLC is too far in
+// the future.
+type FailExpiryTooFar struct{ noData }
+
+func (f *FailExpiryTooFar) Code() FailCode { return CodeExpiryTooFar }
+func (f *FailExpiryTooFar) Error() string  { return f.Code().String() }
+
+// FailInvalidOnionPayload is returned if the hop payload could not be parsed
+// or is missing a required field.
+type FailInvalidOnionPayload struct {
+	// Type is the TLV type that caused the failure.
+	Type tlv.Type
+
+	// Offset is the byte offset in the payload of the failure.
+	Offset uint16
+}
+
+func (f *FailInvalidOnionPayload) Code() FailCode {
+	return CodeInvalidOnionPayload
+}
+func (f *FailInvalidOnionPayload) Error() string {
+	return fmt.Sprintf("%v(type=%d, offset=%d)", f.Code(), f.Type,
+		f.Offset)
+}
+func (f *FailInvalidOnionPayload) encode(w *bytes.Buffer) {
+	_ = tlv.WriteBigSize(w, uint64(f.Type))
+	_ = binary.Write(w, binary.BigEndian, f.Offset)
+}
+func (f *FailInvalidOnionPayload) decode(r *bytes.Reader) error {
+	t, err := tlv.ReadBigSize(r)
+	if err != nil {
+		return err
+	}
+	f.Type = tlv.Type(t)
+
+	return binary.Read(r, binary.BigEndian, &f.Offset)
+}
+
+// FailMPPTimeout is returned by the final node if the full amount of a multi
+// part payment was not received in time.
+type FailMPPTimeout struct{ noData }
+
+func (f *FailMPPTimeout) Code() FailCode { return CodeMPPTimeout }
+func (f *FailMPPTimeout) Error() string  { return f.Code().String() }
+
+// FailInvalidOnionBlinding is returned by any node in a blinded route that
+// fails to process the onion.
+type FailInvalidOnionBlinding struct{ onionHash }
+
+func (f *FailInvalidOnionBlinding) Code() FailCode {
+	return CodeInvalidOnionBlinding
+}
+func (f *FailInvalidOnionBlinding) Error() string {
+	return fmt.Sprintf("%v(onion_sha256=%x)", f.Code(), f.OnionSHA256)
+}
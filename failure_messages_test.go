@@ -0,0 +1,171 @@
+package onion
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestFailureMessageEncoding(t *testing.T) {
+	var hash onionHash
+	copy(hash.OnionSHA256[:], bytes.Repeat([]byte{0xaa}, 32))
+	update := []byte("channel update")
+
+	msgs := []FailureMessage{
+		&FailInvalidRealm{},
+		&FailTemporaryNodeFailure{},
+		&FailPermanentNodeFailure{},
+		&FailRequiredNodeFeatureMissing{},
+		&FailInvalidOnionVersion{hash},
+		&FailInvalidOnionHmac{hash},
+		&FailInvalidOnionKey{hash},
+		&FailTemporaryChannelFailure{Update: update},
+		&FailPermanentChannelFailure{},
+		&FailRequiredChannelFeatureMissing{},
+		&FailUnknownNextPeer{},
+		&FailAmountBelowMinimum{HtlcMsat: 1000, Update: update},
+		&FailFeeInsufficient{HtlcMsat: 1000, Update: update},
+		&FailIncorrectCltvExpiry{CltvExpiry: 144, Update: update},
+		&FailExpiryTooSoon{Update: update},
+		&FailIncorrectOrUnknownPaymentDetails{
+			HtlcMsat: 1000,
+			Height:   800000,
+		},
+		&FailFinalIncorrectCltvExpiry{CltvExpiry: 144},
+		&FailFinalIncorrectHtlcAmount{IncomingHtlcAmt: 1000},
+		&FailChannelDisabled{Flags: 1, Update: update},
+		&FailExpiryTooFar{},
+		&FailInvalidOnionPayload{Type: 65537, Offset: 3},
+		&FailMPPTimeout{},
+		&FailInvalidOnionBlinding{hash},
+	}
+
+	require.Len(t, msgs, len(failCodeNames))
+
+	for _, msg := range msgs {
+		t.Run(msg.Code().String(), func(t *testing.T) {
+			decoded, err := DecodeFailureMessage(
+				EncodeFailureMessage(msg),
+			)
+			require.NoError(t, err)
+			require.Equal(t, msg, decoded)
+
+			code, err := ParseFailCode(msg.Code().String())
+			require.NoError(t, err)
+			require.Equal(t, msg.Code(), code)
+		})
+	}
+
+	// Check the encoding against a known value.
+	encoded := EncodeFailureMessage(&FailIncorrectOrUnknownPaymentDetails{
+		HtlcMsat: 1000,
+		Height:   800000,
+	})
+	require.Equal(t, "400f00000000000003e8000c3500",
+		hex.EncodeToString(encoded))
+
+	_, err := DecodeFailureMessage([]byte{0x00, 0xff})
+	require.Error(t, err)
+
+	_, err = ParseFailCode("not_a_failure")
+	require.Error(t, err)
+}
+
+func TestFailCodeFlags(t *testing.T) {
+	require.True(t, CodeInvalidOnionHmac.IsBadOnion())
+	require.True(t, CodeInvalidOnionHmac.IsPermanent())
+	require.False(t, CodeInvalidOnionHmac.IsNode())
+
+	require.True(t, CodeTemporaryNodeFailure.IsNode())
+	require.False(t, CodeTemporaryNodeFailure.IsPermanent())
+
+	require.True(t, CodeTemporaryChannelFailure.HasUpdate())
+	require.False(t, CodeTemporaryChannelFailure.IsBadOnion())
+
+	require.Equal(t, FailCode(0x4000|15), CodeIncorrectOrUnknownPaymentDetails)
+	require.Equal(t, FailCode(0x8000|0x4000|24), CodeInvalidOnionBlinding)
+}
+
+func TestPeelFailures(t *testing.T) {
+	sessionKey, _ := btcec.NewPrivateKey()
+
+	hopsData := []*HopData{
+		{
+			PubKey:    Users[Bob].PubKey,
+			ClearData: []byte("Hi Bob"),
+		},
+		{
+			PubKey:    Users[Charlie].PubKey,
+			ClearData: []byte("Hi Charlie"),
+		},
+	}
+
+	// An onion with an unknown version.
+	onion, _, err := BuildOnion(sessionKey, hopsData)
+	require.NoError(t, err)
+
+	onion.Version[0] = 1
+	_, _, err = Peel(Users[Bob], onion)
+	var versionErr *FailInvalidOnionVersion
+	require.ErrorAs(t, err, &versionErr)
+
+	// A tampered onion should fail the HMAC check.
+	onion, _, err = BuildOnion(sessionKey, hopsData)
+	require.NoError(t, err)
+
+	onion.HopPayloads[0] ^= 1
+	_, _, err = Peel(Users[Bob], onion)
+	var hmacErr *FailInvalidOnionHmac
+	require.ErrorAs(t, err, &hmacErr)
+	require.True(t, hmacErr.Code().IsBadOnion())
+
+	// An onion peeled by the wrong node also fails the HMAC check.
+	onion, _, err = BuildOnion(sessionKey, hopsData)
+	require.NoError(t, err)
+
+	_, _, err = Peel(Users[Charlie], onion)
+	require.ErrorAs(t, err, &hmacErr)
+
+	// Forwarding over an unknown channel should fail with
+	// unknown_next_peer and return the shared secret so that the failure
+	// can be sent back.
+	unknown := NewShortChannelIDFromInt(1)
+	hopsData[0].ShortChannelID = &unknown
+	onion, _, err = BuildOnion(sessionKey, hopsData)
+	require.NoError(t, err)
+
+	payload, _, err := Peel(Users[Bob], onion)
+	var peerErr *FailUnknownNextPeer
+	require.ErrorAs(t, err, &peerErr)
+	require.NotNil(t, payload)
+	require.NotEqual(t, [32]byte{}, payload.SharedSecret)
+
+	// Encrypted data that the sender tampered with fails the
+	// authentication of the introduction node with invalid_onion_blinding.
+	bp, err := BuildBlindedPath(sessionKey, []*HopData{
+		{PubKey: Users[Bob].PubKey},
+		{PubKey: Users[Charlie].PubKey},
+	})
+	require.NoError(t, err)
+
+	bp.EncryptedData[0][0] ^= 1
+	onion, _, err = BuildOnion(sessionKey, []*HopData{
+		{
+			PubKey:        bp.EntryNodeID,
+			EncryptedData: bp.EncryptedData[0],
+			EphemeralKey:  bp.FirstBlindingEphemeralKey,
+		},
+		{
+			PubKey:        bp.BlindedNodeIDs[0],
+			EncryptedData: bp.EncryptedData[1],
+		},
+	})
+	require.NoError(t, err)
+
+	payload, _, err = Peel(Users[Bob], onion)
+	var blindingErr *FailInvalidOnionBlinding
+	require.ErrorAs(t, err, &blindingErr)
+	require.NotNil(t, payload)
+}
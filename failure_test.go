@@ -0,0 +1,131 @@
+package onion
+
+import (
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestOnionFailure(t *testing.T) {
+	sessionKey, _ := btcec.NewPrivateKey()
+
+	hopsData := []*HopData{
+		{
+			PubKey:    Users[Bob].PubKey,
+			ClearData: []byte("Hi Bob"),
+		},
+		{
+			PubKey:    Users[Charlie].PubKey,
+			ClearData: []byte("Hi Charlie"),
+		},
+		{
+			PubKey:    Users[Dave].PubKey,
+			ClearData: []byte("Hi Dave"),
+		},
+	}
+	users := []*User{Users[Bob], Users[Charlie], Users[Dave]}
+
+	for failingHop := range hopsData {
+		onion, hops, err := BuildOnion(sessionKey, hopsData)
+		require.NoError(t, err)
+
+		// Peel the onion up to and including the failing hop.
+		payloads := make([]*HopPayload, failingHop+1)
+		for i := 0; i <= failingHop; i++ {
+			payloads[i], onion, err = Peel(users[i], onion)
+			require.NoError(t, err)
+		}
+
+		// The failing hop creates the failure and each of the
+		// previous hops adds their layer of obfuscation.
+		failure, err := payloads[failingHop].ErrorEncrypter().
+			EncryptError([]byte("oh no"))
+		require.NoError(t, err)
+
+		for i := failingHop - 1; i >= 0; i-- {
+			failure = payloads[i].ErrorEncrypter().ObfuscateError(
+				failure,
+			)
+		}
+
+		decrypted, err := NewErrorDecrypter(hops).DecryptError(failure)
+		require.NoError(t, err)
+		require.Equal(t, failingHop, decrypted.Index)
+		require.True(t, decrypted.Sender.IsEqual(users[failingHop].PubKey))
+		require.Equal(t, []byte("oh no"), decrypted.Message)
+
+		// The sender should also be able to decrypt the failure using
+		// hops derived from the session key.
+		var route []*btcec.PublicKey
+		for _, hop := range hopsData {
+			route = append(route, hop.PubKey)
+		}
+
+		decrypted, err = NewErrorDecrypter(
+			DeriveHops(sessionKey, route),
+		).DecryptError(failure)
+		require.NoError(t, err)
+		require.Equal(t, failingHop, decrypted.Index)
+	}
+
+	// A garbled failure can't be attributed to any hop.
+	_, hops, err := BuildOnion(sessionKey, hopsData)
+	require.NoError(t, err)
+
+	_, err = NewErrorDecrypter(hops).DecryptError(make([]byte, 292))
+	require.ErrorIs(t, err, ErrUnattributableFailure)
+}
+
+func TestBlindedOnionFailure(t *testing.T) {
+	// A -> B -> C -> B(D) -> B(E) where B(D) fails.
+	eveSessionKey, _ := btcec.NewPrivateKey()
+	bp, err := BuildBlindedPath(eveSessionKey, []*HopData{
+		{PubKey: Users[Charlie].PubKey},
+		{PubKey: Users[Dave].PubKey},
+		{PubKey: Users[Eve].PubKey, ClearData: []byte("Hi Me")},
+	})
+	require.NoError(t, err)
+
+	aliceSessionKey, _ := btcec.NewPrivateKey()
+	onion, hops, err := BuildOnion(aliceSessionKey, []*HopData{
+		{
+			PubKey:    Users[Bob].PubKey,
+			ClearData: []byte("Hi Bob"),
+		},
+		{
+			PubKey:        Users[Charlie].PubKey,
+			EncryptedData: bp.EncryptedData[0],
+			EphemeralKey:  bp.FirstBlindingEphemeralKey,
+		},
+		{
+			PubKey:        bp.BlindedNodeIDs[0],
+			EncryptedData: bp.EncryptedData[1],
+		},
+		{
+			PubKey:        bp.BlindedNodeIDs[1],
+			EncryptedData: bp.EncryptedData[2],
+		},
+	})
+	require.NoError(t, err)
+
+	bob, onion, err := Peel(Users[Bob], onion)
+	require.NoError(t, err)
+
+	charlie, onion, err := Peel(Users[Charlie], onion)
+	require.NoError(t, err)
+
+	dave, _, err := Peel(Users[Dave], onion)
+	require.NoError(t, err)
+
+	failure, err := dave.ErrorEncrypter().EncryptError([]byte("oh no"))
+	require.NoError(t, err)
+
+	failure = charlie.ErrorEncrypter().ObfuscateError(failure)
+	failure = bob.ErrorEncrypter().ObfuscateError(failure)
+
+	decrypted, err := NewErrorDecrypter(hops).DecryptError(failure)
+	require.NoError(t, err)
+	require.Equal(t, 2, decrypted.Index)
+	require.True(t, decrypted.Sender.IsEqual(bp.BlindedNodeIDs[0]))
+	require.Equal(t, []byte("oh no"), decrypted.Message)
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"github.com/btcsuite/btcd/btcec/v2"
+	"onion/tlv"
 )
 
 var (
@@ -17,6 +18,18 @@ var (
 	// umType is used during error reporting.
 	umType = []byte{0x75, 0x6d}
 
+	// ammagType is used to generate the pseudo-random byte stream that is
+	// used to obfuscate failure messages.
+	ammagType = []byte{0x61, 0x6d, 0x6d, 0x61, 0x67}
+
+	// ammagextType is used to generate the pseudo-random byte stream that
+	// is used to obfuscate the attribution data of failures.
+	ammagextType = []byte{0x61, 0x6d, 0x6d, 0x61, 0x67, 0x65, 0x78, 0x74}
+
+	// blindedNodeIDType is used to derive the key that blinds a node's pub
+	// key in a blinded path.
+	blindedNodeIDType = []byte("blinded_node_id")
+
 	// padType is used to generate random filler bytes for the starting
 	// mix-header packet.
 	padType = []byte{0x70, 0x61, 0x64}
@@ -72,8 +85,27 @@ func NewHop(p *btcec.PublicKey, e *btcec.PrivateKey, payload []byte) *Hop {
 	}
 }
 
+// DeriveHops derives the keys for each hop along the route to the given nodes
+// using the same session key that was used to build the onion. It can be used
+// to recreate the hops returned by BuildOnion, for example to decrypt a
+// failure at a later time. The hops do not contain any payloads.
+func DeriveHops(sessionKey *btcec.PrivateKey,
+	pubKeys []*btcec.PublicKey) []*Hop {
+
+	hops := make([]*Hop, len(pubKeys))
+	ephemeralKey := sessionKey
+	for i, pubKey := range pubKeys {
+		hops[i] = NewHop(pubKey, ephemeralKey, nil)
+		ephemeralKey = blindPriv(hops[i].BF, ephemeralKey)
+	}
+
+	return hops
+}
+
+// TotalSize is the number of bytes that this hop's frame takes up in the
+// packet: the BigSize encoded payload length, the payload and the HMAC.
 func (h *Hop) TotalSize() int {
-	return 2 + len(h.Payload) + 32
+	return tlv.BigSizeLen(uint64(len(h.Payload))) + len(h.Payload) + 32
 }
 
 // genKey generates a key using HMAC256 with the given key type and using a
@@ -118,11 +150,16 @@ func blindingFactor(ss [32]byte, p *btcec.PublicKey) [32]byte {
 	return key
 }
 
+// blindPriv multiplies the private key by the blinding factor. The passed key
+// is not modified.
 func blindPriv(bf [32]byte, p *btcec.PrivateKey) *btcec.PrivateKey {
 	scalar := &btcec.ModNScalar{}
 	scalar.SetByteSlice(bf[:])
 
-	return btcec.PrivKeyFromScalar(p.Key.Mul(scalar))
+	var key btcec.ModNScalar
+	key.Set(&p.Key)
+
+	return btcec.PrivKeyFromScalar(key.Mul(scalar))
 }
 
 func blindPub(bf [32]byte, p *btcec.PublicKey) *btcec.PublicKey {
@@ -17,3 +17,14 @@ func TestSharedSecret(t *testing.T) {
 
 	require.True(t, bytes.Equal(ss1[:], ss2[:]))
 }
+
+func TestBlindPrivDoesNotModifyKey(t *testing.T) {
+	priv, _ := btcec.NewPrivateKey()
+	before := priv.Serialize()
+
+	blinded := blindPriv([32]byte{1, 2, 3}, priv)
+	require.Equal(t, before, priv.Serialize())
+	require.True(
+		t, blinded.PubKey().IsEqual(blindPub([32]byte{1, 2, 3}, priv.PubKey())),
+	)
+}
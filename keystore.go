@@ -0,0 +1,220 @@
+package onion
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// keyFileExt is the extension of key files that hold a hex encoded
+	// private key.
+	keyFileExt = ".key"
+
+	// encryptedKeyFileExt is the extension of key files that hold a
+	// private key encrypted with a passphrase.
+	encryptedKeyFileExt = ".enckey"
+
+	// keySaltLen is the length of the scrypt salt of encrypted key files.
+	keySaltLen = 16
+)
+
+// ErrPassphraseRequired is returned when loading an encrypted key file without
+// a passphrase.
+var ErrPassphraseRequired = errors.New("passphrase required for encrypted " +
+	"key file")
+
+// validAlias matches the aliases that can be used as key file names.
+var validAlias = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// passphraseKey derives the key used to encrypt a key file from the
+// passphrase.
+func passphraseKey(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, 1<<15, 8, 1, chacha20poly1305.KeySize)
+}
+
+// WriteKeyFile writes the private key to a key file for the given alias in the
+// keystore directory. If a passphrase is given, the key is encrypted with it.
+// The path of the new key file is returned.
+func WriteKeyFile(dir, alias string, privKey *btcec.PrivateKey,
+	passphrase []byte) (string, error) {
+
+	if !validAlias.MatchString(alias) {
+		return "", fmt.Errorf("invalid alias %q: only letters, digits, "+
+			"- and _ are allowed", alias)
+	}
+
+	alias = strings.ToLower(alias)
+	for _, ext := range []string{keyFileExt, encryptedKeyFileExt} {
+		_, err := os.Stat(filepath.Join(dir, alias+ext))
+		if err == nil {
+			return "", fmt.Errorf("key file for %s already exists",
+				alias)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	contents := privKey.Serialize()
+	path := filepath.Join(dir, alias+keyFileExt)
+	if passphrase != nil {
+		encrypted, err := encryptKey(contents, passphrase)
+		if err != nil {
+			return "", err
+		}
+
+		contents = encrypted
+		path = filepath.Join(dir, alias+encryptedKeyFileExt)
+	}
+
+	err := os.WriteFile(path, []byte(hex.EncodeToString(contents)), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// encryptKey encrypts the private key with the passphrase. The result is the
+// scrypt salt followed by the nonce and the ChaCha20-Poly1305 ciphertext.
+func encryptKey(privKey, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, keySaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key, err := passphraseKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	encrypted := append(salt, nonce...)
+
+	return aead.Seal(encrypted, nonce, privKey, nil), nil
+}
+
+// decryptKey reverses encryptKey.
+func decryptKey(encrypted, passphrase []byte) ([]byte, error) {
+	if len(encrypted) < keySaltLen+chacha20poly1305.NonceSize {
+		return nil, errors.New("encrypted key too short")
+	}
+
+	key, err := passphraseKey(passphrase, encrypted[:keySaltLen])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := encrypted[keySaltLen : keySaltLen+aead.NonceSize()]
+	privKey, err := aead.Open(
+		nil, nonce, encrypted[keySaltLen+aead.NonceSize():], nil,
+	)
+	if err != nil {
+		return nil, errors.New("wrong passphrase")
+	}
+
+	return privKey, nil
+}
+
+// ReadKeyFile reads the private key from a key file. The passphrase is only
+// needed for encrypted key files.
+func ReadKeyFile(path string, passphrase []byte) (*btcec.PrivateKey, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %w", path, err)
+	}
+
+	if filepath.Ext(path) == encryptedKeyFileExt {
+		if passphrase == nil {
+			return nil, fmt.Errorf("%s: %w", path,
+				ErrPassphraseRequired)
+		}
+
+		b, err = decryptKey(b, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt %s: %w", path,
+				err)
+		}
+	}
+
+	if len(b) != btcec.PrivKeyBytesLen {
+		return nil, fmt.Errorf("invalid key file %s: key must be %d "+
+			"bytes", path, btcec.PrivKeyBytesLen)
+	}
+
+	// The key must be a valid scalar as it is, rather than one that has
+	// been reduced to a different key.
+	var scalar btcec.ModNScalar
+	overflow := scalar.SetByteSlice(b)
+	if overflow || scalar.IsZero() {
+		return nil, fmt.Errorf("invalid key file %s: key out of range",
+			path)
+	}
+
+	return btcec.PrivKeyFromScalar(&scalar), nil
+}
+
+// LoadKeystore adds a user to the registry for every key file in the keystore
+// directory. The alias of each user is the name of its key file. The
+// passphrase is only needed if the keystore contains encrypted key files.
+func (r *Registry) LoadKeystore(dir string, passphrase []byte) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() ||
+			(ext != keyFileExt && ext != encryptedKeyFileExt) {
+
+			continue
+		}
+
+		privKey, err := ReadKeyFile(
+			filepath.Join(dir, entry.Name()), passphrase,
+		)
+		if err != nil {
+			return err
+		}
+
+		alias := strings.TrimSuffix(entry.Name(), ext)
+		err = r.Add(NewUser(alias, NewPrivKeySigner(privKey)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -3,49 +3,140 @@ package onion
 import (
 	"crypto/hmac"
 	"crypto/sha256"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/aead/chacha20"
 	"github.com/btcsuite/btcd/btcec/v2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"math"
+	"onion/tlv"
 )
 
+const (
+	// PaymentPacketSize is the size of the hop payloads of the onions
+	// that are sent along with payments.
+	PaymentPacketSize = 1300
+
+	// MaxPacketSize is the largest size of hop payloads that is
+	// supported. It is the size used by large onion messages.
+	MaxPacketSize = 32768
+
+	// onionOverhead is the size of the version, pub key and HMAC of a
+	// serialized onion.
+	onionOverhead = 1 + 33 + 32
+
+	// minPacketSize is the size of the smallest frame that a hop can
+	// read from the hop payloads: a one byte length, a one byte payload
+	// and the HMAC for the next hop.
+	minPacketSize = 1 + 1 + 32
+)
+
+// errInvalidHmac is returned when the HMAC of an onion is invalid.
+var errInvalidHmac = errors.New("invalid onion hmac")
+
 type Onion struct {
-	Version     [1]byte
-	PubKey      [33]byte
-	HopPayloads [1300]byte
-	HMAC        [32]byte
+	Version [1]byte
+	PubKey  [33]byte
+
+	// HopPayloads holds the payloads of the hops. Its length is the
+	// packet size of the onion.
+	HopPayloads []byte
+
+	HMAC [32]byte
 
 	// EphemeralKey is the key that should be passed onto the next hop in
 	// addition to the onion packet.
 	EphemeralKey *btcec.PublicKey
+
+	// IncomingCLTV is the CLTV expiry of the HTLC that carried the onion.
+	// It is stored in the replay log so that entries can be removed once
+	// the HTLC has expired.
+	// NOTE: This is not included in the serialization of the Onion.
+	IncomingCLTV uint32
+
+	// IncomingAmount is the amount in msat of the HTLC that carried the
+	// onion. Hops in a blinded path use it to check the recipient's
+	// constraints and to work out the amount to forward.
+	// NOTE: This is not included in the serialization of the Onion.
+	IncomingAmount uint64
+
+	// AssociatedData is the data that is covered by the HMAC of each hop
+	// along with the packet, such as the payment hash of the HTLC.
+	// NOTE: This is not included in the serialization of the Onion.
+	AssociatedData []byte
 }
 
 func (o *Onion) Serialize() []byte {
-	var packet = [1366]byte{}
+	hmacStart := 34 + len(o.HopPayloads)
+
+	packet := make([]byte, onionOverhead+len(o.HopPayloads))
 	copy(packet[:1], o.Version[:])
 	copy(packet[1:34], o.PubKey[:])
-	copy(packet[34:1334], o.HopPayloads[:])
-	copy(packet[1334:], o.HMAC[:])
-	return packet[:]
+	copy(packet[34:hmacStart], o.HopPayloads)
+	copy(packet[hmacStart:], o.HMAC[:])
+	return packet
 }
 
+// DeserializeOnion deserializes an onion of any packet size up to
+// MaxPacketSize. Payment onions are always 1366 bytes long.
 func DeserializeOnion(b []byte) (*Onion, error) {
-	if len(b) != 1366 {
-		return nil, errors.New("onion must be 1364 bytes")
+	if len(b) < onionOverhead+minPacketSize ||
+		len(b) > onionOverhead+MaxPacketSize {
+
+		return nil, fmt.Errorf("onion must be between %d and %d bytes",
+			onionOverhead+minPacketSize, onionOverhead+MaxPacketSize)
 	}
 
-	onion := &Onion{}
+	hmacStart := len(b) - 32
+
+	onion := &Onion{
+		HopPayloads: make([]byte, hmacStart-34),
+	}
 	copy(onion.Version[:], b[:1])
 	copy(onion.PubKey[:], b[1:34])
-	copy(onion.HopPayloads[:], b[34:1334])
-	copy(onion.HMAC[:], b[1334:])
+	copy(onion.HopPayloads, b[34:hmacStart])
+	copy(onion.HMAC[:], b[hmacStart:])
 
 	return onion, nil
 }
 
-func BuildOnion(sessionKey *btcec.PrivateKey, hopsData []*HopData) (*Onion,
-	error) {
+// BuildOption is an optional argument to BuildOnion.
+type BuildOption func(*buildOptions)
+
+// buildOptions holds the optional arguments to BuildOnion.
+type buildOptions struct {
+	associatedData []byte
+	packetSize     int
+}
+
+// WithAssociatedData sets the associated data that is covered by the HMAC of
+// each hop, such as the payment hash of the HTLC that carries the onion.
+func WithAssociatedData(ad []byte) BuildOption {
+	return func(o *buildOptions) {
+		o.associatedData = ad
+	}
+}
+
+// WithPacketSize sets the size of the hop payloads of the onion. By default,
+// onions have the PaymentPacketSize.
+func WithPacketSize(size int) BuildOption {
+	return func(o *buildOptions) {
+		o.packetSize = size
+	}
+}
+
+// BuildOnion builds an onion for the given hops. The derived Hop for each of
+// the hops is also returned so that the sender can decrypt any failure that is
+// sent back.
+func BuildOnion(sessionKey *btcec.PrivateKey, hopsData []*HopData,
+	opts ...BuildOption) (*Onion, []*Hop, error) {
+
+	options := buildOptions{
+		packetSize: PaymentPacketSize,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
 
 	sessPriv, _ := btcec.PrivKeyFromBytes(sessionKey.Serialize())
 	ephemeralKey := sessPriv
@@ -60,18 +151,59 @@ func BuildOnion(sessionKey *btcec.PrivateKey, hopsData []*HopData) (*Onion,
 			Payload: hop.EncodePayload(),
 		}
 
-		if i != len(hopsData)-1 && !blindedRoute {
+		// If the hop is told which channel to forward over, then
+		// there is no need to also include the next node's pub key.
+		if i != len(hopsData)-1 && !blindedRoute &&
+			hop.ShortChannelID == nil {
+
 			payload.FwdTo = hopsData[i+1].PubKey
 		}
 
-		hops[i] = NewHop(hop.PubKey, ephemeralKey, payload.Serialize())
+		payloadSer, err := payload.Serialize()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(payloadSer) == 0 {
+			return nil, nil, fmt.Errorf("empty payload for hop %d", i)
+		}
+
+		hops[i] = NewHop(hop.PubKey, ephemeralKey, payloadSer)
 
 		ephemeralKey = blindPriv(hops[i].BF, ephemeralKey)
 	}
 
-	filler := genFiller(hops)
+	onion, err := buildPacket(
+		sessionKey, hops, options.packetSize, options.associatedData,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return onion, hops, nil
+}
+
+// buildPacket wraps the payloads of the given hops into an onion with the
+// given packet size. Each hop's payload is used as is.
+func buildPacket(sessionKey *btcec.PrivateKey, hops []*Hop, packetSize int,
+	associatedData []byte) (*Onion, error) {
+
+	if packetSize <= 0 || packetSize > MaxPacketSize {
+		return nil, fmt.Errorf("invalid packet size %d: must be "+
+			"between 1 and %d", packetSize, MaxPacketSize)
+	}
+
+	var totalSize int
+	for _, hop := range hops {
+		totalSize += hop.TotalSize()
+	}
+	if totalSize > packetSize {
+		return nil, fmt.Errorf("hop payloads too large for packet "+
+			"size %d: %d bytes", packetSize, totalSize)
+	}
+
+	filler := genFiller(hops, packetSize)
 
-	packet := genPadding(sessionKey)
+	packet := genPadding(sessionKey, packetSize)
 
 	var nextHmac [32]byte
 	for i := len(hops) - 1; i >= 0; i-- {
@@ -79,18 +211,17 @@ func BuildOnion(sessionKey *btcec.PrivateKey, hopsData []*HopData) (*Onion,
 
 		hmac := nextHmac
 
-		payload := make([]byte, hop.TotalSize())
-
-		binary.BigEndian.PutUint16(
-			payload[:2], uint16(len(hop.Payload)),
+		payload := make([]byte, 0, hop.TotalSize())
+		payload = append(
+			payload, tlv.EncodeBigSize(uint64(len(hop.Payload)))...,
 		)
-		copy(payload[2:2+len(hop.Payload)], hop.Payload)
-		copy(payload[2+len(hop.Payload):], hmac[:])
+		payload = append(payload, hop.Payload...)
+		payload = append(payload, hmac[:]...)
 
 		rightShift(packet[:], hop.TotalSize())
 		copy(packet[:hop.TotalSize()], payload)
 
-		stream := pSByteStream(hop.Rho[:], 1300)
+		stream := pSByteStream(hop.Rho[:], packetSize)
 
 		xor(packet[:], packet[:], stream[:])
 
@@ -100,185 +231,970 @@ func BuildOnion(sessionKey *btcec.PrivateKey, hopsData []*HopData) (*Onion,
 			copy(packet[len(packet)-len(filler):], filler)
 		}
 
-		nextHmac = calcMac(hop.Mu, packet)
+		nextHmac = calcOnionMac(hop.Mu, packet, associatedData)
 	}
 
 	var pubKey [33]byte
 	copy(pubKey[:], sessionKey.PubKey().SerializeCompressed())
 
-	var finalPacket [1300]byte
-	copy(finalPacket[:], packet)
-
 	return &Onion{
-		Version:     [1]byte{0x00},
-		PubKey:      pubKey,
-		HopPayloads: finalPacket,
-		HMAC:        nextHmac,
+		Version:        [1]byte{0x00},
+		PubKey:         pubKey,
+		HopPayloads:    packet,
+		HMAC:           nextHmac,
+		AssociatedData: associatedData,
 	}, nil
 }
 
+// Peel processes the onion as the given user and returns the user's payload
+// along with the onion that should be passed to the next hop. Any error that
+// the origin of the onion should be told about is returned as a
+// FailureMessage. If the failure happened after the user derived its shared
+// secret with the origin, then the returned HopPayload is also non-nil so that
+// its ErrorEncrypter can be used to send the failure back.
+//
+// If the user has a replay log, the shared secret of the onion is added to it
+// and ErrReplayedPacket is returned if the onion has been processed before.
+// The onion's IncomingCLTV is the expiry of the entry, so it must be set.
 func Peel(user *User, onion *Onion) (*HopPayload, *Onion, error) {
-	if onion.Version[0] != 0 {
-		return nil, nil, fmt.Errorf("must use version 0")
+	hopPayload, nextOnion, err := peel(user, onion)
+	if hopPayload == nil || user.ReplayLog == nil {
+		return hopPayload, nextOnion, err
 	}
 
-	peerPubKey, err := btcec.ParsePubKey(onion.PubKey[:])
-	if err != nil {
-		return nil, nil, err
+	replayErr := user.ReplayLog.Put(
+		hashSharedSecret(hopPayload.SharedSecret), onion.IncomingCLTV,
+	)
+	if replayErr != nil {
+		return hopPayload, nil, replayErr
 	}
 
-	privKey := user.privKey
+	return hopPayload, nextOnion, err
+}
 
-	var rhoR [32]byte
-	var nextEphemeral *btcec.PublicKey
-	if onion.EphemeralKey != nil {
-		// Tweak our priv key with the blinding factor
-		ssR := sharedSecret(user.privKey, onion.EphemeralKey)
-		bfR := genKey(ssR, []byte("blinded_node_id"))
-		rhoR = genKey(ssR, rhoType)
+// PeeledOnion is the result of peeling one of the onions in a batch.
+type PeeledOnion struct {
+	// Payload is the user's payload.
+	Payload *HopPayload
 
-		privKey = blindPriv(bfR, user.privKey)
+	// Next is the onion that should be passed to the next hop.
+	Next *Onion
 
-		// SHA256(E(i) || ss(i)) * e(i)
-		bf := blindingFactor(ssR, onion.EphemeralKey)
-		nextEphemeral = blindPub(bf, onion.EphemeralKey)
+	// Err is the error from peeling the onion.
+	Err error
+}
+
+// PeelBatch peels a set of onions as the given user and commits their shared
+// secrets to the user's replay log in a single batch with the given ID. Onions
+// that are replays, either of an earlier onion or of another onion in the same
+// batch, fail with ErrReplayedPacket. Peeling the same batch again gives the
+// same result.
+func PeelBatch(user *User, id []byte,
+	onions []*Onion) ([]*PeeledOnion, error) {
+
+	if len(onions) > 0xffff {
+		return nil, fmt.Errorf("too many onions in batch: %d",
+			len(onions))
 	}
 
-	ss := sharedSecret(privKey, peerPubKey)
-	bf := blindingFactor(ss, peerPubKey)
-	mu := genKey(ss, muType)
-	rho := genKey(ss, rhoType)
+	batch := NewBatch(id)
+	results := make([]*PeeledOnion, len(onions))
+	for i, onion := range onions {
+		payload, next, err := peel(user, onion)
+		results[i] = &PeeledOnion{
+			Payload: payload,
+			Next:    next,
+			Err:     err,
+		}
 
-	var packet [1300]byte
-	copy(packet[:], onion.HopPayloads[:])
+		if payload != nil {
+			batch.Put(
+				uint16(i), hashSharedSecret(payload.SharedSecret),
+				onion.IncomingCLTV,
+			)
+		}
+	}
 
-	// Validate the HMAC.
-	calculatedHmac := calcMac(mu, packet[:])
-	if !hmac.Equal(onion.HMAC[:], calculatedHmac[:]) {
-		return nil, nil, fmt.Errorf("invalid HMAC")
+	if user.ReplayLog == nil {
+		return results, nil
 	}
 
-	// First we pad the packet with 1300 zero bytes.
-	var paddedPacket [2600]byte
-	copy(paddedPacket[:], packet[:])
+	replays, err := user.ReplayLog.PutBatch(batch)
+	if err != nil {
+		return nil, err
+	}
 
-	// Now we go ahead and de-obfuscate the packet.
-	stream := pSByteStream(rho[:], 2600)
-	xor(paddedPacket[:], paddedPacket[:], stream)
+	for i, result := range results {
+		if replays.Contains(uint16(i)) {
+			result.Next = nil
+			result.Err = ErrReplayedPacket
+		}
+	}
 
-	// We should now be able to read our packet. (len + payload + hmac)
-	payloadLen := binary.BigEndian.Uint16(paddedPacket[:2])
+	return results, nil
+}
 
-	payload := make([]byte, payloadLen)
-	copy(payload[:], paddedPacket[2:2+payloadLen])
+// peel processes the onion as the given user without checking the replay log.
+func peel(user *User, onion *Onion) (*HopPayload, *Onion, error) {
+	if user.Signer == nil {
+		return nil, nil, fmt.Errorf("%s: %w", user.Name, ErrNoSigner)
+	}
+
+	var hash onionHash
+	hash.OnionSHA256 = sha256.Sum256(onion.Serialize())
 
-	hopPayload, err := DeserializeHopPayload(payload)
+	if onion.Version[0] != 0 {
+		return nil, nil, &FailInvalidOnionVersion{hash}
+	}
+
+	peerPubKey, err := btcec.ParsePubKey(onion.PubKey[:])
 	if err != nil {
-		return nil, nil, fmt.Errorf("cant deserilize payload: %v", err)
+		return nil, nil, &FailInvalidOnionKey{hash}
+	}
+
+	var ss, ssR [32]byte
+	pathKey := onion.EphemeralKey
+	if pathKey != nil {
+		// Our key is tweaked with the blinding factor.
+		ss, ssR, err = blindedSharedSecrets(
+			user.Signer, pathKey, peerPubKey,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		ss, err = user.Signer.ECDH(peerPubKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to derive shared "+
+				"secret: %w", err)
+		}
+	}
+
+	// Validate the HMAC and remove our layer of the onion. Nodes inside a
+	// blinded route must not reveal anything other than that the onion
+	// could not be processed.
+	payload, nextOnion, err := unwrapPacket(ss, peerPubKey, onion)
+	if errors.Is(err, errInvalidHmac) {
+		if onion.EphemeralKey != nil {
+			return nil, nil, &FailInvalidOnionBlinding{hash}
+		}
+
+		return nil, nil, &FailInvalidOnionHmac{hash}
 	}
 
+	// From here on, we can send failures back to the origin so we return
+	// our shared secret along with any failure.
+	hopPayload := &HopPayload{
+		SharedSecret: ss,
+	}
+	blinded := onion.EphemeralKey != nil
+	fail := func(msg FailureMessage) (*HopPayload, *Onion, error) {
+		if blinded {
+			msg = &FailInvalidOnionBlinding{hash}
+		}
+
+		return hopPayload, nil, msg
+	}
+
+	if err != nil {
+		return fail(&FailInvalidOnionPayload{})
+	}
+
+	deserialized, err := DeserializeHopPayload(payload)
+	if err != nil {
+		return fail(payloadFailure(err, payload))
+	}
+	hopPayload.Payload = deserialized.Payload
+	hopPayload.FwdTo = deserialized.FwdTo
+
 	hopPayloadData, err := DecodeHopDataPayload(hopPayload.Payload)
 	if err != nil {
-		return nil, nil, err
+		return fail(payloadFailure(err, payload))
 	}
+	hopPayload.Data = hopPayloadData
+	scid := hopPayloadData.ShortChannelID
 
 	if hopPayloadData.EphemeralKey != nil {
-		// Tweak our priv key with the blinding factor
-		ssR := sharedSecret(user.privKey, hopPayloadData.EphemeralKey)
-		bfR := genKey(ssR, []byte("blinded_node_id"))
-		rhoR = genKey(ssR, rhoType)
+		// We are the introduction node of the blinded route so we were
+		// given the blinding point in our payload.
+		blinded = true
+		pathKey = hopPayloadData.EphemeralKey
+		ssR, err = user.Signer.ECDH(pathKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to derive shared "+
+				"secret: %w", err)
+		}
+	}
 
-		privKey = blindPriv(bfR, user.privKey)
+	var loadFromRecipient *RecipientData
+	if len(hopPayloadData.EncryptedData) != 0 {
+		if pathKey == nil {
+			return fail(&FailInvalidOnionBlinding{hash})
+		}
 
-		// SHA256(E(i) || ss(i)) * e(i)
-		bf := blindingFactor(ssR, hopPayloadData.EphemeralKey)
-		nextEphemeral = blindPub(bf, hopPayloadData.EphemeralKey)
+		recipient, err := openRecipientData(
+			user, ssR, pathKey, hopPayloadData.EncryptedData,
+			onion.IncomingAmount, onion.IncomingCLTV,
+		)
+		if err != nil {
+			return fail(&FailInvalidOnionBlinding{hash})
+		}
+
+		loadFromRecipient = recipient.data
+		hopPayload.RecipientData = loadFromRecipient
+		hopPayload.FwdTo = recipient.next
+		hopPayload.DecryptedDataFromRecipient = loadFromRecipient.Payload
+		hopPayload.PathID = loadFromRecipient.PathID
+		nextOnion.EphemeralKey = recipient.nextPathKey
+	} else if hopPayload.FwdTo == nil && scid != nil {
+		// If we were only told which channel to forward the onion over,
+		// then we look up our peer on that channel.
+		hopPayload.FwdTo, err = user.Channels.Peer(*scid, user.PubKey)
+		if err != nil {
+			return fail(&FailUnknownNextPeer{})
+		}
 	}
 
-	if len(hopPayloadData.EncryptedData) != 0 {
-		stream := pSByteStream(rhoR[:], len(hopPayloadData.EncryptedData))
-		decrypted := make([]byte, len(hopPayloadData.EncryptedData))
+	// The sender of a payment over a blinded path doesn't know our policy,
+	// so we work out what to forward from the incoming HTLC ourselves.
+	if loadFromRecipient != nil && loadFromRecipient.PaymentRelay != nil &&
+		hopPayload.FwdTo != nil {
+
+		if hopPayloadData.AmtToForward != 0 ||
+			hopPayloadData.OutgoingCLTV != 0 {
 
-		xor(decrypted[:], hopPayloadData.EncryptedData[:], stream)
+			return fail(&FailInvalidOnionBlinding{hash})
+		}
 
-		loadFromRecipient, err := DeserializeHopPayload(decrypted)
+		amt, cltv, err := loadFromRecipient.PaymentRelay.Forward(
+			onion.IncomingAmount, onion.IncomingCLTV,
+		)
 		if err != nil {
-			return nil, nil, err
+			return fail(&FailInvalidOnionBlinding{hash})
 		}
 
-		hopPayload.FwdTo = loadFromRecipient.FwdTo
-		hopPayload.DecryptedDataFromRecipient = loadFromRecipient.Payload
+		hopPayloadData.AmtToForward = amt
+		hopPayloadData.OutgoingCLTV = cltv
+		nextOnion.IncomingAmount = amt
+		nextOnion.IncomingCLTV = cltv
+	}
+
+	// Dummy hops at the end of a blinded path point back to us, so we
+	// peel through our own layers until we reach our real payload.
+	if loadFromRecipient != nil && hopPayload.FwdTo != nil &&
+		hopPayload.FwdTo.IsEqual(user.PubKey) {
+
+		if loadFromRecipient.PaymentRelay == nil {
+			nextOnion.IncomingAmount = onion.IncomingAmount
+			nextOnion.IncomingCLTV = onion.IncomingCLTV
+		}
+
+		return peel(user, nextOnion)
+	}
+
+	// As the recipient of a blinded path, we check that the onion was
+	// built from a path that we issued so that we can't be probed with
+	// forged paths.
+	if blinded && hopPayload.FwdTo == nil && user.PathStore != nil {
+		if err := VerifyPathID(user.PathStore, hopPayload.PathID); err != nil {
+			return fail(&FailInvalidOnionBlinding{hash})
+		}
+	}
+
+	return hopPayload, nextOnion, nil
+}
+
+// recipientHop is what a hop of a blinded path learns from the encrypted data
+// that the recipient left for it.
+type recipientHop struct {
+	// data is the decrypted data from the recipient.
+	data *RecipientData
+
+	// next is the node that the hop forwards to, which is looked up in the
+	// hop's channels if the recipient only gave the channel. It is nil for
+	// the final hop.
+	next *btcec.PublicKey
+
+	// nextPathKey is the path key that the hop passes on to the next node.
+	nextPathKey *btcec.PublicKey
+}
+
+// openRecipientData decrypts the encrypted data that the recipient of a
+// blinded path left for the user, who derived the shared secret ssR with the
+// creator of the path from the given path key. The data must follow the rules
+// for which hops may be given a path ID or the path key of the next path, and
+// the HTLC that the user received must meet the recipient's payment
+// constraints.
+func openRecipientData(user *User, ssR [32]byte, pathKey *btcec.PublicKey,
+	encrypted []byte, amt uint64, cltv uint32) (*recipientHop, error) {
+
+	decrypted, err := decryptRecipientData(genKey(ssR, rhoType), encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted data: %w", err)
+	}
+
+	data, err := DecodeRecipientData(decrypted)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted data: %w", err)
+	}
+
+	// Only the final hop may be given a path ID and only a hop that
+	// forwards may be given the path key of the next path.
+	forwards := data.NextNodeID != nil || data.ShortChannelID != nil
+	if data.PathID != nil && forwards {
+		return nil, fmt.Errorf("path id given to a forwarding hop")
+	}
+
+	if data.NextPathKeyOverride != nil && !forwards {
+		return nil, fmt.Errorf("next path key given to the final hop")
+	}
+
+	// The recipient limits the HTLCs that may use its path.
+	constraints := data.PaymentConstraints
+	if constraints != nil && amt < constraints.HtlcMinimumMsat {
+		return nil, fmt.Errorf("amount %d msat below the minimum of "+
+			"%d msat", amt, constraints.HtlcMinimumMsat)
+	}
+
+	if constraints != nil && cltv > constraints.MaxCltvExpiry {
+		return nil, fmt.Errorf("cltv expiry %d above the maximum of %d",
+			cltv, constraints.MaxCltvExpiry)
+	}
+
+	// If we were only told which channel to forward the onion over, then
+	// we look up our peer on that channel.
+	next := data.NextNodeID
+	if next == nil && data.ShortChannelID != nil {
+		next, err = user.Channels.Peer(*data.ShortChannelID, user.PubKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The next node starts another blinded path that was joined to ours,
+	// so it expects the path key of that path.
+	nextPathKey := data.NextPathKeyOverride
+	if nextPathKey == nil {
+		// SHA256(E(i) || ss(i)) * e(i)
+		bf := blindingFactor(ssR, pathKey)
+		nextPathKey = blindPub(bf, pathKey)
+	}
+
+	return &recipientHop{
+		data:        data,
+		next:        next,
+		nextPathKey: nextPathKey,
+	}, nil
+}
+
+// blindedSharedSecrets derives the shared secret with the creator of a blinded
+// path from the blinding point and then the shared secret with the sender of
+// the onion using our key tweaked with the resulting blinding factor.
+func blindedSharedSecrets(signer Signer, blindingPoint,
+	peerPubKey *btcec.PublicKey) ([32]byte, [32]byte, error) {
+
+	var ss, ssR [32]byte
+	ssR, err := signer.ECDH(blindingPoint)
+	if err != nil {
+		return ss, ssR, fmt.Errorf("unable to derive shared secret: %w",
+			err)
+	}
+	bfR := genKey(ssR, blindedNodeIDType)
+
+	ss, err = signer.BlindedECDH(bfR, peerPubKey)
+	if err != nil {
+		return ss, ssR, fmt.Errorf("unable to derive shared secret: %w",
+			err)
+	}
+
+	return ss, ssR, nil
+}
+
+// unwrapPacket checks the HMAC of the onion with the shared secret derived from
+// its pub key and removes a layer of obfuscation. The hop's payload is
+// returned along with the onion for the next hop. If the HMAC of the next
+// onion is all zeros, then this is the final hop.
+func unwrapPacket(ss [32]byte, peerPubKey *btcec.PublicKey,
+	onion *Onion) ([]byte, *Onion, error) {
+
+	packetSize := len(onion.HopPayloads)
+	if packetSize < minPacketSize {
+		return nil, nil, fmt.Errorf("hop payloads must be at least %d "+
+			"bytes", minPacketSize)
+	}
+
+	mu := genKey(ss, muType)
+	rho := genKey(ss, rhoType)
+
+	calculatedHmac := calcOnionMac(
+		mu, onion.HopPayloads, onion.AssociatedData,
+	)
+	if !hmac.Equal(onion.HMAC[:], calculatedHmac[:]) {
+		return nil, nil, errInvalidHmac
+	}
+
+	// First we pad the packet with as many zero bytes as the packet
+	// size.
+	paddedPacket := make([]byte, 2*packetSize)
+	copy(paddedPacket, onion.HopPayloads)
+
+	// Now we go ahead and de-obfuscate the packet.
+	stream := pSByteStream(rho[:], 2*packetSize)
+	xor(paddedPacket, paddedPacket, stream)
+
+	// We should now be able to read our packet. (len + payload + hmac)
+	payloadLen, lenSize, err := tlv.DecodeBigSize(paddedPacket[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	maxPayloadLen := packetSize - lenSize - 32
+	if payloadLen == 0 || maxPayloadLen <= 0 ||
+		payloadLen > uint64(maxPayloadLen) {
+
+		return nil, nil, fmt.Errorf("invalid payload length: %d",
+			payloadLen)
 	}
+	payloadEnd := lenSize + int(payloadLen)
+
+	payload := make([]byte, payloadLen)
+	copy(payload[:], paddedPacket[lenSize:payloadEnd])
 
 	var nextHmac [32]byte
-	copy(nextHmac[:], paddedPacket[2+payloadLen:2+payloadLen+32])
+	copy(nextHmac[:], paddedPacket[payloadEnd:payloadEnd+32])
 
-	var finalPacket [1300]byte
-	copy(finalPacket[:], paddedPacket[2+payloadLen+32:])
+	finalPacket := make([]byte, packetSize)
+	copy(finalPacket, paddedPacket[payloadEnd+32:])
 
 	// Blind the given ephemeral pub key to get the next one.
+	bf := blindingFactor(ss, peerPubKey)
 	nextPubKey := blindPub(bf, peerPubKey)
 	var nextPubKeyBytes [33]byte
 	copy(nextPubKeyBytes[:], nextPubKey.SerializeCompressed())
 
-	return hopPayload, &Onion{
-		Version:      onion.Version,
-		PubKey:       nextPubKeyBytes,
-		HopPayloads:  finalPacket,
-		HMAC:         nextHmac,
-		EphemeralKey: nextEphemeral,
+	return payload, &Onion{
+		Version:        onion.Version,
+		PubKey:         nextPubKeyBytes,
+		HopPayloads:    finalPacket,
+		HMAC:           nextHmac,
+		AssociatedData: onion.AssociatedData,
 	}, nil
 }
 
-func BuildBlindedPath(sessionKey *btcec.PrivateKey,
-	hopsData []*HopData) (*BlindedPath, error) {
+// BlindedPathOption is an optional argument to BuildBlindedPath.
+type BlindedPathOption func(*blindedPathOptions)
 
-	if len(hopsData) < 2 {
-		return nil, fmt.Errorf("need at least 2 nodes for a blinded " +
-			"path")
+// blindedPathOptions holds the optional arguments to BuildBlindedPath.
+type blindedPathOptions struct {
+	numDummyHops int
+	padding      bool
+	pathID       []byte
+	channels     *ChannelTable
+	nextPath     *BlindedPath
+
+	// recipientData is the encoded data for each hop, which is encrypted
+	// as it is instead of the data that would be encoded from the hops.
+	recipientData [][]byte
+}
+
+// WithDummyHops appends the given number of dummy hops to the end of the path
+// so that the sender can't tell how long the path really is. The dummy hops
+// all point back to the recipient, which peels through them when it receives
+// an onion.
+func WithDummyHops(n int) BlindedPathOption {
+	return func(o *blindedPathOptions) {
+		o.numDummyHops = n
 	}
+}
 
-	firstBlindingEphemeral := sessionKey.PubKey()
-	entryNode := hopsData[0].PubKey
+// WithPadding pads the data for each hop in the path to the same length so
+// that the sender can't learn anything about the hops from the length of their
+// encrypted data.
+func WithPadding() BlindedPathOption {
+	return func(o *blindedPathOptions) {
+		o.padding = true
+	}
+}
 
-	blindedNodeIds := make([]*btcec.PublicKey, len(hopsData))
-	encryptedData := make([][]byte, len(hopsData))
+// WithPathID sets the path ID in the data for the final hop so that the
+// recipient can check that onions sent to the path were built from it.
+func WithPathID(pathID []byte) BlindedPathOption {
+	return func(o *blindedPathOptions) {
+		o.pathID = pathID
+	}
+}
 
-	ephemeral := sessionKey
-	for i := 0; i < len(hopsData); i++ {
-		ss := sharedSecret(ephemeral, hopsData[i].PubKey)
-		bf := genKey(ss, []byte("blinded_node_id"))
-		rho := genKey(ss, rhoType)
+// WithCompactEntryNode identifies the entry node of the path by one of its
+// channels in the given table instead of its pub key, which makes the encoded
+// path 24 bytes shorter. The sender must know the channel to use the path.
+func WithCompactEntryNode(channels *ChannelTable) BlindedPathOption {
+	return func(o *blindedPathOptions) {
+		o.channels = channels
+	}
+}
 
-		blindedNodeIds[i] = blindPub(bf, hopsData[i].PubKey)
+// WithNextPath concatenates another blinded path to the end of the path, such
+// as when an LSP prepends its own hops to the path of a client. The last of the
+// given hops forwards to the entry node of the next path and overrides the path
+// key with the next path's first path key. The path ID and dummy hops belong to
+// the recipient of the next path, so they can't be added to the path as well.
+func WithNextPath(next *BlindedPath) BlindedPathOption {
+	return func(o *blindedPathOptions) {
+		o.nextPath = next
+	}
+}
 
-		var fwdTo *btcec.PublicKey
-		if i != len(hopsData)-1 {
-			fwdTo = hopsData[i+1].PubKey
+// withRecipientData encrypts the given data for each hop instead of the data
+// that is encoded from the hops. It lets the test vectors, which use records
+// that we don't, be built with BuildBlindedPath.
+func withRecipientData(data [][]byte) BlindedPathOption {
+	return func(o *blindedPathOptions) {
+		o.recipientData = data
+	}
+}
+
+func BuildBlindedPath(sessionKey *btcec.PrivateKey, hopsData []*HopData,
+	opts ...BlindedPathOption) (*BlindedPath, error) {
+
+	var options blindedPathOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	// A path of only the recipient doesn't hide the recipient, but it still
+	// lets the recipient check with the path ID that a payment was sent
+	// over a path that it issued.
+	if len(hopsData) < 1 {
+		return nil, fmt.Errorf("need at least 1 node for a blinded " +
+			"path")
+	}
+
+	if options.numDummyHops < 0 {
+		return nil, fmt.Errorf("invalid number of dummy hops: %d",
+			options.numDummyHops)
+	}
+
+	next := options.nextPath
+	if next != nil {
+		if err := checkNextPath(next, &options); err != nil {
+			return nil, err
 		}
+	}
 
-		payload := &HopPayload{
-			Payload: hopsData[i].ClearData,
-			FwdTo:   fwdTo,
+	// The recipient forwards to itself for each dummy hop and its data
+	// is given to the last of them.
+	if options.numDummyHops > 0 {
+		recipient := hopsData[len(hopsData)-1]
+
+		withDummies := make(
+			[]*HopData, 0, len(hopsData)+options.numDummyHops,
+		)
+		withDummies = append(withDummies, hopsData[:len(hopsData)-1]...)
+		for i := 0; i < options.numDummyHops; i++ {
+			withDummies = append(withDummies, &HopData{
+				PubKey: recipient.PubKey,
+			})
 		}
-		payloadSer := payload.Serialize()
+		hopsData = append(withDummies, recipient)
+	}
 
-		stream := pSByteStream(rho[:], len(payloadSer))
-		xor(payloadSer[:], payloadSer[:], stream)
+	if options.recipientData != nil &&
+		len(options.recipientData) != len(hopsData) {
 
-		encryptedData[i] = payloadSer
+		return nil, fmt.Errorf("recipient data for %d of %d hops",
+			len(options.recipientData), len(hopsData))
+	}
 
-		ephemeral = blindPriv(blindingFactor(ss, ephemeral.PubKey()), ephemeral)
+	var entrySCIDDir *SCIDDir
+	if options.channels != nil {
+		dir, ok := options.channels.SCIDDir(hopsData[0].PubKey)
+		if !ok {
+			return nil, fmt.Errorf("entry node has no channels to " +
+				"identify it by")
+		}
+		entrySCIDDir = &dir
 	}
 
-	return &BlindedPath{
-		EntryNodeID:               entryNode,
+	// The pay info of a concatenated path can only be worked out if we
+	// know what the next path costs.
+	var payInfo *BlindedPayInfo
+	if next == nil || next.PayInfo != nil {
+		var err error
+		payInfo, err = newBlindedPayInfo(hopsData, next)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	blindedNodeIds, encryptedData := blindHops(
+		sessionKey, hopsData, &options,
+	)
+
+	path := &BlindedPath{
+		EntryNodeID:               hopsData[0].PubKey,
 		BlindedNodeIDs:            blindedNodeIds[1:],
 		EncryptedData:             encryptedData,
-		FirstBlindingEphemeralKey: firstBlindingEphemeral,
+		FirstBlindingEphemeralKey: sessionKey.PubKey(),
+		EntryBlindedNodeID:        blindedNodeIds[0],
+		EntrySCIDDir:              entrySCIDDir,
+		PayInfo:                   payInfo,
+	}
+
+	// The next path's entry node is reached over its blinded node ID like
+	// the rest of our hops, with the path key from the override.
+	if next != nil {
+		path.BlindedNodeIDs = append(
+			path.BlindedNodeIDs, next.EntryBlindedNodeID,
+		)
+		path.BlindedNodeIDs = append(
+			path.BlindedNodeIDs, next.BlindedNodeIDs...,
+		)
+		path.EncryptedData = append(
+			path.EncryptedData, next.EncryptedData...,
+		)
+	}
+
+	return path, nil
+}
+
+// checkNextPath checks that the path can be concatenated to the hops of a new
+// path with the given options.
+func checkNextPath(next *BlindedPath, options *blindedPathOptions) error {
+	if options.numDummyHops > 0 || options.pathID != nil {
+		return fmt.Errorf("dummy hops and path IDs can't be added to " +
+			"a path that another path is concatenated to")
+	}
+
+	if next.EntryNodeID == nil {
+		return fmt.Errorf("unknown entry node of the next path")
+	}
+
+	if next.EntryBlindedNodeID == nil {
+		return fmt.Errorf("next path has no blinded node ID for its " +
+			"entry node")
+	}
+
+	if len(next.EncryptedData) != len(next.BlindedNodeIDs)+1 {
+		return fmt.Errorf("next path has encrypted data for %d of %d "+
+			"hops", len(next.EncryptedData),
+			len(next.BlindedNodeIDs)+1)
+	}
+
+	return nil
+}
+
+// newBlindedPayInfo aggregates the payment relay, constraints and allowed
+// features of the hops in a blinded path, starting from the recipient, into the
+// pay info for the whole path. The fees are rounded up so that every hop gets at least its fee.
+// If another path is concatenated to the hops, then the aggregation starts from
+// its pay info and the last of the hops forwards to it.
+func newBlindedPayInfo(hopsData []*HopData,
+	next *BlindedPath) (*BlindedPayInfo, error) {
+
+	var (
+		feeBase, feeRate uint64
+		cltvDelta        uint64
+		minHtlc          uint64
+		maxHtlc          uint64
+		features         []byte
+	)
+	if next != nil {
+		features = next.PayInfo.Features
+		feeBase = uint64(next.PayInfo.FeeBaseMsat)
+		feeRate = uint64(next.PayInfo.FeeProportionalMillionths)
+		cltvDelta = uint64(next.PayInfo.CltvExpiryDelta)
+		minHtlc = next.PayInfo.HtlcMinimumMsat
+		if next.PayInfo.HtlcMaximumMsat != math.MaxUint64 {
+			maxHtlc = next.PayInfo.HtlcMaximumMsat
+		}
+	}
+
+	for i := len(hopsData) - 1; i >= 0; i-- {
+		hop := hopsData[i]
+		features = mergeFeatures(features, hop.AllowedFeatures)
+
+		// The recipient doesn't forward so its relay is not used.
+		relay := hop.PaymentRelay
+		if relay != nil && (i != len(hopsData)-1 || next != nil) {
+			base := uint64(relay.FeeBaseMsat)
+			rate := uint64(relay.FeeProportionalMillionths)
+
+			feeBase = ceilDiv(
+				base*1_000_000+feeBase*(1_000_000+rate), 1_000_000,
+			)
+			feeRate = ceilDiv(
+				(feeRate+rate)*1_000_000+feeRate*rate, 1_000_000,
+			)
+			cltvDelta += uint64(relay.CltvExpiryDelta)
+
+			// The limits of the later hops apply to what this hop
+			// forwards, so they grow by its fee.
+			minHtlc = relay.incomingAmount(minHtlc)
+			if maxHtlc != 0 {
+				maxHtlc = relay.incomingAmount(maxHtlc)
+			}
+		}
+
+		constraints := hop.PaymentConstraints
+		if constraints != nil && constraints.HtlcMinimumMsat > minHtlc {
+			minHtlc = constraints.HtlcMinimumMsat
+		}
+
+		if hop.HtlcMaximumMsat != 0 &&
+			(maxHtlc == 0 || hop.HtlcMaximumMsat < maxHtlc) {
+
+			maxHtlc = hop.HtlcMaximumMsat
+		}
+	}
+
+	if feeBase > math.MaxUint32 || feeRate > math.MaxUint32 ||
+		cltvDelta > math.MaxUint16 {
+
+		return nil, fmt.Errorf("blinded path is too expensive: fee "+
+			"base %d, fee rate %d, cltv delta %d", feeBase, feeRate,
+			cltvDelta)
+	}
+
+	if maxHtlc == 0 {
+		maxHtlc = math.MaxUint64
+	}
+
+	if minHtlc > maxHtlc {
+		return nil, fmt.Errorf("blinded path has an htlc minimum %d "+
+			"above its maximum %d", minHtlc, maxHtlc)
+	}
+
+	return &BlindedPayInfo{
+		FeeBaseMsat:               uint32(feeBase),
+		FeeProportionalMillionths: uint32(feeRate),
+		CltvExpiryDelta:           uint16(cltvDelta),
+		HtlcMinimumMsat:           minHtlc,
+		HtlcMaximumMsat:           maxHtlc,
+		Features:                  features,
 	}, nil
 }
 
+// mergeFeatures returns the union of two feature bit vectors. Feature bits are
+// numbered from the end of the vector, so the shorter vector is lined up with
+// the end of the longer one.
+func mergeFeatures(a, b []byte) []byte {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+
+	if len(a) == 0 {
+		return nil
+	}
+
+	merged := make([]byte, len(a))
+	copy(merged, a)
+
+	offset := len(a) - len(b)
+	for i, f := range b {
+		merged[offset+i] |= f
+	}
+
+	return merged
+}
+
+// blindHops blinds the pub keys of the given hops with the session key and
+// encrypts the data for each hop, telling it where to forward the packet to.
+// The final hop is given the path ID from the options, and the data for every
+// hop is padded to the same length if padding is set. The blinded node ID of
+// every hop, including the first, is returned.
+func blindHops(sessionKey *btcec.PrivateKey, hopsData []*HopData,
+	options *blindedPathOptions) ([]*btcec.PublicKey, [][]byte) {
+
+	pubKeys := make([]*btcec.PublicKey, len(hopsData))
+	recipientData := make([][]byte, len(hopsData))
+	for i, hop := range hopsData {
+		pubKeys[i] = hop.PubKey
+
+		if options.recipientData != nil {
+			recipientData[i] = options.recipientData[i]
+			continue
+		}
+
+		payload := &RecipientData{
+			Payload:            hop.ClearData,
+			PaymentRelay:       hop.PaymentRelay,
+			PaymentConstraints: hop.PaymentConstraints,
+			AllowedFeatures:    hop.AllowedFeatures,
+		}
+
+		last := i == len(hopsData)-1
+		switch {
+		case last && options.nextPath == nil:
+			payload.PathID = options.pathID
+
+		case hop.ShortChannelID != nil:
+			payload.ShortChannelID = hop.ShortChannelID
+
+		case last:
+			payload.NextNodeID = options.nextPath.EntryNodeID
+
+		default:
+			payload.NextNodeID = hopsData[i+1].PubKey
+		}
+
+		if last && options.nextPath != nil {
+			payload.NextPathKeyOverride =
+				options.nextPath.FirstBlindingEphemeralKey
+		}
+
+		recipientData[i] = payload.Encode()
+	}
+
+	if options.padding {
+		recipientData = padRecipientData(recipientData)
+	}
+
+	blindedNodeIds := make([]*btcec.PublicKey, len(hopsData))
+	encryptedData := make([][]byte, len(hopsData))
+	for i, hop := range DeriveHops(sessionKey, pubKeys) {
+		bf := genKey(hop.SS, blindedNodeIDType)
+		blindedNodeIds[i] = blindPub(bf, hop.P)
+
+		encryptedData[i] = encryptRecipientData(hop.Rho, recipientData[i])
+	}
+
+	return blindedNodeIds, encryptedData
+}
+
+// padRecipientData adds a padding record to each of the encoded recipient
+// data streams so that they all have the same length. The padding record has
+// the smallest type so it is placed at the start of each stream.
+func padRecipientData(recipientData [][]byte) [][]byte {
+	// The padding record takes up at least 2 bytes for its type and
+	// length. Since the length of the record's length changes once the
+	// value is 253 bytes long, some lengths can't be padded to exactly
+	// so we look for the smallest length that every stream can reach.
+	paddingLen := func(n int) (int, bool) {
+		switch {
+		case n < 2:
+			return 0, false
+		case n-2 < 0xfd:
+			return n - 2, true
+		case n-4 >= 0xfd:
+			return n - 4, true
+		default:
+			return 0, false
+		}
+	}
+
+	target := 0
+	for _, data := range recipientData {
+		if len(data) > target {
+			target = len(data)
+		}
+	}
+	target += 2
+
+	for {
+		ok := true
+		for _, data := range recipientData {
+			if _, valid := paddingLen(target - len(data)); !valid {
+				ok = false
+				break
+			}
+		}
+
+		if ok {
+			break
+		}
+		target++
+	}
+
+	padded := make([][]byte, len(recipientData))
+	for i, data := range recipientData {
+		n, _ := paddingLen(target - len(data))
+
+		padded[i] = make([]byte, 0, target)
+		padded[i] = append(padded[i], tlv.EncodeBigSize(
+			uint64(recipientPaddingType),
+		)...)
+		padded[i] = append(padded[i], tlv.EncodeBigSize(uint64(n))...)
+		padded[i] = append(padded[i], make([]byte, n)...)
+		padded[i] = append(padded[i], data...)
+	}
+
+	return padded
+}
+
+// encryptRecipientData encrypts the data for a hop in a blinded path with
+// ChaCha20-Poly1305 using the rho key derived from the shared secret with that
+// hop and a zero nonce.
+func encryptRecipientData(rho [32]byte, data []byte) []byte {
+	aead, err := chacha20poly1305.New(rho[:])
+	if err != nil {
+		panic(err)
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+
+	return aead.Seal(nil, nonce[:], data, nil)
+}
+
+// decryptRecipientData reverses encryptRecipientData. An error is returned if
+// the data was not encrypted for the hop or has been tampered with.
+func decryptRecipientData(rho [32]byte, encrypted []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(rho[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+
+	return aead.Open(nil, nonce[:], encrypted, nil)
+}
+
+// payloadFailure converts an error from decoding a hop payload into an
+// invalid_onion_payload failure that points at the offending record.
+func payloadFailure(err error, payload []byte) *FailInvalidOnionPayload {
+	var t tlv.Type
+
+	var unknownErr tlv.ErrUnknownRequiredType
+	var recordErr *ErrInvalidRecord
+	switch {
+	case errors.As(err, &unknownErr):
+		t = tlv.Type(unknownErr)
+	case errors.As(err, &recordErr):
+		t = recordErr.Type
+	default:
+		return &FailInvalidOnionPayload{}
+	}
+
+	return &FailInvalidOnionPayload{
+		Type:   t,
+		Offset: recordOffset(payload, t),
+	}
+}
+
+// recordOffset returns the byte offset of the record with the given type in
+// the TLV stream or 0 if it can't be found.
+func recordOffset(stream []byte, t tlv.Type) uint16 {
+	offset := 0
+	for offset < len(stream) {
+		recordType, n, err := tlv.DecodeBigSize(stream[offset:])
+		if err != nil {
+			return 0
+		}
+
+		if tlv.Type(recordType) == t {
+			return uint16(offset)
+		}
+
+		l, m, err := tlv.DecodeBigSize(stream[offset+n:])
+		if err != nil {
+			return 0
+		}
+
+		offset += n + m + int(l)
+	}
+
+	return 0
+}
+
 // calcMac calculates HMAC-SHA-256 over the message using the passed secret key
 // as input to the HMAC.
 func calcMac(key [32]byte, msg []byte) [32]byte {
@@ -292,6 +1208,12 @@ func calcMac(key [32]byte, msg []byte) [32]byte {
 	return mac
 }
 
+// calcOnionMac calculates the HMAC of an onion over the hop payloads and the
+// associated data.
+func calcOnionMac(key [32]byte, packet, associatedData []byte) [32]byte {
+	return calcMac(key, append(append([]byte{}, packet...), associatedData...))
+}
+
 // rightShift shifts the byte-slice by the given number of bytes to the right
 // and 0-fill the resulting gap.
 func rightShift(slice []byte, num int) {
@@ -304,7 +1226,7 @@ func rightShift(slice []byte, num int) {
 	}
 }
 
-func genFiller(hops []*Hop) []byte {
+func genFiller(hops []*Hop, packetSize int) []byte {
 	numHops := len(hops)
 
 	// We have to generate a filler that matches all but the last hop (the
@@ -317,7 +1239,7 @@ func genFiller(hops []*Hop) []byte {
 
 	for i := 0; i < numHops-1; i++ {
 		// Sum up how many frames were used by prior hops.
-		fillerStart := 1300
+		fillerStart := packetSize
 		for _, h := range hops[:i] {
 			fillerStart -= h.TotalSize()
 		}
@@ -325,10 +1247,10 @@ func genFiller(hops []*Hop) []byte {
 		// The filler is the part dangling off of the end of the
 		// routingInfo, so offset it from there, and use the current
 		// hop's frame count as its size.
-		fillerEnd := 1300 + hops[i].TotalSize()
+		fillerEnd := packetSize + hops[i].TotalSize()
 
 		streamKey := genKey(hops[i].SS, rhoType)
-		streamBytes := pSByteStream(streamKey[:], 2600)
+		streamBytes := pSByteStream(streamKey[:], 2*packetSize)
 
 		xor(filler, filler, streamBytes[fillerStart:fillerEnd])
 	}
@@ -336,7 +1258,7 @@ func genFiller(hops []*Hop) []byte {
 	return filler
 }
 
-func genPadding(sessionKey *btcec.PrivateKey) []byte {
+func genPadding(sessionKey *btcec.PrivateKey, packetSize int) []byte {
 	var sessionKeyBytes [32]byte
 	copy(sessionKeyBytes[:], sessionKey.Serialize())
 
@@ -350,10 +1272,10 @@ func genPadding(sessionKey *btcec.PrivateKey) []byte {
 		panic(err)
 	}
 
-	var res [1300]byte
-	padCipher.XORKeyStream(res[:], res[:])
+	res := make([]byte, packetSize)
+	padCipher.XORKeyStream(res, res)
 
-	return res[:]
+	return res
 }
 
 // pSByteStream generates a pseudo-random byte stream by initialising Chacha20
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/stretchr/testify/require"
+	"math"
 	"testing"
 )
 
@@ -48,11 +49,36 @@ func TestBuildAndPeelOnion(t *testing.T) {
 			},
 			hopUsers: []string{Bob, Charlie, Dave},
 		},
+		{
+			name:       "onion with payment info A -> B -> C",
+			sessionKey: pk1,
+			hopsData: []*HopData{
+				{
+					PubKey:       Users[Bob].PubKey,
+					AmtToForward: 1000,
+					OutgoingCLTV: 144,
+					ShortChannelID: &ShortChannelID{
+						BlockHeight: 101,
+						TxIndex:     1,
+					},
+				},
+				{
+					PubKey:       Users[Charlie].PubKey,
+					AmtToForward: 1000,
+					OutgoingCLTV: 100,
+					PaymentData: &PaymentData{
+						PaymentSecret: [32]byte{1},
+						TotalMsat:     1000,
+					},
+				},
+			},
+			hopUsers: []string{Bob, Charlie},
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			onion, err := BuildOnion(test.sessionKey, test.hopsData)
+			onion, _, err := BuildOnion(test.sessionKey, test.hopsData)
 			require.NoError(t, err)
 
 			var payload *HopPayload
@@ -61,8 +87,7 @@ func TestBuildAndPeelOnion(t *testing.T) {
 				payload, onion, err = Peel(user, onion)
 				require.NoError(t, err)
 
-				pl, err := DecodeHopDataPayload(payload.Payload)
-				require.NoError(t, err)
+				pl := payload.Data
 
 				require.True(
 					t,
@@ -71,6 +96,22 @@ func TestBuildAndPeelOnion(t *testing.T) {
 						pl.ClearData,
 					),
 				)
+				require.Equal(
+					t, test.hopsData[i].AmtToForward,
+					pl.AmtToForward,
+				)
+				require.Equal(
+					t, test.hopsData[i].OutgoingCLTV,
+					pl.OutgoingCLTV,
+				)
+				require.Equal(
+					t, test.hopsData[i].ShortChannelID,
+					pl.ShortChannelID,
+				)
+				require.Equal(
+					t, test.hopsData[i].PaymentData,
+					pl.PaymentData,
+				)
 			}
 		})
 	}
@@ -126,7 +167,7 @@ func TestBuildAndPeelBlindedOnion(t *testing.T) {
 		},
 	}
 
-	onion, err := BuildOnion(aliceSessionKey, hopsData)
+	onion, _, err := BuildOnion(aliceSessionKey, hopsData)
 	require.NoError(t, err)
 
 	// Give onion to Bob:
@@ -145,3 +186,691 @@ func TestBuildAndPeelBlindedOnion(t *testing.T) {
 	_, onion, err = Peel(Users[Eve], onion)
 	require.NoError(t, err)
 }
+
+func TestBlindedPathDummyHops(t *testing.T) {
+	// A -> C -> B(D) -> B(E) -> B(E) -> B(E)
+	eveSessionKey, _ := btcec.NewPrivateKey()
+
+	blindedHopData := []*HopData{
+		{
+			PubKey: Users[Charlie].PubKey,
+		},
+		{
+			PubKey: Users[Dave].PubKey,
+		},
+		{
+			PubKey:    Users[Eve].PubKey,
+			ClearData: []byte("Hi Me, from Me"),
+		},
+	}
+
+	_, err := BuildBlindedPath(
+		eveSessionKey, blindedHopData, WithDummyHops(-1),
+	)
+	require.Error(t, err)
+
+	bp, err := BuildBlindedPath(
+		eveSessionKey, blindedHopData, WithDummyHops(2),
+	)
+	require.NoError(t, err)
+	require.Len(t, bp.BlindedNodeIDs, 4)
+	require.Len(t, bp.EncryptedData, 5)
+
+	// Alice can't tell the dummy hops apart from real ones.
+	hopsData := []*HopData{
+		{
+			PubKey:        bp.EntryNodeID,
+			EncryptedData: bp.EncryptedData[0],
+			EphemeralKey:  bp.FirstBlindingEphemeralKey,
+		},
+	}
+	for i, id := range bp.BlindedNodeIDs {
+		hopsData = append(hopsData, &HopData{
+			PubKey:        id,
+			EncryptedData: bp.EncryptedData[i+1],
+		})
+	}
+	hopsData[len(hopsData)-1].ClearData = []byte("Hi Eve, from Alice")
+
+	aliceSessionKey, _ := btcec.NewPrivateKey()
+	onion, _, err := BuildOnion(aliceSessionKey, hopsData)
+	require.NoError(t, err)
+
+	payload, onion, err := Peel(Users[Charlie], onion)
+	require.NoError(t, err)
+	require.True(t, payload.FwdTo.IsEqual(Users[Dave].PubKey))
+
+	payload, onion, err = Peel(Users[Dave], onion)
+	require.NoError(t, err)
+	require.True(t, payload.FwdTo.IsEqual(Users[Eve].PubKey))
+
+	// Eve peels through the dummy hops in one go.
+	payload, _, err = Peel(Users[Eve], onion)
+	require.NoError(t, err)
+	require.Nil(t, payload.FwdTo)
+	require.Equal(t, []byte("Hi Eve, from Alice"), payload.Data.ClearData)
+	require.Equal(t, []byte("Hi Me, from Me"),
+		payload.DecryptedDataFromRecipient)
+}
+
+func TestBlindedPathPadding(t *testing.T) {
+	sessionKey, _ := btcec.NewPrivateKey()
+
+	blindedHopData := []*HopData{
+		{
+			PubKey:    Users[Charlie].PubKey,
+			ClearData: []byte("Hi Charlie"),
+		},
+		{
+			PubKey: Users[Dave].PubKey,
+		},
+		{
+			PubKey:    Users[Eve].PubKey,
+			ClearData: bytes.Repeat([]byte{0x01}, 300),
+		},
+	}
+
+	bp, err := BuildBlindedPath(sessionKey, blindedHopData, WithPadding())
+	require.NoError(t, err)
+
+	for _, data := range bp.EncryptedData {
+		require.Len(t, data, len(bp.EncryptedData[0]))
+	}
+
+	// The padding is ignored by each hop.
+	hopsData := []*HopData{
+		{
+			PubKey:        bp.EntryNodeID,
+			EncryptedData: bp.EncryptedData[0],
+			EphemeralKey:  bp.FirstBlindingEphemeralKey,
+		},
+		{
+			PubKey:        bp.BlindedNodeIDs[0],
+			EncryptedData: bp.EncryptedData[1],
+		},
+		{
+			PubKey:        bp.BlindedNodeIDs[1],
+			EncryptedData: bp.EncryptedData[2],
+		},
+	}
+
+	onion, _, err := BuildOnion(sessionKey, hopsData)
+	require.NoError(t, err)
+
+	for i, name := range []string{Charlie, Dave, Eve} {
+		var payload *HopPayload
+		payload, onion, err = Peel(Users[name], onion)
+		require.NoError(t, err)
+		require.Equal(t, blindedHopData[i].ClearData,
+			payload.DecryptedDataFromRecipient)
+	}
+}
+
+func TestPadRecipientData(t *testing.T) {
+	// The length of the padding record's length grows at 253 bytes, so
+	// some differences in length can't be padded exactly.
+	for _, lengths := range [][]int{
+		{0, 0}, {0, 10}, {0, 250}, {0, 251}, {0, 252}, {0, 253},
+		{0, 254}, {0, 255}, {3, 400, 17},
+	} {
+		data := make([][]byte, len(lengths))
+		for i, l := range lengths {
+			data[i] = (&RecipientData{
+				Payload: bytes.Repeat([]byte{0x01}, l),
+			}).Encode()
+		}
+
+		padded := padRecipientData(data)
+		for i := range padded {
+			require.Len(t, padded[i], len(padded[0]))
+
+			decoded, err := DecodeRecipientData(padded[i])
+			require.NoError(t, err)
+			require.Len(t, decoded.Payload, lengths[i])
+		}
+	}
+}
+
+func TestBlindedPathPaymentRelay(t *testing.T) {
+	constraints := &PaymentConstraints{
+		MaxCltvExpiry:   1200,
+		HtlcMinimumMsat: 1000,
+	}
+
+	eveSessionKey, _ := btcec.NewPrivateKey()
+	bp, err := BuildBlindedPath(eveSessionKey, []*HopData{
+		{
+			PubKey: Users[Charlie].PubKey,
+			PaymentRelay: &PaymentRelay{
+				FeeBaseMsat:               1000,
+				FeeProportionalMillionths: 100,
+				CltvExpiryDelta:           40,
+			},
+			PaymentConstraints: constraints,
+		},
+		{
+			PubKey: Users[Dave].PubKey,
+			PaymentRelay: &PaymentRelay{
+				FeeBaseMsat:               500,
+				FeeProportionalMillionths: 200,
+				CltvExpiryDelta:           20,
+			},
+			PaymentConstraints: constraints,
+		},
+		{
+			PubKey:             Users[Eve].PubKey,
+			PaymentConstraints: constraints,
+		},
+	})
+	require.NoError(t, err)
+
+	// buildOnion has Alice build an onion over the path with the given
+	// amount and CLTV for the HTLC to Charlie.
+	buildOnion := func(amt uint64, cltv uint32) *Onion {
+		sessionKey, _ := btcec.NewPrivateKey()
+		onion, _, err := BuildOnion(sessionKey, []*HopData{
+			{
+				PubKey:        bp.EntryNodeID,
+				EncryptedData: bp.EncryptedData[0],
+				EphemeralKey:  bp.FirstBlindingEphemeralKey,
+			},
+			{
+				PubKey:        bp.BlindedNodeIDs[0],
+				EncryptedData: bp.EncryptedData[1],
+			},
+			{
+				PubKey:        bp.BlindedNodeIDs[1],
+				EncryptedData: bp.EncryptedData[2],
+				AmtToForward:  100000,
+				OutgoingCLTV:  1000,
+			},
+		})
+		require.NoError(t, err)
+
+		onion.IncomingAmount = amt
+		onion.IncomingCLTV = cltv
+
+		return onion
+	}
+
+	// Each hop takes its fee and CLTV delta from the incoming HTLC.
+	payload, onion, err := Peel(Users[Charlie], buildOnion(101531, 1100))
+	require.NoError(t, err)
+	require.EqualValues(t, 100521, payload.Data.AmtToForward)
+	require.EqualValues(t, 1060, payload.Data.OutgoingCLTV)
+	require.EqualValues(t, 100521, onion.IncomingAmount)
+	require.EqualValues(t, 1060, onion.IncomingCLTV)
+
+	payload, onion, err = Peel(Users[Dave], onion)
+	require.NoError(t, err)
+	require.EqualValues(t, 100001, payload.Data.AmtToForward)
+	require.EqualValues(t, 1040, payload.Data.OutgoingCLTV)
+
+	payload, _, err = Peel(Users[Eve], onion)
+	require.NoError(t, err)
+	require.Nil(t, payload.FwdTo)
+	require.EqualValues(t, 100000, payload.Data.AmtToForward)
+
+	// The pay info covers the fees and CLTV deltas of Charlie and Dave,
+	// and Eve's minimum along with the fees to get it to her.
+	require.Equal(t, &BlindedPayInfo{
+		FeeBaseMsat:               1501,
+		FeeProportionalMillionths: 301,
+		CltvExpiryDelta:           60,
+		HtlcMinimumMsat:           2502,
+		HtlcMaximumMsat:           math.MaxUint64,
+	}, bp.PayInfo)
+
+	_, _, err = bp.PayInfo.IntroductionHTLC(100, 1000)
+	require.Error(t, err)
+
+	// Alice can pay over the path with just the pay info.
+	amt, cltv, err := bp.PayInfo.IntroductionHTLC(100000, 1000)
+	require.NoError(t, err)
+
+	_, onion, err = Peel(Users[Charlie], buildOnion(amt, cltv))
+	require.NoError(t, err)
+
+	_, onion, err = Peel(Users[Dave], onion)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, onion.IncomingAmount, uint64(100000))
+	require.EqualValues(t, 1000, onion.IncomingCLTV)
+
+	// HTLCs outside of the constraints are rejected.
+	var blindingErr *FailInvalidOnionBlinding
+	_, _, err = Peel(Users[Charlie], buildOnion(101531, 1201))
+	require.ErrorAs(t, err, &blindingErr)
+
+	_, _, err = Peel(Users[Charlie], buildOnion(999, 1100))
+	require.ErrorAs(t, err, &blindingErr)
+
+	// Charlie's fee leaves Dave with less than his minimum.
+	_, onion, err = Peel(Users[Charlie], buildOnion(1000, 1100))
+	require.NoError(t, err)
+	require.Zero(t, onion.IncomingAmount)
+
+	_, _, err = Peel(Users[Dave], onion)
+	require.ErrorAs(t, err, &blindingErr)
+}
+
+func TestBlindedPathAllowedFeatures(t *testing.T) {
+	hopsData := []*HopData{
+		{
+			PubKey:          Users[Bob].PubKey,
+			AllowedFeatures: []byte{0x01, 0x00},
+		},
+		{
+			PubKey:          Users[Charlie].PubKey,
+			AllowedFeatures: []byte{0x02},
+		},
+		{PubKey: Users[Dave].PubKey},
+	}
+
+	sessionKey, _ := btcec.NewPrivateKey()
+	bp, err := BuildBlindedPath(sessionKey, hopsData)
+	require.NoError(t, err)
+
+	// The sender must support the features of every hop.
+	require.Equal(t, []byte{0x01, 0x02}, bp.PayInfo.Features)
+
+	payInfo, err := DecodeBlindedPayInfo(bp.PayInfo.Encode())
+	require.NoError(t, err)
+	require.Equal(t, bp.PayInfo, payInfo)
+
+	// Each hop finds its own allowed features in its encrypted data.
+	selected := &SelectedPath{
+		Path:  bp,
+		Route: []*btcec.PublicKey{bp.EntryNodeID},
+	}
+	onion, _, err := selected.BuildOnion(sessionKey, &HopData{})
+	require.NoError(t, err)
+
+	for i, name := range []string{Bob, Charlie, Dave} {
+		payload, next, err := Peel(Users[name], onion)
+		require.NoError(t, err)
+		require.Equal(
+			t, hopsData[i].AllowedFeatures,
+			payload.RecipientData.AllowedFeatures,
+		)
+		onion = next
+	}
+
+	// A path that is joined to another one adds its features to those of
+	// the next path.
+	next, err := BuildBlindedPath(sessionKey, []*HopData{
+		{
+			PubKey:          Users[Dave].PubKey,
+			AllowedFeatures: []byte{0x04, 0x00, 0x00},
+		},
+		{PubKey: Users[Eve].PubKey},
+	})
+	require.NoError(t, err)
+
+	bp, err = BuildBlindedPath(
+		sessionKey, hopsData[:2], WithNextPath(next),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x04, 0x01, 0x02}, bp.PayInfo.Features)
+
+	// Without allowed features, the pay info has none.
+	bp, err = BuildBlindedPath(sessionKey, []*HopData{
+		{PubKey: Users[Bob].PubKey},
+		{PubKey: Users[Charlie].PubKey},
+	})
+	require.NoError(t, err)
+	require.Nil(t, bp.PayInfo.Features)
+}
+
+func TestBlindedPathConcatenation(t *testing.T) {
+	hopsData := []*HopData{
+		{
+			PubKey: Users[Bob].PubKey,
+			PaymentRelay: &PaymentRelay{
+				FeeBaseMsat:               100,
+				FeeProportionalMillionths: 10,
+				CltvExpiryDelta:           10,
+			},
+		},
+		{
+			PubKey: Users[Charlie].PubKey,
+			PaymentRelay: &PaymentRelay{
+				FeeBaseMsat:               1000,
+				FeeProportionalMillionths: 100,
+				CltvExpiryDelta:           40,
+			},
+		},
+		{
+			PubKey: Users[Dave].PubKey,
+			PaymentRelay: &PaymentRelay{
+				FeeBaseMsat:               500,
+				FeeProportionalMillionths: 200,
+				CltvExpiryDelta:           20,
+			},
+		},
+		{PubKey: Users[Eve].PubKey},
+	}
+
+	pathStore := NewMemoryPathStore()
+	pathID, err := NewPathID()
+	require.NoError(t, err)
+	require.NoError(t, pathStore.Add(pathID, 2000))
+
+	// Eve's path starts at Dave and Charlie prepends his own hops to it.
+	eveSessionKey, _ := btcec.NewPrivateKey()
+	evePath, err := BuildBlindedPath(
+		eveSessionKey, hopsData[2:], WithPathID(pathID),
+	)
+	require.NoError(t, err)
+
+	charlieSessionKey, _ := btcec.NewPrivateKey()
+	bp, err := BuildBlindedPath(
+		charlieSessionKey, hopsData[:2], WithNextPath(evePath),
+	)
+	require.NoError(t, err)
+	require.True(t, bp.EntryNodeID.IsEqual(Users[Bob].PubKey))
+	require.Len(t, bp.BlindedNodeIDs, 3)
+	require.Len(t, bp.EncryptedData, 4)
+
+	// The pay info is the same as for a single path over all the hops.
+	whole, err := BuildBlindedPath(eveSessionKey, hopsData)
+	require.NoError(t, err)
+	require.Equal(t, whole.PayInfo, bp.PayInfo)
+
+	// The path ID belongs to Eve's part of the path.
+	_, err = BuildBlindedPath(
+		charlieSessionKey, hopsData[:2], WithNextPath(evePath),
+		WithPathID(pathID),
+	)
+	require.Error(t, err)
+
+	selected, err := SelectBlindedPath(
+		Users[Alice], []*BlindedPath{bp}, 10000, 1000,
+	)
+	require.NoError(t, err)
+
+	sessionKey, _ := btcec.NewPrivateKey()
+	onion, _, err := selected.BuildOnion(sessionKey, &HopData{
+		AmtToForward: 10000,
+		OutgoingCLTV: 1000,
+	})
+	require.NoError(t, err)
+	onion.IncomingAmount = selected.IntroAmount
+	onion.IncomingCLTV = selected.IntroCLTV
+
+	// Charlie hands Dave the path key of Eve's path instead of the one
+	// that follows from his own.
+	for _, name := range []string{Bob, Charlie, Dave} {
+		payload, next, err := Peel(Users[name], onion)
+		require.NoError(t, err)
+		require.NotNil(t, payload.FwdTo)
+
+		if name == Charlie {
+			require.True(t, next.EphemeralKey.IsEqual(
+				evePath.FirstBlindingEphemeralKey,
+			))
+		}
+
+		next.IncomingAmount = payload.Data.AmtToForward
+		next.IncomingCLTV = payload.Data.OutgoingCLTV
+		onion = next
+	}
+
+	eve := *Users[Eve]
+	eve.PathStore = pathStore
+
+	payload, _, err := Peel(&eve, onion)
+	require.NoError(t, err)
+	require.Nil(t, payload.FwdTo)
+	require.Equal(t, pathID, payload.PathID)
+	require.EqualValues(t, 10000, payload.Data.AmtToForward)
+	require.EqualValues(t, 1000, payload.Data.OutgoingCLTV)
+}
+
+func TestBuildAndPeelOnionWithSCIDs(t *testing.T) {
+	sessionKey, _ := btcec.NewPrivateKey()
+
+	bobToCharlie, ok := Channels.ChannelBetween(
+		Users[Bob].PubKey, Users[Charlie].PubKey,
+	)
+	require.True(t, ok)
+
+	charlieToDave, ok := Channels.ChannelBetween(
+		Users[Charlie].PubKey, Users[Dave].PubKey,
+	)
+	require.True(t, ok)
+
+	hopsData := []*HopData{
+		{
+			PubKey:         Users[Bob].PubKey,
+			ShortChannelID: &bobToCharlie,
+		},
+		{
+			PubKey:         Users[Charlie].PubKey,
+			ShortChannelID: &charlieToDave,
+		},
+		{
+			PubKey:    Users[Dave].PubKey,
+			ClearData: []byte("Hi Dave"),
+		},
+	}
+
+	onion, _, err := BuildOnion(sessionKey, hopsData)
+	require.NoError(t, err)
+
+	payload, onion, err := Peel(Users[Bob], onion)
+	require.NoError(t, err)
+	require.True(t, payload.FwdTo.IsEqual(Users[Charlie].PubKey))
+
+	payload, onion, err = Peel(Users[Charlie], onion)
+	require.NoError(t, err)
+	require.True(t, payload.FwdTo.IsEqual(Users[Dave].PubKey))
+
+	payload, _, err = Peel(Users[Dave], onion)
+	require.NoError(t, err)
+	require.Nil(t, payload.FwdTo)
+	require.Equal(t, []byte("Hi Dave"), payload.Data.ClearData)
+
+	// A hop that doesn't know about the channel can't forward the onion.
+	onion, _, err = BuildOnion(sessionKey, hopsData)
+	require.NoError(t, err)
+
+	unknown := *Users[Bob]
+	unknown.Channels = NewChannelTable()
+	_, _, err = Peel(&unknown, onion)
+	require.Error(t, err)
+}
+
+func TestBuildAndPeelBlindedOnionWithSCIDs(t *testing.T) {
+	// A -> B -> C -> B(D) -> B(E) where the blinded path uses short
+	// channel IDs instead of next node IDs.
+	charlieToDave, _ := Channels.ChannelBetween(
+		Users[Charlie].PubKey, Users[Dave].PubKey,
+	)
+	daveToEve, _ := Channels.ChannelBetween(
+		Users[Dave].PubKey, Users[Eve].PubKey,
+	)
+
+	eveSessionKey, _ := btcec.NewPrivateKey()
+	bp, err := BuildBlindedPath(eveSessionKey, []*HopData{
+		{
+			PubKey:         Users[Charlie].PubKey,
+			ShortChannelID: &charlieToDave,
+		},
+		{
+			PubKey:         Users[Dave].PubKey,
+			ShortChannelID: &daveToEve,
+		},
+		{
+			PubKey:    Users[Eve].PubKey,
+			ClearData: []byte("Hi Me, from Me"),
+		},
+	})
+	require.NoError(t, err)
+
+	aliceSessionKey, _ := btcec.NewPrivateKey()
+	onion, _, err := BuildOnion(aliceSessionKey, []*HopData{
+		{
+			PubKey:    Users[Bob].PubKey,
+			ClearData: []byte("Hi Bob, from Alice"),
+		},
+		{
+			PubKey:        Users[Charlie].PubKey,
+			EncryptedData: bp.EncryptedData[0],
+			EphemeralKey:  bp.FirstBlindingEphemeralKey,
+		},
+		{
+			PubKey:        bp.BlindedNodeIDs[0],
+			EncryptedData: bp.EncryptedData[1],
+		},
+		{
+			PubKey:        bp.BlindedNodeIDs[1],
+			EncryptedData: bp.EncryptedData[2],
+		},
+	})
+	require.NoError(t, err)
+
+	_, onion, err = Peel(Users[Bob], onion)
+	require.NoError(t, err)
+
+	payload, onion, err := Peel(Users[Charlie], onion)
+	require.NoError(t, err)
+	require.True(t, payload.FwdTo.IsEqual(Users[Dave].PubKey))
+
+	payload, onion, err = Peel(Users[Dave], onion)
+	require.NoError(t, err)
+	require.True(t, payload.FwdTo.IsEqual(Users[Eve].PubKey))
+
+	payload, _, err = Peel(Users[Eve], onion)
+	require.NoError(t, err)
+	require.Nil(t, payload.FwdTo)
+	require.Equal(
+		t, []byte("Hi Me, from Me"), payload.DecryptedDataFromRecipient,
+	)
+}
+
+func TestOnionAssociatedData(t *testing.T) {
+	sessionKey, _ := btcec.NewPrivateKey()
+	paymentHash := bytes.Repeat([]byte{0x42}, 32)
+
+	onion, _, err := BuildOnion(sessionKey, []*HopData{
+		{
+			PubKey:    Users[Bob].PubKey,
+			ClearData: []byte("Hi Bob"),
+		},
+		{
+			PubKey:    Users[Charlie].PubKey,
+			ClearData: []byte("Hi Charlie"),
+		},
+	}, WithAssociatedData(paymentHash))
+	require.NoError(t, err)
+
+	// The associated data is not part of the serialized onion, so it
+	// can't be peeled without it.
+	received, err := DeserializeOnion(onion.Serialize())
+	require.NoError(t, err)
+
+	_, _, err = Peel(Users[Bob], received)
+	require.IsType(t, &FailInvalidOnionHmac{}, err)
+
+	received.AssociatedData = paymentHash
+	_, next, err := Peel(Users[Bob], received)
+	require.NoError(t, err)
+	require.Equal(t, paymentHash, next.AssociatedData)
+
+	payload, _, err := Peel(Users[Charlie], next)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hi Charlie"), payload.Data.ClearData)
+}
+
+func TestOnionPacketSize(t *testing.T) {
+	hopsData := []*HopData{
+		{
+			PubKey:    Users[Bob].PubKey,
+			ClearData: []byte("Hi Bob"),
+		},
+		{
+			PubKey:    Users[Charlie].PubKey,
+			ClearData: bytes.Repeat([]byte("Hi Charlie"), 200),
+		},
+	}
+
+	// The payloads don't fit in a payment onion.
+	sessionKey, _ := btcec.NewPrivateKey()
+	_, _, err := BuildOnion(sessionKey, hopsData)
+	require.Error(t, err)
+
+	for _, size := range []int{2500, MaxPacketSize} {
+		onion, _, err := BuildOnion(
+			sessionKey, hopsData, WithPacketSize(size),
+		)
+		require.NoError(t, err)
+
+		b := onion.Serialize()
+		require.Len(t, b, size+66)
+
+		onion, err = DeserializeOnion(b)
+		require.NoError(t, err)
+
+		payload, next, err := Peel(Users[Bob], onion)
+		require.NoError(t, err)
+		require.True(t, payload.FwdTo.IsEqual(Users[Charlie].PubKey))
+		require.Len(t, next.HopPayloads, size)
+
+		payload, _, err = Peel(Users[Charlie], next)
+		require.NoError(t, err)
+		require.Equal(t, hopsData[1].ClearData, payload.Data.ClearData)
+	}
+
+	_, _, err = BuildOnion(
+		sessionKey, hopsData, WithPacketSize(MaxPacketSize+1),
+	)
+	require.Error(t, err)
+
+	_, err = DeserializeOnion(make([]byte, 66))
+	require.Error(t, err)
+	_, err = DeserializeOnion(make([]byte, MaxPacketSize+67))
+	require.Error(t, err)
+}
+
+func TestPeelShortPacket(t *testing.T) {
+	sessionKey, _ := btcec.NewPrivateKey()
+	pathKey, _ := btcec.NewPrivateKey()
+
+	var pubKey [33]byte
+	copy(pubKey[:], sessionKey.PubKey().SerializeCompressed())
+
+	// The packets are too short to hold a frame, but have a valid HMAC
+	// so that they aren't rejected before they are read.
+	for _, size := range []int{0, 20, minPacketSize - 1} {
+		ss, err := Users[Bob].Signer.ECDH(sessionKey.PubKey())
+		require.NoError(t, err)
+
+		onion := &Onion{
+			PubKey:      pubKey,
+			HopPayloads: make([]byte, size),
+		}
+		onion.HMAC = calcOnionMac(
+			genKey(ss, muType), onion.HopPayloads, nil,
+		)
+
+		_, _, err = Peel(Users[Bob], onion)
+		require.Error(t, err)
+
+		ss, _, err = blindedSharedSecrets(
+			Users[Bob].Signer, pathKey.PubKey(), sessionKey.PubKey(),
+		)
+		require.NoError(t, err)
+
+		onion.EphemeralKey = pathKey.PubKey()
+		onion.HMAC = calcOnionMac(
+			genKey(ss, muType), onion.HopPayloads, nil,
+		)
+
+		_, _, err = PeelMessage(Users[Bob], onion)
+		require.Error(t, err)
+
+		b := append(append([]byte{0}, pubKey[:]...), onion.HopPayloads...)
+		_, err = DeserializeOnion(append(b, onion.HMAC[:]...))
+		require.Error(t, err)
+	}
+}
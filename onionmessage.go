@@ -0,0 +1,390 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"onion/tlv"
+)
+
+const (
+	// replyPathType is the type of the reply_path record in an onion
+	// message payload.
+	replyPathType tlv.Type = 2
+
+	// messageEncryptedDataType is the type of the encrypted_recipient_data
+	// record in an onion message payload.
+	messageEncryptedDataType tlv.Type = 4
+
+	// MinContentType is the smallest type of the records that carry the
+	// application content of an onion message to the final hop.
+	MinContentType tlv.Type = 64
+
+	// TextContentType is the type of the free-form text message in the
+	// content of an onion message. It is a custom (odd) type so that
+	// recipients that don't know about it may ignore it.
+	TextContentType tlv.Type = 65537
+)
+
+// MessagePayload is the payload of a hop in an onion message.
+type MessagePayload struct {
+	// ReplyPath is the blinded path that the final hop can use to reply
+	// to the sender. It is only set for the final hop.
+	ReplyPath *BlindedPath
+
+	// EncryptedData is the data from the creator of the blinded path for
+	// this hop.
+	EncryptedData []byte
+
+	// Content holds the application records for the final hop. Every
+	// type is at least MinContentType.
+	Content tlv.Stream
+
+	// RecipientData is the decrypted EncryptedData.
+	// NOTE: This is not included in the serialization of the
+	// MessagePayload.
+	RecipientData *RecipientData
+
+	// NextNodeID is the pub key of the node to which the message should
+	// be forwarded. It is nil for the final hop.
+	// NOTE: This is not included in the serialization of the
+	// MessagePayload.
+	NextNodeID *btcec.PublicKey
+}
+
+// Encode encodes the MessagePayload as a TLV stream.
+func (m *MessagePayload) Encode() []byte {
+	s := make(tlv.Stream, len(m.Content)+2)
+	for t, v := range m.Content {
+		s[t] = v
+	}
+
+	if m.ReplyPath != nil {
+		s[replyPathType] = m.ReplyPath.Encode()
+	}
+
+	// The encrypted data for the final hop may be empty but it must still
+	// be present.
+	if m.EncryptedData != nil {
+		s[messageEncryptedDataType] = m.EncryptedData
+	}
+
+	return s.Encode()
+}
+
+// DecodeMessagePayload decodes a TLV stream created by MessagePayload.Encode.
+// Any record with a type of at least MinContentType is content for the final
+// hop and is accepted even if it is even.
+func DecodeMessagePayload(b []byte) (*MessagePayload, error) {
+	known := []tlv.Type{replyPathType, messageEncryptedDataType}
+
+	var (
+		s   tlv.Stream
+		err error
+	)
+	for {
+		s, err = tlv.DecodeStream(b, known...)
+
+		var unknown tlv.ErrUnknownRequiredType
+		if !errors.As(err, &unknown) ||
+			tlv.Type(unknown) < MinContentType {
+
+			break
+		}
+
+		known = append(known, tlv.Type(unknown))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &MessagePayload{
+		EncryptedData: s[messageEncryptedDataType],
+	}
+
+	if v, ok := s[replyPathType]; ok {
+		payload.ReplyPath, err = DecodeBlindedPath(v)
+		if err != nil {
+			return nil, &ErrInvalidRecord{replyPathType, err}
+		}
+	}
+
+	for t, v := range s {
+		if t < MinContentType {
+			continue
+		}
+
+		if payload.Content == nil {
+			payload.Content = make(tlv.Stream)
+		}
+		payload.Content[t] = v
+	}
+
+	return payload, nil
+}
+
+// MessageHandler handles the onion messages that a user is the final hop of.
+type MessageHandler interface {
+	// HandleMessage is given the content of the message along with the
+	// reply path if the sender included one.
+	HandleMessage(content tlv.Stream, replyPath *BlindedPath) error
+}
+
+// MessageOption is an optional argument to BuildOnionMessage and
+// BuildMessageReply.
+type MessageOption func(*messageOptions)
+
+// messageOptions holds the optional arguments for building an onion message.
+type messageOptions struct {
+	replyPath *BlindedPath
+}
+
+// WithReplyPath attaches a blinded path to the message that the final hop can
+// use to reply to the sender without learning who the sender is.
+func WithReplyPath(path *BlindedPath) MessageOption {
+	return func(o *messageOptions) {
+		o.replyPath = path
+	}
+}
+
+// BuildOnionMessage builds an onion message that is sent along the given route
+// of nodes with the content for the last of them. Onion messages are only ever
+// sent over blinded paths, so the route is blinded with the path key and each
+// hop only learns the next node from its encrypted data. The returned onion's
+// EphemeralKey is the path key that is sent to the first hop along with the
+// onion. The onion uses the PaymentPacketSize if the payloads fit and
+// MaxPacketSize otherwise.
+func BuildOnionMessage(sessionKey, pathKey *btcec.PrivateKey,
+	route []*btcec.PublicKey, content tlv.Stream,
+	opts ...MessageOption) (*Onion, error) {
+
+	if len(route) == 0 {
+		return nil, fmt.Errorf("onion message needs at least 1 hop")
+	}
+
+	hopsData := make([]*HopData, len(route))
+	for i, pubKey := range route {
+		hopsData[i] = &HopData{
+			PubKey: pubKey,
+		}
+	}
+	blindedNodeIDs, encryptedData := blindHops(
+		pathKey, hopsData, &blindedPathOptions{},
+	)
+
+	return buildMessage(
+		sessionKey, pathKey.PubKey(), blindedNodeIDs, encryptedData,
+		content, opts,
+	)
+}
+
+// BuildMessageReply builds an onion message that is sent along a reply path
+// that was given with an earlier message. The path was built by the node that
+// the reply is for, so the replier only learns the entry node of the path. The
+// returned onion and its EphemeralKey should be sent to the path's
+// EntryNodeID.
+func BuildMessageReply(sessionKey *btcec.PrivateKey, replyPath *BlindedPath,
+	content tlv.Stream, opts ...MessageOption) (*Onion, error) {
+
+	if replyPath.EntryBlindedNodeID == nil {
+		return nil, fmt.Errorf("reply path has no blinded node ID " +
+			"for its entry node")
+	}
+
+	if len(replyPath.EncryptedData) != len(replyPath.BlindedNodeIDs)+1 {
+		return nil, fmt.Errorf("reply path has encrypted data for %d "+
+			"of %d hops", len(replyPath.EncryptedData),
+			len(replyPath.BlindedNodeIDs)+1)
+	}
+
+	blindedNodeIDs := append(
+		[]*btcec.PublicKey{replyPath.EntryBlindedNodeID},
+		replyPath.BlindedNodeIDs...,
+	)
+
+	return buildMessage(
+		sessionKey, replyPath.FirstBlindingEphemeralKey,
+		blindedNodeIDs, replyPath.EncryptedData, content, opts,
+	)
+}
+
+// buildMessage wraps the encrypted data for each of the blinded hops into an
+// onion message with the content for the final hop.
+func buildMessage(sessionKey *btcec.PrivateKey, pathKey *btcec.PublicKey,
+	blindedNodeIDs []*btcec.PublicKey, encryptedData [][]byte,
+	content tlv.Stream, opts []MessageOption) (*Onion, error) {
+
+	var options messageOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	for t := range content {
+		if t < MinContentType {
+			return nil, fmt.Errorf("content type %d is below %d", t,
+				MinContentType)
+		}
+	}
+
+	ephemeralKey := sessionKey
+	hops := make([]*Hop, len(blindedNodeIDs))
+	totalSize := 0
+	for i := range blindedNodeIDs {
+		payload := &MessagePayload{
+			EncryptedData: encryptedData[i],
+		}
+		if i == len(blindedNodeIDs)-1 {
+			payload.Content = content
+			payload.ReplyPath = options.replyPath
+		}
+
+		hops[i] = NewHop(
+			blindedNodeIDs[i], ephemeralKey, payload.Encode(),
+		)
+		totalSize += hops[i].TotalSize()
+
+		ephemeralKey = blindPriv(hops[i].BF, ephemeralKey)
+	}
+
+	packetSize := PaymentPacketSize
+	if totalSize > PaymentPacketSize {
+		packetSize = MaxPacketSize
+	}
+
+	onion, err := buildPacket(sessionKey, hops, packetSize, nil)
+	if err != nil {
+		return nil, err
+	}
+	onion.EphemeralKey = pathKey
+
+	return onion, nil
+}
+
+// PeelMessage processes the onion message as the given user. The onion's
+// EphemeralKey must be set to the path key that came with the message. If the
+// user is the final hop, the content is passed to the user's MessageHandler
+// and the returned onion is nil. Otherwise, the returned onion should be sent
+// to the payload's NextNodeID along with its EphemeralKey.
+//
+// Onion messages have no way of reporting failures so any invalid message is
+// simply dropped with an error.
+//
+// The user's PathStore is not used. The final hop finds the path ID, if any, in
+// the payload's RecipientData and must check it itself before it treats the
+// message as one that came over a reply path that it issued.
+func PeelMessage(user *User, onion *Onion) (*MessagePayload, *Onion, error) {
+	if user.Signer == nil {
+		return nil, nil, fmt.Errorf("%s: %w", user.Name, ErrNoSigner)
+	}
+
+	if onion.Version[0] != 0 {
+		return nil, nil, fmt.Errorf("unknown onion version: %d",
+			onion.Version[0])
+	}
+
+	pathKey := onion.EphemeralKey
+	if pathKey == nil {
+		return nil, nil, fmt.Errorf("onion message without a path key")
+	}
+
+	peerPubKey, err := btcec.ParsePubKey(onion.PubKey[:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid onion key: %w", err)
+	}
+
+	ss, ssR, err := blindedSharedSecrets(user.Signer, pathKey, peerPubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, nextOnion, err := unwrapPacket(ss, peerPubKey, onion)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to process onion message: "+
+			"%w", err)
+	}
+
+	msg, err := DecodeMessagePayload(payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid message payload: %w", err)
+	}
+
+	if msg.EncryptedData == nil {
+		return nil, nil, fmt.Errorf("message payload without " +
+			"encrypted data")
+	}
+
+	decrypted, err := decryptRecipientData(
+		genKey(ssR, rhoType), msg.EncryptedData,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid encrypted data: %w", err)
+	}
+
+	msg.RecipientData, err = DecodeRecipientData(decrypted)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid encrypted data: %w", err)
+	}
+	recipientData := msg.RecipientData
+
+	// The sender leaves the HMAC for the hop after the final hop empty.
+	if nextOnion.HMAC == [32]byte{} {
+		if recipientData.NextNodeID != nil ||
+			recipientData.ShortChannelID != nil ||
+			recipientData.NextPathKeyOverride != nil {
+
+			return nil, nil, fmt.Errorf("final hop told to " +
+				"forward the message")
+		}
+
+		if user.MessageHandler != nil {
+			err := user.MessageHandler.HandleMessage(
+				msg.Content, msg.ReplyPath,
+			)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		return msg, nil, nil
+	}
+
+	// Only the final hop may be given anything other than the encrypted
+	// data, or a path ID in it.
+	if msg.ReplyPath != nil || len(msg.Content) != 0 ||
+		recipientData.PathID != nil {
+
+		return nil, nil, fmt.Errorf("message content for a hop that " +
+			"is not the final hop")
+	}
+
+	msg.NextNodeID = recipientData.NextNodeID
+	if msg.NextNodeID == nil && recipientData.ShortChannelID != nil {
+		msg.NextNodeID, err = user.Channels.Peer(
+			*recipientData.ShortChannelID, user.PubKey,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if msg.NextNodeID == nil {
+		return nil, nil, fmt.Errorf("no next node for the message")
+	}
+
+	// SHA256(E(i) || ss(i)) * e(i)
+	bf := blindingFactor(ssR, pathKey)
+	nextOnion.EphemeralKey = blindPub(bf, pathKey)
+
+	// The next node may start another blinded path that was joined to the
+	// one that we are on.
+	if recipientData.NextPathKeyOverride != nil {
+		nextOnion.EphemeralKey = recipientData.NextPathKeyOverride
+	}
+
+	// Dummy hops at the end of a reply path point back to us, so we peel
+	// through our own layers until we reach the real payload.
+	if msg.NextNodeID.IsEqual(user.PubKey) {
+		return PeelMessage(user, nextOnion)
+	}
+
+	return msg, nextOnion, nil
+}
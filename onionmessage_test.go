@@ -0,0 +1,237 @@
+package onion
+
+import (
+	"bytes"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/stretchr/testify/require"
+	"onion/tlv"
+	"testing"
+)
+
+// recordingHandler is a MessageHandler that keeps the last message.
+type recordingHandler struct {
+	content   tlv.Stream
+	replyPath *BlindedPath
+}
+
+func (r *recordingHandler) HandleMessage(content tlv.Stream,
+	replyPath *BlindedPath) error {
+
+	r.content = content
+	r.replyPath = replyPath
+
+	return nil
+}
+
+func TestMessagePayloadEncodeDecode(t *testing.T) {
+	pathKey, _ := btcec.NewPrivateKey()
+	replyPath, err := BuildBlindedPath(pathKey, []*HopData{
+		{PubKey: Users[Bob].PubKey},
+		{PubKey: Users[Alice].PubKey},
+	})
+	require.NoError(t, err)
+
+	// The pay info is not encoded with the path.
+	replyPath.PayInfo = nil
+
+	payload := &MessagePayload{
+		ReplyPath:     replyPath,
+		EncryptedData: []byte("encrypted"),
+		Content: tlv.Stream{
+			64:              []byte("even content"),
+			TextContentType: []byte("hello"),
+		},
+	}
+
+	decoded, err := DecodeMessagePayload(payload.Encode())
+	require.NoError(t, err)
+	require.Equal(t, payload, decoded)
+
+	// Unknown even types below the content range are rejected.
+	_, err = DecodeMessagePayload(tlv.Stream{6: {0x01}}.Encode())
+	require.ErrorIs(t, err, tlv.ErrUnknownRequiredType(6))
+}
+
+func TestBuildAndPeelOnionMessage(t *testing.T) {
+	sessionKey, _ := btcec.NewPrivateKey()
+	pathKey, _ := btcec.NewPrivateKey()
+
+	hopUsers := []string{Bob, Charlie, Dave}
+	route := make([]*btcec.PublicKey, len(hopUsers))
+	for i, name := range hopUsers {
+		route[i] = Users[name].PubKey
+	}
+
+	content := tlv.Stream{
+		TextContentType: []byte("Hi Dave"),
+	}
+
+	onion, err := BuildOnionMessage(sessionKey, pathKey, route, content)
+	require.NoError(t, err)
+	require.Len(t, onion.HopPayloads, PaymentPacketSize)
+	require.True(t, onion.EphemeralKey.IsEqual(pathKey.PubKey()))
+
+	// Peeling without the path key fails.
+	_, _, err = PeelMessage(Users[Bob], &Onion{
+		PubKey:      onion.PubKey,
+		HopPayloads: onion.HopPayloads,
+		HMAC:        onion.HMAC,
+	})
+	require.Error(t, err)
+
+	handler := deliverMessage(t, onion, hopUsers)
+	require.Equal(t, content, handler.content)
+	require.Nil(t, handler.replyPath)
+
+	// Hops that are not in the route can't process the message.
+	onion, err = BuildOnionMessage(sessionKey, pathKey, route, content)
+	require.NoError(t, err)
+	_, _, err = PeelMessage(Users[Eve], onion)
+	require.Error(t, err)
+}
+
+func TestOnionMessageContent(t *testing.T) {
+	sessionKey, _ := btcec.NewPrivateKey()
+	pathKey, _ := btcec.NewPrivateKey()
+	route := []*btcec.PublicKey{Users[Bob].PubKey, Users[Charlie].PubKey}
+
+	// Content must use the application types.
+	_, err := BuildOnionMessage(sessionKey, pathKey, route, tlv.Stream{
+		2: []byte("not content"),
+	})
+	require.Error(t, err)
+
+	_, err = BuildOnionMessage(sessionKey, pathKey, nil, nil)
+	require.Error(t, err)
+
+	// Content that doesn't fit in a payment sized packet is sent in a
+	// large onion.
+	large := tlv.Stream{
+		TextContentType: bytes.Repeat([]byte{0x01}, 2000),
+	}
+	onion, err := BuildOnionMessage(sessionKey, pathKey, route, large)
+	require.NoError(t, err)
+	require.Len(t, onion.HopPayloads, MaxPacketSize)
+
+	payload, next, err := PeelMessage(Users[Bob], onion)
+	require.NoError(t, err)
+	require.True(t, payload.NextNodeID.IsEqual(Users[Charlie].PubKey))
+
+	payload, next, err = PeelMessage(Users[Charlie], next)
+	require.NoError(t, err)
+	require.Nil(t, next)
+	require.Equal(t, large, payload.Content)
+}
+
+func TestOnionMessageReply(t *testing.T) {
+	sessionKey, _ := btcec.NewPrivateKey()
+	pathKey, _ := btcec.NewPrivateKey()
+	replyPathKey, _ := btcec.NewPrivateKey()
+
+	// Alice builds a path from Charlie back to herself for the reply
+	// with a dummy hop at the end that she peels through.
+	replyPath, err := BuildBlindedPath(replyPathKey, []*HopData{
+		{PubKey: Users[Charlie].PubKey},
+		{PubKey: Users[Bob].PubKey},
+		{PubKey: Users[Alice].PubKey},
+	}, WithDummyHops(1))
+	require.NoError(t, err)
+	require.Len(t, replyPath.BlindedNodeIDs, 3)
+	replyPath.PayInfo = nil
+
+	onion, err := BuildOnionMessage(
+		sessionKey, pathKey, []*btcec.PublicKey{
+			Users[Bob].PubKey, Users[Charlie].PubKey,
+			Users[Dave].PubKey,
+		}, tlv.Stream{TextContentType: []byte("Hi Dave")},
+		WithReplyPath(replyPath),
+	)
+	require.NoError(t, err)
+
+	handler := deliverMessage(t, onion, []string{Bob, Charlie, Dave})
+	require.Equal(t, replyPath, handler.replyPath)
+
+	// Dave sends his reply to the entry node of the reply path.
+	reply := tlv.Stream{TextContentType: []byte("Hi whoever you are")}
+	onion, err = BuildMessageReply(sessionKey, handler.replyPath, reply)
+	require.NoError(t, err)
+	require.True(t, onion.EphemeralKey.IsEqual(
+		replyPath.FirstBlindingEphemeralKey,
+	))
+
+	handler = deliverMessage(t, onion, []string{Charlie, Bob, Alice})
+	require.Equal(t, reply, handler.content)
+
+	// A reply can't be built without the entry node's blinded node ID.
+	replyPath.EntryBlindedNodeID = nil
+	_, err = BuildMessageReply(sessionKey, replyPath, reply)
+	require.Error(t, err)
+}
+
+func TestOnionMessageReplyConcatenated(t *testing.T) {
+	sessionKey, _ := btcec.NewPrivateKey()
+	alicePathKey, _ := btcec.NewPrivateKey()
+	daveSessionKey, _ := btcec.NewPrivateKey()
+
+	// Alice's path starts at Bob and Dave prepends himself and Charlie to
+	// it.
+	alicePath, err := BuildBlindedPath(alicePathKey, []*HopData{
+		{PubKey: Users[Bob].PubKey},
+		{PubKey: Users[Alice].PubKey},
+	})
+	require.NoError(t, err)
+
+	replyPath, err := BuildBlindedPath(daveSessionKey, []*HopData{
+		{PubKey: Users[Dave].PubKey},
+		{PubKey: Users[Charlie].PubKey},
+	}, WithNextPath(alicePath))
+	require.NoError(t, err)
+	require.Len(t, replyPath.BlindedNodeIDs, 3)
+
+	// Eve replies over the whole path.
+	reply := tlv.Stream{TextContentType: []byte("Hi whoever you are")}
+	onion, err := BuildMessageReply(sessionKey, replyPath, reply)
+	require.NoError(t, err)
+
+	handler := deliverMessage(t, onion, []string{Dave, Charlie, Bob, Alice})
+	require.Equal(t, reply, handler.content)
+}
+
+// deliverMessage passes the onion message along the given hops and returns
+// the handler of the final hop.
+func deliverMessage(t *testing.T, onion *Onion,
+	hopUsers []string) *recordingHandler {
+
+	t.Helper()
+
+	for i, name := range hopUsers {
+		user := *Users[name]
+		handler := &recordingHandler{}
+		user.MessageHandler = handler
+
+		// Send the onion over the wire along with the path key.
+		pathKey := onion.EphemeralKey
+		received, err := DeserializeOnion(onion.Serialize())
+		require.NoError(t, err)
+		received.EphemeralKey = pathKey
+
+		payload, next, err := PeelMessage(&user, received)
+		require.NoError(t, err)
+
+		if i == len(hopUsers)-1 {
+			require.Nil(t, next)
+			require.Nil(t, payload.NextNodeID)
+
+			return handler
+		}
+
+		require.Nil(t, handler.content)
+		require.True(t, payload.NextNodeID.IsEqual(
+			Users[hopUsers[i+1]].PubKey,
+		))
+
+		onion = next
+	}
+
+	return nil
+}
@@ -0,0 +1,284 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// PathIDLen is the length of the path IDs created by NewPathID.
+const PathIDLen = 32
+
+// ErrUnknownPathID is returned by VerifyPathID if the path ID doesn't belong to
+// a blinded path that the recipient issued or the path has expired.
+var ErrUnknownPathID = errors.New("unknown path id")
+
+// NewPathID returns a random path ID for a new blinded path.
+func NewPathID() ([]byte, error) {
+	pathID := make([]byte, PathIDLen)
+	if _, err := rand.Read(pathID); err != nil {
+		return nil, err
+	}
+
+	return pathID, nil
+}
+
+// PathStore keeps track of the path IDs of the blinded paths that a recipient
+// has issued so that it can check that the onions it receives over a blinded
+// path were built from one of them.
+type PathStore interface {
+	// Add adds the path ID to the store along with the block height after
+	// which the path is no longer valid.
+	Add(pathID []byte, expiry uint32) error
+
+	// Contains returns true if the path ID is in the store.
+	Contains(pathID []byte) (bool, error)
+
+	// Expire removes all path IDs with an expiry below the given height.
+	Expire(height uint32) error
+
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// VerifyPathID checks that the path ID from the encrypted data of an onion is
+// in the store. ErrUnknownPathID is returned if it is missing or unknown, which
+// means that the sender built the onion from a path that the recipient never
+// issued.
+func VerifyPathID(store PathStore, pathID []byte) error {
+	if len(pathID) == 0 {
+		return ErrUnknownPathID
+	}
+
+	ok, err := store.Contains(pathID)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrUnknownPathID
+	}
+
+	return nil
+}
+
+// MemoryPathStore is a PathStore that is kept in memory.
+type MemoryPathStore struct {
+	mu    sync.Mutex
+	paths map[string]uint32
+}
+
+// NewMemoryPathStore creates an empty MemoryPathStore.
+func NewMemoryPathStore() *MemoryPathStore {
+	return &MemoryPathStore{
+		paths: make(map[string]uint32),
+	}
+}
+
+// Add adds the path ID to the store.
+//
+// NOTE: This is part of the PathStore interface.
+func (m *MemoryPathStore) Add(pathID []byte, expiry uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.paths[string(pathID)] = expiry
+
+	return nil
+}
+
+// Contains returns true if the path ID is in the store.
+//
+// NOTE: This is part of the PathStore interface.
+func (m *MemoryPathStore) Contains(pathID []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.paths[string(pathID)]
+
+	return ok, nil
+}
+
+// Expire removes all path IDs with an expiry below the given height.
+//
+// NOTE: This is part of the PathStore interface.
+func (m *MemoryPathStore) Expire(height uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire(height)
+
+	return nil
+}
+
+// expire removes all path IDs with an expiry below the given height and
+// returns the removed path IDs with their expiry. The caller must hold the
+// lock.
+func (m *MemoryPathStore) expire(height uint32) map[string]uint32 {
+	removed := make(map[string]uint32)
+	for pathID, expiry := range m.paths {
+		if expiry < height {
+			removed[pathID] = expiry
+			delete(m.paths, pathID)
+		}
+	}
+
+	return removed
+}
+
+// Close is a no-op for the in-memory store.
+//
+// NOTE: This is part of the PathStore interface.
+func (m *MemoryPathStore) Close() error {
+	return nil
+}
+
+// FilePathStore is a PathStore that is persisted to a file. The store is small
+// so the whole file is rewritten on every change.
+type FilePathStore struct {
+	mem  *MemoryPathStore
+	path string
+}
+
+// OpenFilePathStore opens the path store at the given path. The file is only
+// created once the first path ID is added.
+func OpenFilePathStore(path string) (*FilePathStore, error) {
+	mem := NewMemoryPathStore()
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	r := bytes.NewReader(b)
+	for r.Len() > 0 {
+		pathID, expiry, err := readPathID(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read path store %s: "+
+				"%w", path, err)
+		}
+
+		mem.paths[string(pathID)] = expiry
+	}
+
+	return &FilePathStore{
+		mem:  mem,
+		path: path,
+	}, nil
+}
+
+// Add adds the path ID to the store.
+//
+// NOTE: This is part of the PathStore interface.
+func (f *FilePathStore) Add(pathID []byte, expiry uint32) error {
+	if len(pathID) > 0xffff {
+		return fmt.Errorf("path id too long: %d bytes", len(pathID))
+	}
+
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+
+	prevExpiry, existed := f.mem.paths[string(pathID)]
+	f.mem.paths[string(pathID)] = expiry
+
+	if err := f.write(); err != nil {
+		// Undo the change so that the store matches what is on disk.
+		if existed {
+			f.mem.paths[string(pathID)] = prevExpiry
+		} else {
+			delete(f.mem.paths, string(pathID))
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Contains returns true if the path ID is in the store.
+//
+// NOTE: This is part of the PathStore interface.
+func (f *FilePathStore) Contains(pathID []byte) (bool, error) {
+	return f.mem.Contains(pathID)
+}
+
+// Expire removes all path IDs with an expiry below the given height.
+//
+// NOTE: This is part of the PathStore interface.
+func (f *FilePathStore) Expire(height uint32) error {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+
+	removed := f.mem.expire(height)
+	if len(removed) == 0 {
+		return nil
+	}
+
+	if err := f.write(); err != nil {
+		// Undo the change so that the store matches what is on disk.
+		for pathID, expiry := range removed {
+			f.mem.paths[pathID] = expiry
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Close is a no-op since the file is only open while it is written.
+//
+// NOTE: This is part of the PathStore interface.
+func (f *FilePathStore) Close() error {
+	return nil
+}
+
+// write writes all the path IDs to a new file and then swaps it in. The caller
+// must hold the lock.
+func (f *FilePathStore) write() error {
+	var b bytes.Buffer
+	for pathID, expiry := range f.mem.paths {
+		writePathID(&b, []byte(pathID), expiry)
+	}
+
+	tmpPath := f.path + ".tmp"
+	if err := os.WriteFile(tmpPath, b.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, f.path)
+}
+
+// writePathID serialises a path ID as:
+//   - 2 byte path ID length followed by the path ID
+//   - 4 byte expiry
+func writePathID(w *bytes.Buffer, pathID []byte, expiry uint32) {
+	_ = binary.Write(w, binary.BigEndian, uint16(len(pathID)))
+	w.Write(pathID)
+	_ = binary.Write(w, binary.BigEndian, expiry)
+}
+
+// readPathID reads a path ID written by writePathID.
+func readPathID(r io.Reader) ([]byte, uint32, error) {
+	var idLen uint16
+	if err := binary.Read(r, binary.BigEndian, &idLen); err != nil {
+		return nil, 0, err
+	}
+
+	pathID := make([]byte, idLen)
+	if _, err := io.ReadFull(r, pathID); err != nil {
+		return nil, 0, err
+	}
+
+	var expiry uint32
+	if err := binary.Read(r, binary.BigEndian, &expiry); err != nil {
+		return nil, 0, err
+	}
+
+	return pathID, expiry, nil
+}
@@ -0,0 +1,150 @@
+package onion
+
+import (
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testPathStore(t *testing.T, store PathStore) {
+	pathID1, err := NewPathID()
+	require.NoError(t, err)
+	pathID2, err := NewPathID()
+	require.NoError(t, err)
+
+	require.ErrorIs(t, VerifyPathID(store, pathID1), ErrUnknownPathID)
+	require.ErrorIs(t, VerifyPathID(store, nil), ErrUnknownPathID)
+
+	require.NoError(t, store.Add(pathID1, 100))
+	require.NoError(t, store.Add(pathID2, 200))
+	require.NoError(t, VerifyPathID(store, pathID1))
+	require.NoError(t, VerifyPathID(store, pathID2))
+
+	// Expiring removes only the paths below the height.
+	require.NoError(t, store.Expire(101))
+	require.ErrorIs(t, VerifyPathID(store, pathID1), ErrUnknownPathID)
+	require.NoError(t, VerifyPathID(store, pathID2))
+}
+
+func TestMemoryPathStore(t *testing.T) {
+	testPathStore(t, NewMemoryPathStore())
+}
+
+func TestFilePathStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paths")
+
+	store, err := OpenFilePathStore(path)
+	require.NoError(t, err)
+	testPathStore(t, store)
+
+	pathID, err := NewPathID()
+	require.NoError(t, err)
+	require.NoError(t, store.Add(pathID, 300))
+	require.NoError(t, store.Close())
+
+	// The store should survive being reopened.
+	store, err = OpenFilePathStore(path)
+	require.NoError(t, err)
+	require.NoError(t, VerifyPathID(store, pathID))
+
+	require.NoError(t, store.Expire(301))
+	require.NoError(t, store.Close())
+
+	store, err = OpenFilePathStore(path)
+	require.NoError(t, err)
+	require.ErrorIs(t, VerifyPathID(store, pathID), ErrUnknownPathID)
+	require.NoError(t, store.Close())
+}
+
+func TestFilePathStoreExpire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paths")
+
+	store, err := OpenFilePathStore(path)
+	require.NoError(t, err)
+
+	// Nothing is written if no path expires.
+	require.NoError(t, store.Expire(100))
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	pathID, err := NewPathID()
+	require.NoError(t, err)
+	require.NoError(t, store.Add(pathID, 100))
+
+	// If the file can't be written, the path is kept so that the store
+	// matches what is on disk.
+	require.NoError(t, os.Mkdir(path+".tmp", 0700))
+	require.Error(t, store.Expire(101))
+	require.NoError(t, VerifyPathID(store, pathID))
+
+	require.NoError(t, os.Remove(path+".tmp"))
+	require.NoError(t, store.Expire(101))
+	require.ErrorIs(t, VerifyPathID(store, pathID), ErrUnknownPathID)
+	require.NoError(t, store.Close())
+
+	store, err = OpenFilePathStore(path)
+	require.NoError(t, err)
+	require.ErrorIs(t, VerifyPathID(store, pathID), ErrUnknownPathID)
+	require.NoError(t, store.Close())
+}
+
+func TestPeelPathID(t *testing.T) {
+	pathID, err := NewPathID()
+	require.NoError(t, err)
+
+	dave := *Users[Dave]
+	dave.PathStore = NewMemoryPathStore()
+	require.NoError(t, dave.PathStore.Add(pathID, 1000))
+
+	// sendOverPath builds a blinded path from Charlie to Dave with the
+	// given options and has Alice send an onion over it.
+	sendOverPath := func(opts ...BlindedPathOption) *Onion {
+		pathKey, _ := btcec.NewPrivateKey()
+		bp, err := BuildBlindedPath(pathKey, []*HopData{
+			{PubKey: Users[Charlie].PubKey},
+			{PubKey: Users[Dave].PubKey},
+		}, opts...)
+		require.NoError(t, err)
+
+		sessionKey, _ := btcec.NewPrivateKey()
+		onion, _, err := BuildOnion(sessionKey, []*HopData{
+			{
+				PubKey:        bp.EntryNodeID,
+				EncryptedData: bp.EncryptedData[0],
+				EphemeralKey:  bp.FirstBlindingEphemeralKey,
+			},
+			{
+				PubKey:        bp.BlindedNodeIDs[0],
+				EncryptedData: bp.EncryptedData[1],
+			},
+		})
+		require.NoError(t, err)
+
+		_, onion, err = Peel(Users[Charlie], onion)
+		require.NoError(t, err)
+
+		return onion
+	}
+
+	payload, _, err := Peel(&dave, sendOverPath(WithPathID(pathID)))
+	require.NoError(t, err)
+	require.Equal(t, pathID, payload.PathID)
+
+	// Paths that Dave didn't issue are rejected.
+	forged, err := NewPathID()
+	require.NoError(t, err)
+
+	var blindingErr *FailInvalidOnionBlinding
+	_, _, err = Peel(&dave, sendOverPath(WithPathID(forged)))
+	require.ErrorAs(t, err, &blindingErr)
+
+	_, _, err = Peel(&dave, sendOverPath())
+	require.ErrorAs(t, err, &blindingErr)
+
+	// Without a store the path ID is only surfaced.
+	payload, _, err = Peel(Users[Dave], sendOverPath(WithPathID(forged)))
+	require.NoError(t, err)
+	require.Equal(t, forged, payload.PathID)
+}
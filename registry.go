@@ -0,0 +1,100 @@
+package onion
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"sort"
+	"strings"
+)
+
+// Registry is a set of known users that can be looked up by alias or by pub
+// key.
+type Registry struct {
+	// Users maps the upper case alias of each user to the user.
+	Users map[string]*User
+
+	// UserIndex maps the serialized pub key of each user to its alias.
+	UserIndex map[string]string
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		Users:     make(map[string]*User),
+		UserIndex: make(map[string]string),
+	}
+}
+
+// Add adds the user to the registry. The alias and the pub key of the user must
+// not already be in use.
+func (r *Registry) Add(user *User) error {
+	alias := strings.ToUpper(user.Name)
+	if _, ok := r.Users[alias]; ok {
+		return fmt.Errorf("user %s already exists", alias)
+	}
+
+	pubKey := string(user.PubKey.SerializeCompressed())
+	if existing, ok := r.UserIndex[pubKey]; ok {
+		return fmt.Errorf("pub key of %s is already used by %s", alias,
+			existing)
+	}
+
+	r.Users[alias] = user
+	r.UserIndex[pubKey] = alias
+
+	return nil
+}
+
+// Get returns the user with the given alias or hex encoded pub key. A pub key
+// that is not in the registry is returned as a user without a Signer so that
+// it can still be used as a hop in a route.
+func (r *Registry) Get(aliasOrPubKey string) (*User, error) {
+	if user, ok := r.Users[strings.ToUpper(aliasOrPubKey)]; ok {
+		return user, nil
+	}
+
+	b, err := hex.DecodeString(aliasOrPubKey)
+	if err != nil || len(b) != btcec.PubKeyBytesLenCompressed {
+		return nil, fmt.Errorf("no user named %s", aliasOrPubKey)
+	}
+
+	pubKey, err := btcec.ParsePubKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pub key %s: %w", aliasOrPubKey,
+			err)
+	}
+
+	if alias, ok := r.UserIndex[string(b)]; ok {
+		return r.Users[alias], nil
+	}
+
+	return &User{
+		Name:     hex.EncodeToString(b),
+		PubKey:   pubKey,
+		Channels: Channels,
+	}, nil
+}
+
+// Alias returns the alias of the user with the given pub key, or the hex
+// encoded pub key if it is not in the registry.
+func (r *Registry) Alias(pubKey *btcec.PublicKey) string {
+	b := pubKey.SerializeCompressed()
+	if alias, ok := r.UserIndex[string(b)]; ok {
+		return alias
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// Aliases returns the aliases of all the users in the registry in
+// alphabetical order.
+func (r *Registry) Aliases() []string {
+	aliases := make([]string, 0, len(r.Users))
+	for alias := range r.Users {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	return aliases
+}
@@ -0,0 +1,194 @@
+package onion
+
+import (
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+
+	priv, _ := btcec.NewPrivateKey()
+	frank := NewUser("frank", NewPrivKeySigner(priv))
+	require.NoError(t, registry.Add(frank))
+
+	// Neither the alias nor the pub key can be reused.
+	require.Error(t, registry.Add(NewUser("FRANK", Users[Bob].Signer)))
+	require.Error(t, registry.Add(NewUser("george", frank.Signer)))
+
+	// Users can be found by alias in any case or by pub key.
+	pubKeyHex := hex.EncodeToString(priv.PubKey().SerializeCompressed())
+	for _, name := range []string{"frank", "Frank", pubKeyHex} {
+		user, err := registry.Get(name)
+		require.NoError(t, err)
+		require.Equal(t, frank, user)
+	}
+	require.Equal(t, "FRANK", registry.Alias(priv.PubKey()))
+
+	// An unknown pub key can still be used as a hop.
+	other, _ := btcec.NewPrivateKey()
+	otherHex := hex.EncodeToString(other.PubKey().SerializeCompressed())
+	user, err := registry.Get(otherHex)
+	require.NoError(t, err)
+	require.True(t, user.PubKey.IsEqual(other.PubKey()))
+	require.Nil(t, user.Signer)
+	require.Equal(t, otherHex, registry.Alias(other.PubKey()))
+
+	_, err = registry.Get("george")
+	require.Error(t, err)
+
+	require.Equal(t, []string{"FRANK"}, registry.Aliases())
+
+	// The example users are in the default registry.
+	user, err = GetUser("bob")
+	require.NoError(t, err)
+	require.Equal(t, Users[Bob], user)
+}
+
+func TestKeystore(t *testing.T) {
+	dir := t.TempDir()
+	passphrase := []byte("hunter2")
+
+	frankKey, _ := btcec.NewPrivateKey()
+	_, err := WriteKeyFile(dir, "frank", frankKey, nil)
+	require.NoError(t, err)
+
+	georgeKey, _ := btcec.NewPrivateKey()
+	path, err := WriteKeyFile(dir, "George", georgeKey, passphrase)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "george.enckey"), path)
+
+	// Key files can't be overwritten or escape the keystore.
+	_, err = WriteKeyFile(dir, "frank", georgeKey, passphrase)
+	require.Error(t, err)
+	_, err = WriteKeyFile(dir, "../frank", frankKey, nil)
+	require.Error(t, err)
+
+	// The encrypted key can only be read with the right passphrase.
+	_, err = ReadKeyFile(path, nil)
+	require.ErrorIs(t, err, ErrPassphraseRequired)
+	_, err = ReadKeyFile(path, []byte("wrong"))
+	require.Error(t, err)
+
+	key, err := ReadKeyFile(path, passphrase)
+	require.NoError(t, err)
+	require.Equal(t, georgeKey.Serialize(), key.Serialize())
+
+	// Keys that are zero or not below the curve order are rejected
+	// rather than loaded as a different key.
+	for _, key := range []string{
+		strings.Repeat("00", 32),
+		"fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141",
+		strings.Repeat("ff", 32),
+	} {
+		badPath := filepath.Join(t.TempDir(), "bad.key")
+		require.NoError(t, os.WriteFile(badPath, []byte(key), 0600))
+		_, err = ReadKeyFile(badPath, nil)
+		require.Error(t, err)
+	}
+
+	// Other files in the keystore are ignored.
+	require.NoError(t, os.WriteFile(
+		filepath.Join(dir, "README"), []byte("hi"), 0600,
+	))
+
+	registry := NewRegistry()
+	require.ErrorIs(
+		t, registry.LoadKeystore(dir, nil), ErrPassphraseRequired,
+	)
+
+	registry = NewRegistry()
+	require.NoError(t, registry.LoadKeystore(dir, passphrase))
+	require.Equal(t, []string{"FRANK", "GEORGE"}, registry.Aliases())
+
+	frank, err := registry.Get("frank")
+	require.NoError(t, err)
+	require.True(t, frank.PubKey.IsEqual(frankKey.PubKey()))
+
+	// A missing keystore is empty.
+	registry = NewRegistry()
+	require.NoError(t, registry.LoadKeystore(
+		filepath.Join(dir, "missing"), nil,
+	))
+	require.Empty(t, registry.Aliases())
+}
+
+func TestPeelWithKeystoreUsers(t *testing.T) {
+	dir := t.TempDir()
+
+	registry := NewRegistry()
+	for _, alias := range []string{"frank", "george"} {
+		key, _ := btcec.NewPrivateKey()
+		_, err := WriteKeyFile(dir, alias, key, nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, registry.LoadKeystore(dir, nil))
+
+	frank, _ := registry.Get("frank")
+	george, _ := registry.Get("george")
+
+	sessionKey, _ := btcec.NewPrivateKey()
+	onion, _, err := BuildOnion(sessionKey, []*HopData{
+		{
+			PubKey:    frank.PubKey,
+			ClearData: []byte("Hi Frank"),
+		},
+		{
+			PubKey:    george.PubKey,
+			ClearData: []byte("Hi George"),
+		},
+	})
+	require.NoError(t, err)
+
+	payload, onion, err := Peel(frank, onion)
+	require.NoError(t, err)
+	require.True(t, payload.FwdTo.IsEqual(george.PubKey))
+
+	payload, _, err = Peel(george, onion)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hi George"), payload.Data.ClearData)
+}
+
+func TestPeelWithoutSigner(t *testing.T) {
+	// A user that is only known by its pub key can't process onions.
+	key, _ := btcec.NewPrivateKey()
+	user, err := NewRegistry().Get(
+		hex.EncodeToString(key.PubKey().SerializeCompressed()),
+	)
+	require.NoError(t, err)
+
+	sessionKey, _ := btcec.NewPrivateKey()
+	onion, _, err := BuildOnion(sessionKey, []*HopData{
+		{
+			PubKey:    user.PubKey,
+			ClearData: []byte("Hi"),
+		},
+	})
+	require.NoError(t, err)
+
+	_, _, err = Peel(user, onion)
+	require.ErrorIs(t, err, ErrNoSigner)
+
+	pathKey, _ := btcec.NewPrivateKey()
+	onion, err = BuildOnionMessage(
+		sessionKey, pathKey, []*btcec.PublicKey{user.PubKey}, nil,
+	)
+	require.NoError(t, err)
+
+	_, _, err = PeelMessage(user, onion)
+	require.ErrorIs(t, err, ErrNoSigner)
+
+	path, err := BuildBlindedPath(sessionKey, []*HopData{
+		{PubKey: user.PubKey},
+		{PubKey: Users[Bob].PubKey},
+	})
+	require.NoError(t, err)
+
+	_, _, err = AdvanceBlindedPath(user, path, 1000, 100)
+	require.ErrorIs(t, err, ErrNoSigner)
+}
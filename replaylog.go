@@ -0,0 +1,581 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrReplayedPacket is returned by Peel if the shared secret of the onion has
+// been seen before.
+var ErrReplayedPacket = errors.New("onion packet has been replayed")
+
+// ErrNoExpiry is returned when an entry without an expiry is added to a replay
+// log. The entry would be removed by the next call to Expire, after which a
+// replay of the onion would go unnoticed.
+var ErrNoExpiry = errors.New("replay log entry has no expiry")
+
+// HashPrefix is the truncated hash of a shared secret that is stored in the
+// replay log.
+type HashPrefix [20]byte
+
+// hashSharedSecret returns the hash that the given shared secret is stored
+// under in the replay log.
+func hashSharedSecret(ss [32]byte) HashPrefix {
+	var hash HashPrefix
+	h := sha256.Sum256(ss[:])
+	copy(hash[:], h[:])
+
+	return hash
+}
+
+// ReplayLog keeps track of the shared secrets of the onions that a node has
+// processed so that it can detect replayed onions.
+type ReplayLog interface {
+	// Put adds the hash to the log along with the CLTV expiry of the HTLC
+	// that carried the onion, which must not be zero. ErrReplayedPacket is
+	// returned if the hash is already in the log.
+	Put(hash HashPrefix, expiry uint32) error
+
+	// PutBatch atomically adds all the entries of the batch to the log and
+	// returns the set of sequence numbers in the batch that are replays.
+	// None of the entries may have a zero expiry.
+	// Committing a batch with the same ID again returns the same replay
+	// set without changing the log.
+	PutBatch(batch *Batch) (*ReplaySet, error)
+
+	// Expire removes all entries with an expiry below the given height
+	// since HTLCs with these onions can no longer be settled. The replay
+	// sets of batches whose entries have all expired are removed too.
+	Expire(height uint32) error
+
+	// Close releases any resources held by the log.
+	Close() error
+}
+
+// ReplaySet is the set of sequence numbers in a batch that are replays.
+type ReplaySet struct {
+	replays map[uint16]struct{}
+}
+
+// NewReplaySet creates an empty ReplaySet.
+func NewReplaySet() *ReplaySet {
+	return &ReplaySet{
+		replays: make(map[uint16]struct{}),
+	}
+}
+
+// Add marks the given sequence number as a replay.
+func (r *ReplaySet) Add(seqNum uint16) {
+	r.replays[seqNum] = struct{}{}
+}
+
+// Contains returns true if the given sequence number is a replay.
+func (r *ReplaySet) Contains(seqNum uint16) bool {
+	_, ok := r.replays[seqNum]
+	return ok
+}
+
+// Size returns the number of replays in the set.
+func (r *ReplaySet) Size() int {
+	return len(r.replays)
+}
+
+// batchEntry is a single entry of a Batch.
+type batchEntry struct {
+	seqNum uint16
+	hash   HashPrefix
+	expiry uint32
+}
+
+// Batch is a set of replay log entries that are committed together.
+type Batch struct {
+	// ID identifies the batch so that committing it again is idempotent.
+	ID []byte
+
+	entries []batchEntry
+}
+
+// NewBatch creates an empty batch with the given ID.
+func NewBatch(id []byte) *Batch {
+	return &Batch{
+		ID: id,
+	}
+}
+
+// Put adds an entry to the batch. The sequence number identifies the entry in
+// the ReplaySet returned when the batch is committed.
+func (b *Batch) Put(seqNum uint16, hash HashPrefix, expiry uint32) {
+	b.entries = append(b.entries, batchEntry{
+		seqNum: seqNum,
+		hash:   hash,
+		expiry: expiry,
+	})
+}
+
+// validate checks that every entry of the batch has an expiry.
+func (b *Batch) validate() error {
+	for _, entry := range b.entries {
+		if entry.expiry == 0 {
+			return fmt.Errorf("entry %d: %w", entry.seqNum,
+				ErrNoExpiry)
+		}
+	}
+
+	return nil
+}
+
+// expiry returns the highest expiry of the entries in the batch.
+func (b *Batch) expiry() uint32 {
+	var expiry uint32
+	for _, entry := range b.entries {
+		if entry.expiry > expiry {
+			expiry = entry.expiry
+		}
+	}
+
+	return expiry
+}
+
+// committedBatch is the result of a batch that has been committed to the log.
+type committedBatch struct {
+	replays *ReplaySet
+
+	// expiry is the highest expiry of the entries in the batch. The batch
+	// is expired along with its entries.
+	expiry uint32
+}
+
+// MemoryReplayLog is a ReplayLog that is kept in memory.
+type MemoryReplayLog struct {
+	mu      sync.Mutex
+	entries map[HashPrefix]uint32
+	batches map[string]*committedBatch
+}
+
+// NewMemoryReplayLog creates an empty MemoryReplayLog.
+func NewMemoryReplayLog() *MemoryReplayLog {
+	return &MemoryReplayLog{
+		entries: make(map[HashPrefix]uint32),
+		batches: make(map[string]*committedBatch),
+	}
+}
+
+// Put adds the hash to the log.
+//
+// NOTE: This is part of the ReplayLog interface.
+func (m *MemoryReplayLog) Put(hash HashPrefix, expiry uint32) error {
+	if expiry == 0 {
+		return ErrNoExpiry
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.entries[hash]; ok {
+		return ErrReplayedPacket
+	}
+
+	m.entries[hash] = expiry
+
+	return nil
+}
+
+// PutBatch atomically adds the entries of the batch to the log.
+//
+// NOTE: This is part of the ReplayLog interface.
+func (m *MemoryReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	if err := batch.validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	replays, _ := m.applyBatch(batch)
+
+	return replays, nil
+}
+
+// applyBatch adds the entries of the batch to the log and returns the replays
+// along with the entries that were added. If the batch has been committed
+// before, no entries are added. The caller must hold the lock.
+func (m *MemoryReplayLog) applyBatch(batch *Batch) (*ReplaySet, []batchEntry) {
+	if committed, ok := m.batches[string(batch.ID)]; ok {
+		return committed.replays, nil
+	}
+
+	replays := NewReplaySet()
+	var added []batchEntry
+	for _, entry := range batch.entries {
+		if _, ok := m.entries[entry.hash]; ok {
+			replays.Add(entry.seqNum)
+			continue
+		}
+
+		m.entries[entry.hash] = entry.expiry
+		added = append(added, entry)
+	}
+
+	if len(batch.ID) != 0 {
+		m.batches[string(batch.ID)] = &committedBatch{
+			replays: replays,
+			expiry:  batch.expiry(),
+		}
+	}
+
+	return replays, added
+}
+
+// Expire removes all entries with an expiry below the given height along with
+// the batches that they were committed in.
+//
+// NOTE: This is part of the ReplayLog interface.
+func (m *MemoryReplayLog) Expire(height uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expire(height)
+
+	return nil
+}
+
+// expire removes all entries and batches with an expiry below the given
+// height. The number of entries and batches that were removed is returned.
+// The caller must hold the lock.
+func (m *MemoryReplayLog) expire(height uint32) int {
+	var removed int
+	for hash, expiry := range m.entries {
+		if expiry < height {
+			delete(m.entries, hash)
+			removed++
+		}
+	}
+
+	for id, committed := range m.batches {
+		if committed.expiry < height {
+			delete(m.batches, id)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Close is a no-op for the in-memory log.
+//
+// NOTE: This is part of the ReplayLog interface.
+func (m *MemoryReplayLog) Close() error {
+	return nil
+}
+
+// FileReplayLog is a ReplayLog that is persisted to a file so that it survives
+// restarts. Every commit is appended to the file as a single record so that a
+// partially written commit is ignored when the log is loaded again.
+type FileReplayLog struct {
+	mem  *MemoryReplayLog
+	path string
+	file *os.File
+}
+
+// OpenFileReplayLog opens the replay log stored at the given path, creating it
+// if it does not exist yet.
+func OpenFileReplayLog(path string) (*FileReplayLog, error) {
+	mem := NewMemoryReplayLog()
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Keep track of where the last complete record ends.
+	var end int64
+	r := bytes.NewReader(b)
+	for r.Len() > 0 {
+		batch, expiry, replays, err := readRecord(r)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// The last commit was not completely written so it
+			// never happened.
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read replay log "+
+				"%s: %w", path, err)
+		}
+
+		for _, entry := range batch.entries {
+			mem.entries[entry.hash] = entry.expiry
+		}
+		if len(batch.ID) != 0 {
+			mem.batches[string(batch.ID)] = &committedBatch{
+				replays: replays,
+				expiry:  expiry,
+			}
+		}
+
+		end = int64(len(b) - r.Len())
+	}
+
+	// Drop any partially written record so that new records are appended
+	// after the last complete one.
+	if err := truncateFile(path, end); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileReplayLog{
+		mem:  mem,
+		path: path,
+		file: file,
+	}, nil
+}
+
+// truncateFile truncates the file at the given path if it exists.
+func truncateFile(path string, size int64) error {
+	err := os.Truncate(path, size)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Put adds the hash to the log.
+//
+// NOTE: This is part of the ReplayLog interface.
+func (f *FileReplayLog) Put(hash HashPrefix, expiry uint32) error {
+	batch := NewBatch(nil)
+	batch.Put(0, hash, expiry)
+
+	replays, err := f.PutBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	if replays.Contains(0) {
+		return ErrReplayedPacket
+	}
+
+	return nil
+}
+
+// PutBatch atomically adds the entries of the batch to the log.
+//
+// NOTE: This is part of the ReplayLog interface.
+func (f *FileReplayLog) PutBatch(batch *Batch) (*ReplaySet, error) {
+	if err := batch.validate(); err != nil {
+		return nil, err
+	}
+
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+
+	if committed, ok := f.mem.batches[string(batch.ID)]; ok {
+		return committed.replays, nil
+	}
+
+	replays, added := f.mem.applyBatch(batch)
+
+	var record bytes.Buffer
+	writeRecord(
+		&record, &Batch{ID: batch.ID, entries: added}, batch.expiry(),
+		replays,
+	)
+	_, err := f.file.Write(record.Bytes())
+	if err == nil {
+		err = f.file.Sync()
+	}
+	if err != nil {
+		// Undo the batch so that the log matches what is on disk.
+		for _, entry := range added {
+			delete(f.mem.entries, entry.hash)
+		}
+		delete(f.mem.batches, string(batch.ID))
+
+		return nil, err
+	}
+
+	return replays, nil
+}
+
+// Expire removes all entries with an expiry below the given height. If any
+// were removed, the file is rewritten with the remaining entries.
+//
+// NOTE: This is part of the ReplayLog interface.
+func (f *FileReplayLog) Expire(height uint32) error {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+
+	if f.mem.expire(height) == 0 {
+		return nil
+	}
+
+	// Write the remaining entries along with the replay sets of the
+	// committed batches to a new file and then swap it in.
+	var b bytes.Buffer
+	remaining := NewBatch(nil)
+	for hash, expiry := range f.mem.entries {
+		remaining.Put(0, hash, expiry)
+	}
+	writeRecord(&b, remaining, 0, NewReplaySet())
+
+	for id, committed := range f.mem.batches {
+		writeRecord(
+			&b, NewBatch([]byte(id)), committed.expiry,
+			committed.replays,
+		)
+	}
+
+	tmpPath := f.path + ".tmp"
+	if err := os.WriteFile(tmpPath, b.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	f.file = file
+
+	return nil
+}
+
+// Close closes the underlying file.
+//
+// NOTE: This is part of the ReplayLog interface.
+func (f *FileReplayLog) Close() error {
+	return f.file.Close()
+}
+
+// writeRecord serialises a committed batch as:
+//   - 4 byte record length
+//   - 2 byte batch ID length followed by the batch ID
+//   - 4 byte expiry of the batch
+//   - 4 byte number of entries followed by the entries as 20 byte hash and 4
+//     byte expiry
+//   - 4 byte number of replays followed by their 2 byte sequence numbers
+func writeRecord(w *bytes.Buffer, batch *Batch, expiry uint32,
+	replays *ReplaySet) {
+
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.BigEndian, uint16(len(batch.ID)))
+	b.Write(batch.ID)
+
+	_ = binary.Write(&b, binary.BigEndian, expiry)
+
+	_ = binary.Write(&b, binary.BigEndian, uint32(len(batch.entries)))
+	for _, entry := range batch.entries {
+		b.Write(entry.hash[:])
+		_ = binary.Write(&b, binary.BigEndian, entry.expiry)
+	}
+
+	_ = binary.Write(&b, binary.BigEndian, uint32(replays.Size()))
+	for seqNum := range replays.replays {
+		_ = binary.Write(&b, binary.BigEndian, seqNum)
+	}
+
+	_ = binary.Write(w, binary.BigEndian, uint32(b.Len()))
+	w.Write(b.Bytes())
+}
+
+// readRecord reads a record written by writeRecord. io.ErrUnexpectedEOF is
+// returned if the record is incomplete.
+func readRecord(r io.Reader) (*Batch, uint32, *ReplaySet, error) {
+	var recordLen uint32
+	if err := binary.Read(r, binary.BigEndian, &recordLen); err != nil {
+		return nil, 0, nil, io.ErrUnexpectedEOF
+	}
+
+	record := make([]byte, recordLen)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, 0, nil, io.ErrUnexpectedEOF
+	}
+
+	batch, expiry, replays, err := parseRecord(bytes.NewReader(record))
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("invalid record: %v", err)
+	}
+
+	return batch, expiry, replays, nil
+}
+
+// parseRecord parses the contents of a record written by writeRecord.
+func parseRecord(rr *bytes.Reader) (*Batch, uint32, *ReplaySet, error) {
+	var idLen uint16
+	if err := binary.Read(rr, binary.BigEndian, &idLen); err != nil {
+		return nil, 0, nil, err
+	}
+
+	batch := NewBatch(nil)
+	if idLen != 0 {
+		batch.ID = make([]byte, idLen)
+		if _, err := io.ReadFull(rr, batch.ID); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+
+	var expiry uint32
+	if err := binary.Read(rr, binary.BigEndian, &expiry); err != nil {
+		return nil, 0, nil, err
+	}
+
+	var numEntries uint32
+	if err := binary.Read(rr, binary.BigEndian, &numEntries); err != nil {
+		return nil, 0, nil, err
+	}
+
+	// Each entry takes 24 bytes, so a count that doesn't fit in the rest
+	// of the record is invalid.
+	if int64(numEntries)*24 > int64(rr.Len()) {
+		return nil, 0, nil, io.ErrUnexpectedEOF
+	}
+
+	batch.entries = make([]batchEntry, 0, numEntries)
+	for i := uint32(0); i < numEntries; i++ {
+		var entry batchEntry
+		if _, err := io.ReadFull(rr, entry.hash[:]); err != nil {
+			return nil, 0, nil, err
+		}
+		err := binary.Read(rr, binary.BigEndian, &entry.expiry)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		batch.entries = append(batch.entries, entry)
+	}
+
+	var numReplays uint32
+	if err := binary.Read(rr, binary.BigEndian, &numReplays); err != nil {
+		return nil, 0, nil, err
+	}
+
+	replays := NewReplaySet()
+	for i := uint32(0); i < numReplays; i++ {
+		var seqNum uint16
+		err := binary.Read(rr, binary.BigEndian, &seqNum)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		replays.Add(seqNum)
+	}
+
+	return batch, expiry, replays, nil
+}
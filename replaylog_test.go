@@ -0,0 +1,231 @@
+package onion
+
+import (
+	"encoding/binary"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testReplayLog(t *testing.T, log ReplayLog) {
+	hash1 := HashPrefix{1}
+	hash2 := HashPrefix{2}
+	hash3 := HashPrefix{3}
+
+	require.NoError(t, log.Put(hash1, 100))
+	require.ErrorIs(t, log.Put(hash1, 100), ErrReplayedPacket)
+
+	// Both an entry that is already in the log and a duplicate within the
+	// batch are replays.
+	batch := NewBatch([]byte("batch"))
+	batch.Put(0, hash1, 100)
+	batch.Put(1, hash2, 200)
+	batch.Put(2, hash2, 200)
+	batch.Put(3, hash3, 300)
+
+	replays, err := log.PutBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, 2, replays.Size())
+	require.True(t, replays.Contains(0))
+	require.True(t, replays.Contains(2))
+
+	// Committing the batch again gives the same result.
+	replays, err = log.PutBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, 2, replays.Size())
+	require.False(t, replays.Contains(1))
+
+	require.ErrorIs(t, log.Put(hash2, 200), ErrReplayedPacket)
+	require.ErrorIs(t, log.Put(hash3, 300), ErrReplayedPacket)
+
+	// Expiring removes only the entries below the height.
+	require.NoError(t, log.Expire(201))
+	require.NoError(t, log.Put(hash1, 100))
+	require.NoError(t, log.Put(hash2, 200))
+	require.ErrorIs(t, log.Put(hash3, 300), ErrReplayedPacket)
+
+	// Entries without an expiry would be removed by the next Expire, so
+	// they are rejected.
+	hash9 := HashPrefix{9}
+	require.ErrorIs(t, log.Put(hash9, 0), ErrNoExpiry)
+
+	batch = NewBatch([]byte("no expiry"))
+	batch.Put(0, hash9, 300)
+	batch.Put(1, HashPrefix{10}, 0)
+	_, err = log.PutBatch(batch)
+	require.ErrorIs(t, err, ErrNoExpiry)
+	require.NoError(t, log.Put(hash9, 300))
+}
+
+func TestMemoryReplayLog(t *testing.T) {
+	testReplayLog(t, NewMemoryReplayLog())
+}
+
+func TestFileReplayLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.log")
+
+	log, err := OpenFileReplayLog(path)
+	require.NoError(t, err)
+	testReplayLog(t, log)
+	require.NoError(t, log.Close())
+
+	// The log should survive being reopened.
+	log, err = OpenFileReplayLog(path)
+	require.NoError(t, err)
+	require.ErrorIs(t, log.Put(HashPrefix{1}, 100), ErrReplayedPacket)
+	require.ErrorIs(t, log.Put(HashPrefix{3}, 300), ErrReplayedPacket)
+
+	batch := NewBatch([]byte("batch"))
+	replays, err := log.PutBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, 2, replays.Size())
+
+	require.NoError(t, log.Put(HashPrefix{4}, 400))
+	require.NoError(t, log.Close())
+
+	// A partially written record is ignored and dropped.
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b[:len(b)-1], 0600))
+
+	log, err = OpenFileReplayLog(path)
+	require.NoError(t, err)
+	require.NoError(t, log.Put(HashPrefix{4}, 400))
+	require.NoError(t, log.Close())
+
+	log, err = OpenFileReplayLog(path)
+	require.NoError(t, err)
+	require.ErrorIs(t, log.Put(HashPrefix{4}, 400), ErrReplayedPacket)
+	require.NoError(t, log.Close())
+}
+
+func TestReplayLogExpireBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.log")
+	fileLog, err := OpenFileReplayLog(path)
+	require.NoError(t, err)
+	defer fileLog.Close()
+
+	for _, log := range []ReplayLog{NewMemoryReplayLog(), fileLog} {
+		batch := NewBatch([]byte("batch"))
+		batch.Put(0, HashPrefix{1}, 100)
+		batch.Put(1, HashPrefix{1}, 100)
+		batch.Put(2, HashPrefix{2}, 200)
+
+		replays, err := log.PutBatch(batch)
+		require.NoError(t, err)
+		require.Equal(t, 1, replays.Size())
+
+		// The batch is kept as long as one of its entries is.
+		require.NoError(t, log.Expire(101))
+		replays, err = log.PutBatch(batch)
+		require.NoError(t, err)
+		require.Equal(t, 1, replays.Size())
+
+		// Once all of its entries have expired, the batch is
+		// committed again as a new one.
+		require.NoError(t, log.Expire(201))
+		require.NoError(t, log.Put(HashPrefix{2}, 200))
+		replays, err = log.PutBatch(batch)
+		require.NoError(t, err)
+		require.Equal(t, 2, replays.Size())
+		require.True(t, replays.Contains(2))
+	}
+}
+
+func TestFileReplayLogManyEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.log")
+
+	log, err := OpenFileReplayLog(path)
+	require.NoError(t, err)
+
+	// More entries than fit in a 2 byte count.
+	const numEntries = 70000
+	batch := NewBatch([]byte("batch"))
+	for i := 0; i < numEntries; i++ {
+		var hash HashPrefix
+		binary.BigEndian.PutUint32(hash[:], uint32(i))
+		batch.Put(0, hash, 200)
+	}
+	batch.Put(1, HashPrefix{0xff}, 100)
+
+	_, err = log.PutBatch(batch)
+	require.NoError(t, err)
+
+	// Expiring rewrites all remaining entries as a single record.
+	require.NoError(t, log.Expire(101))
+	require.NoError(t, log.Close())
+
+	log, err = OpenFileReplayLog(path)
+	require.NoError(t, err)
+	defer log.Close()
+
+	var last HashPrefix
+	binary.BigEndian.PutUint32(last[:], numEntries-1)
+	require.ErrorIs(t, log.Put(HashPrefix{}, 200), ErrReplayedPacket)
+	require.ErrorIs(t, log.Put(last, 200), ErrReplayedPacket)
+	require.NoError(t, log.Put(HashPrefix{0xff}, 100))
+}
+
+func TestPeelReplay(t *testing.T) {
+	sessionKey, _ := btcec.NewPrivateKey()
+
+	hopsData := []*HopData{
+		{
+			PubKey:    Users[Bob].PubKey,
+			ClearData: []byte("Hi Bob"),
+		},
+		{
+			PubKey:    Users[Charlie].PubKey,
+			ClearData: []byte("Hi Charlie"),
+		},
+	}
+
+	bob := *Users[Bob]
+	bob.ReplayLog = NewMemoryReplayLog()
+
+	onion, _, err := BuildOnion(sessionKey, hopsData)
+	require.NoError(t, err)
+
+	// The onion can only be added to the log with the expiry of the HTLC
+	// that carried it.
+	_, next, err := Peel(&bob, onion)
+	require.ErrorIs(t, err, ErrNoExpiry)
+	require.Nil(t, next)
+
+	onion.IncomingCLTV = 100
+	_, next, err = Peel(&bob, onion)
+	require.NoError(t, err)
+	require.NotNil(t, next)
+
+	payload, next, err := Peel(&bob, onion)
+	require.ErrorIs(t, err, ErrReplayedPacket)
+	require.Nil(t, next)
+	require.NotNil(t, payload)
+
+	// Peel a batch containing the replayed onion, a new onion and a
+	// duplicate of the new onion.
+	sessionKey2, _ := btcec.NewPrivateKey()
+	onion2, _, err := BuildOnion(sessionKey2, hopsData)
+	require.NoError(t, err)
+	onion2.IncomingCLTV = 100
+
+	results, err := PeelBatch(
+		&bob, []byte("batch"), []*Onion{onion, onion2, onion2},
+	)
+	require.NoError(t, err)
+	require.ErrorIs(t, results[0].Err, ErrReplayedPacket)
+	require.NoError(t, results[1].Err)
+	require.NotNil(t, results[1].Next)
+	require.ErrorIs(t, results[2].Err, ErrReplayedPacket)
+
+	// Peeling the same batch again gives the same result.
+	results, err = PeelBatch(
+		&bob, []byte("batch"), []*Onion{onion, onion2, onion2},
+	)
+	require.NoError(t, err)
+	require.ErrorIs(t, results[0].Err, ErrReplayedPacket)
+	require.NoError(t, results[1].Err)
+	require.ErrorIs(t, results[2].Err, ErrReplayedPacket)
+}
@@ -0,0 +1,382 @@
+package onion
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"strings"
+)
+
+// Scenario describes an onion that a test vector can be generated for. Node
+// keys and session keys that are not given are derived from the seed.
+type Scenario struct {
+	Comment string `json:"comment,omitempty"`
+
+	// Seed is the hex encoded seed that missing keys are derived from.
+	Seed string `json:"seed,omitempty"`
+
+	// SessionKey is the hex encoded session key of the sender. If it is
+	// not set, the session key with index 0 is derived from the seed.
+	SessionKey string `json:"session_key,omitempty"`
+
+	// AssociatedData is the hex encoded data that is covered by the HMAC
+	// of each hop.
+	AssociatedData string `json:"associated_data,omitempty"`
+
+	// PacketSize is the size of the hop payloads of the onion. If it is
+	// not set, the onion has the PaymentPacketSize.
+	PacketSize int `json:"packet_size,omitempty"`
+
+	// Nodes are the nodes that the hops refer to.
+	Nodes []*ScenarioNode `json:"nodes"`
+
+	// Hops are the clear text hops of the route. If there is a blinded
+	// path, these are the hops before its introduction node.
+	Hops []*ScenarioHop `json:"hops"`
+
+	// BlindedPath is an optional blinded path at the end of the route.
+	BlindedPath *ScenarioBlindedPath `json:"blinded_path,omitempty"`
+}
+
+// ScenarioNode is a node in a Scenario.
+type ScenarioNode struct {
+	Alias string `json:"alias"`
+
+	// PrivKey is the hex encoded private key of the node. If it is not
+	// set, the node key with the index of the node is derived from the
+	// seed.
+	PrivKey string `json:"privkey,omitempty"`
+}
+
+// ScenarioHop is a hop in a Scenario.
+type ScenarioHop struct {
+	// Node is the alias of the hop's node.
+	Node string `json:"node"`
+
+	// Payload is the message from the sender to the hop.
+	Payload string `json:"payload,omitempty"`
+
+	// AmtToForward and OutgoingCLTV are the optional payment fields of
+	// the hop's payload.
+	AmtToForward uint64 `json:"amt_to_forward,omitempty"`
+	OutgoingCLTV uint32 `json:"outgoing_cltv_value,omitempty"`
+
+	// RecipientData is the message from the recipient to a hop in the
+	// blinded path.
+	RecipientData string `json:"recipient_data,omitempty"`
+}
+
+// ScenarioBlindedPath is the blinded path in a Scenario.
+type ScenarioBlindedPath struct {
+	// SessionKey is the hex encoded session key that the recipient uses
+	// to build the blinded path. If it is not set, the session key with
+	// index 1 is derived from the seed.
+	SessionKey string `json:"session_key,omitempty"`
+
+	// Hops are the hops of the blinded path, starting with the
+	// introduction node.
+	Hops []*ScenarioHop `json:"hops"`
+}
+
+// ParseScenario parses a JSON scenario.
+func ParseScenario(b []byte) (*Scenario, error) {
+	var s Scenario
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("invalid scenario: %w", err)
+	}
+
+	return &s, nil
+}
+
+// scenarioNode is a node in a Scenario along with its key.
+type scenarioNode struct {
+	alias   string
+	privKey *btcec.PrivateKey
+}
+
+// GenerateTestVector builds the onion for the scenario and returns a test
+// vector with every intermediate value. The test vector has the same format
+// as the BOLT 4 onion test vectors, or the blinded onion test vectors if the
+// scenario has a blinded path, so that it can be checked with Verify.
+func (s *Scenario) GenerateTestVector() (*TestVector, error) {
+	pos := vectorPos{section: "scenario", hop: -1}
+
+	var deriver *SeedDeriver
+	if s.Seed != "" {
+		seed, err := pos.bytes("seed", s.Seed)
+		if err != nil {
+			return nil, err
+		}
+
+		deriver, err = NewSeedDeriver(seed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// deriveKey returns the given key or derives it from the seed.
+	deriveKey := func(pos vectorPos, field, key string,
+		derive func(*SeedDeriver) *btcec.PrivateKey) (*btcec.PrivateKey,
+		error) {
+
+		if key != "" {
+			return pos.privKey(field, key)
+		}
+
+		if deriver == nil {
+			return nil, fmt.Errorf("%v: %s or seed required", pos,
+				field)
+		}
+
+		return derive(deriver), nil
+	}
+
+	nodes := make(map[string]*scenarioNode, len(s.Nodes))
+	for i, node := range s.Nodes {
+		i := uint32(i)
+		privKey, err := deriveKey(
+			vectorPos{section: "nodes", hop: int(i)}, "privkey",
+			node.PrivKey, func(d *SeedDeriver) *btcec.PrivateKey {
+				return d.NodeKey(i)
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		alias := strings.ToLower(node.Alias)
+		if _, ok := nodes[alias]; ok {
+			return nil, fmt.Errorf("duplicate node %s", node.Alias)
+		}
+
+		nodes[alias] = &scenarioNode{
+			alias:   node.Alias,
+			privKey: privKey,
+		}
+	}
+
+	findNode := func(hop *ScenarioHop) (*scenarioNode, error) {
+		node, ok := nodes[strings.ToLower(hop.Node)]
+		if !ok {
+			return nil, fmt.Errorf("unknown node %s", hop.Node)
+		}
+
+		return node, nil
+	}
+
+	sessionKey, err := deriveKey(
+		pos, "session_key", s.SessionKey,
+		func(d *SeedDeriver) *btcec.PrivateKey {
+			return d.SessionKey(0)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ad, err := pos.bytes("associated_data", s.AssociatedData)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		route    []*scenarioNode
+		hopsData []*HopData
+	)
+	for _, hop := range s.Hops {
+		node, err := findNode(hop)
+		if err != nil {
+			return nil, err
+		}
+
+		route = append(route, node)
+		hopsData = append(hopsData, &HopData{
+			PubKey:       node.privKey.PubKey(),
+			ClearData:    []byte(hop.Payload),
+			AmtToForward: hop.AmtToForward,
+			OutgoingCLTV: hop.OutgoingCLTV,
+		})
+	}
+
+	// The recipient builds the blinded path and the sender then adds
+	// its hops to the route.
+	var (
+		blindedPath *BlindedPath
+		blindedHops []*Hop
+	)
+	if s.BlindedPath != nil {
+		blindedSessionKey, err := deriveKey(
+			vectorPos{section: "blinded_path", hop: -1},
+			"session_key", s.BlindedPath.SessionKey,
+			func(d *SeedDeriver) *btcec.PrivateKey {
+				return d.SessionKey(1)
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		pathData := make([]*HopData, len(s.BlindedPath.Hops))
+		pubKeys := make([]*btcec.PublicKey, len(s.BlindedPath.Hops))
+		for i, hop := range s.BlindedPath.Hops {
+			node, err := findNode(hop)
+			if err != nil {
+				return nil, err
+			}
+
+			route = append(route, node)
+			pubKeys[i] = node.privKey.PubKey()
+			pathData[i] = &HopData{
+				PubKey:    pubKeys[i],
+				ClearData: []byte(hop.RecipientData),
+			}
+		}
+
+		blindedPath, err = BuildBlindedPath(blindedSessionKey, pathData)
+		if err != nil {
+			return nil, err
+		}
+		blindedHops = DeriveHops(blindedSessionKey, pubKeys)
+
+		for i, hop := range s.BlindedPath.Hops {
+			hopData := &HopData{
+				PubKey:        blindedPath.EntryNodeID,
+				ClearData:     []byte(hop.Payload),
+				AmtToForward:  hop.AmtToForward,
+				OutgoingCLTV:  hop.OutgoingCLTV,
+				EncryptedData: blindedPath.EncryptedData[i],
+				EphemeralKey:  blindedPath.FirstBlindingEphemeralKey,
+			}
+			if i > 0 {
+				hopData.PubKey = blindedPath.BlindedNodeIDs[i-1]
+				hopData.EphemeralKey = nil
+			}
+
+			hopsData = append(hopsData, hopData)
+		}
+	}
+
+	if len(hopsData) == 0 {
+		return nil, fmt.Errorf("scenario has no hops")
+	}
+
+	packetSize := s.PacketSize
+	if packetSize == 0 {
+		packetSize = PaymentPacketSize
+	}
+
+	onion, hops, err := BuildOnion(
+		sessionKey, hopsData, WithAssociatedData(ad),
+		WithPacketSize(packetSize),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	vectorHops := make([]*vectorHop, len(hops))
+	decode := make([]string, len(hops))
+	next := onion
+	for i, hop := range hops {
+		vectorHops[i] = &vectorHop{
+			Alias:  route[i].alias,
+			PubKey: hexKey(hop.P),
+			Payload: hex.EncodeToString(
+				payloadFrame(hop.Payload),
+			),
+			EphemeralPrivKey: hex.EncodeToString(hop.E.Serialize()),
+			EphemeralPubKey:  hexKey(hop.E.PubKey()),
+			SharedSecret:     hex.EncodeToString(hop.SS[:]),
+			Rho:              hex.EncodeToString(hop.Rho[:]),
+			Mu:               hex.EncodeToString(hop.Mu[:]),
+			Um:               hex.EncodeToString(hop.Um[:]),
+			Pad:              hex.EncodeToString(hop.Pad[:]),
+			BlindingFactor:   hex.EncodeToString(hop.BF[:]),
+			Onion:            hex.EncodeToString(next.Serialize()),
+			HMAC:             hex.EncodeToString(next.HMAC[:]),
+		}
+		decode[i] = hex.EncodeToString(route[i].privKey.Serialize())
+
+		_, next, err = unwrapPacket(hop.SS, hop.E.PubKey(), next)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	gen := &vectorSection{
+		SessionKey:     hex.EncodeToString(sessionKey.Serialize()),
+		AssociatedData: hex.EncodeToString(ad),
+		Filler:         hex.EncodeToString(genFiller(hops, packetSize)),
+	}
+
+	if blindedPath == nil {
+		gen.Hops = vectorHops
+
+		return &TestVector{
+			Comment:  s.Comment,
+			Generate: gen,
+			Onion:    hex.EncodeToString(onion.Serialize()),
+			Decode:   decode,
+		}, nil
+	}
+
+	// The hops in the blinded path are given the next blinding point
+	// along with the onion.
+	numClear := len(s.Hops)
+	decrypt := make([]*vectorHop, len(hops))
+	for i, hop := range vectorHops {
+		decrypt[i] = &vectorHop{
+			Alias:       hop.Alias,
+			Onion:       hop.Onion,
+			NodePrivKey: decode[i],
+		}
+
+		if i >= numClear {
+			blindedHop := blindedHops[i-numClear]
+			decrypt[i].NextBlinding = hexKey(
+				blindPub(blindedHop.BF, blindedHop.E.PubKey()),
+			)
+		}
+	}
+
+	pathHops := make([]*vectorHop, len(blindedHops))
+	for i, hop := range blindedHops {
+		bf := genKey(hop.SS, blindedNodeIDType)
+		pathHops[i] = &vectorHop{
+			Alias:            route[numClear+i].alias,
+			NodeID:           hexKey(hop.P),
+			EphemeralPrivKey: hex.EncodeToString(hop.E.Serialize()),
+			EphemeralPubKey:  hexKey(hop.E.PubKey()),
+			SharedSecret:     hex.EncodeToString(hop.SS[:]),
+			Rho:              hex.EncodeToString(hop.Rho[:]),
+			BlindingFactor:   hex.EncodeToString(hop.BF[:]),
+			BlindedNodeID:    hexKey(blindPub(bf, hop.P)),
+			EncryptedData: hex.EncodeToString(
+				blindedPath.EncryptedData[i],
+			),
+		}
+	}
+
+	gen.BlindedRoute = &vectorSection{
+		IntroductionNodeID: hexKey(blindedPath.EntryNodeID),
+		Blinding:           hexKey(blindedPath.FirstBlindingEphemeralKey),
+		Hops:               pathHops,
+	}
+	gen.FullRoute = &vectorSection{
+		Hops: vectorHops,
+	}
+	gen.Onion = hex.EncodeToString(onion.Serialize())
+
+	return &TestVector{
+		Comment:  s.Comment,
+		Generate: gen,
+		Decrypt: &vectorSection{
+			Hops: decrypt,
+		},
+	}, nil
+}
+
+// hexKey hex encodes the compressed pub key.
+func hexKey(pubKey *btcec.PublicKey) string {
+	return hex.EncodeToString(pubKey.SerializeCompressed())
+}
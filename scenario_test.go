@@ -0,0 +1,99 @@
+package onion
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadScenario(t *testing.T, name string) *Scenario {
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+
+	s, err := ParseScenario(b)
+	require.NoError(t, err)
+
+	return s
+}
+
+func TestGenerateTestVector(t *testing.T) {
+	for _, name := range []string{
+		"scenario.json", "scenario-blinded.json",
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := loadScenario(t, name)
+
+			v, err := s.GenerateTestVector()
+			require.NoError(t, err)
+
+			// The generated vector can be verified once it has
+			// been written out.
+			b, err := json.Marshal(v)
+			require.NoError(t, err)
+
+			parsed, err := ParseTestVector(b)
+			require.NoError(t, err)
+			require.NoError(t, parsed.Verify())
+
+			// The same vector is generated every time.
+			v2, err := s.GenerateTestVector()
+			require.NoError(t, err)
+			require.Equal(t, v, v2)
+		})
+	}
+}
+
+func TestGeneratedVectorMismatch(t *testing.T) {
+	v, err := loadScenario(t, "scenario.json").GenerateTestVector()
+	require.NoError(t, err)
+
+	require.Len(t, v.Generate.Hops, 3)
+	require.Len(t, v.Decode, 3)
+	require.NotEmpty(t, v.Generate.Filler)
+
+	// Each intermediate value is checked.
+	v.Generate.Hops[1].Mu = v.Generate.Hops[1].Um
+
+	var mismatch *VectorMismatch
+	require.ErrorAs(t, v.Verify(), &mismatch)
+	require.Equal(t, "generate", mismatch.Section)
+	require.Equal(t, 1, mismatch.Hop)
+	require.Equal(t, "mu", mismatch.Field)
+
+	v, err = loadScenario(t, "scenario-blinded.json").GenerateTestVector()
+	require.NoError(t, err)
+	require.Len(t, v.Generate.FullRoute.Hops, 4)
+	require.Len(t, v.Generate.BlindedRoute.Hops, 3)
+
+	v.Decrypt.Hops[2].NextBlinding = v.Decrypt.Hops[1].NextBlinding
+	require.ErrorAs(t, v.Verify(), &mismatch)
+	require.Equal(t, "decrypt", mismatch.Section)
+	require.Equal(t, 2, mismatch.Hop)
+	require.Equal(t, "next_blinding", mismatch.Field)
+}
+
+func TestScenarioKeys(t *testing.T) {
+	s := loadScenario(t, "scenario.json")
+	s.Seed = ""
+
+	// Without a seed, every key must be given.
+	_, err := s.GenerateTestVector()
+	require.Error(t, err)
+
+	s.SessionKey = strings.Repeat("41", 32)
+	for i, node := range s.Nodes {
+		node.PrivKey = strings.Repeat(fmt.Sprintf("%02x", 0x42+i), 32)
+	}
+	v, err := s.GenerateTestVector()
+	require.NoError(t, err)
+	require.Equal(t, s.SessionKey, v.Generate.SessionKey)
+	require.Equal(t, s.Nodes[0].PrivKey, v.Decode[0])
+
+	s.Hops[0].Node = "Frank"
+	_, err = s.GenerateTestVector()
+	require.Error(t, err)
+}
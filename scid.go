@@ -0,0 +1,86 @@
+package onion
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ShortChannelID identifies a channel by the location of its funding output
+// in the chain.
+type ShortChannelID struct {
+	// BlockHeight is the height of the block containing the funding
+	// transaction.
+	BlockHeight uint32
+
+	// TxIndex is the index of the funding transaction within the block.
+	TxIndex uint32
+
+	// OutputIndex is the index of the funding output within the funding
+	// transaction.
+	OutputIndex uint16
+}
+
+// NewShortChannelIDFromInt unpacks the compact 8 byte form of a short channel
+// ID.
+func NewShortChannelIDFromInt(v uint64) ShortChannelID {
+	return ShortChannelID{
+		BlockHeight: uint32(v >> 40),
+		TxIndex:     uint32(v>>16) & 0xffffff,
+		OutputIndex: uint16(v),
+	}
+}
+
+// ToUint64 packs the short channel ID into its compact 8 byte form:
+//   - 3 bytes block height
+//   - 3 bytes tx index
+//   - 2 bytes output index
+func (s ShortChannelID) ToUint64() uint64 {
+	return uint64(s.BlockHeight)<<40 | uint64(s.TxIndex)<<16 |
+		uint64(s.OutputIndex)
+}
+
+// String returns the human-readable BxTxO form of the short channel ID.
+func (s ShortChannelID) String() string {
+	return fmt.Sprintf("%dx%dx%d", s.BlockHeight, s.TxIndex, s.OutputIndex)
+}
+
+// ParseShortChannelID parses a short channel ID in either the BxTxO form or
+// as a plain integer.
+func ParseShortChannelID(str string) (ShortChannelID, error) {
+	parts := strings.Split(strings.TrimSpace(str), "x")
+	if len(parts) == 1 {
+		v, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return ShortChannelID{}, err
+		}
+
+		return NewShortChannelIDFromInt(v), nil
+	}
+
+	if len(parts) != 3 {
+		return ShortChannelID{}, fmt.Errorf("invalid short channel "+
+			"ID: %s", str)
+	}
+
+	block, err := strconv.ParseUint(parts[0], 10, 24)
+	if err != nil {
+		return ShortChannelID{}, err
+	}
+
+	tx, err := strconv.ParseUint(parts[1], 10, 24)
+	if err != nil {
+		return ShortChannelID{}, err
+	}
+
+	output, err := strconv.ParseUint(parts[2], 10, 16)
+	if err != nil {
+		return ShortChannelID{}, err
+	}
+
+	return ShortChannelID{
+		BlockHeight: uint32(block),
+		TxIndex:     uint32(tx),
+		OutputIndex: uint16(output),
+	}, nil
+}
@@ -0,0 +1,28 @@
+package onion
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestShortChannelID(t *testing.T) {
+	scid := ShortChannelID{
+		BlockHeight: 700000,
+		TxIndex:     1234,
+		OutputIndex: 5,
+	}
+
+	require.Equal(t, scid, NewShortChannelIDFromInt(scid.ToUint64()))
+	require.Equal(t, "700000x1234x5", scid.String())
+
+	parsed, err := ParseShortChannelID("700000x1234x5")
+	require.NoError(t, err)
+	require.Equal(t, scid, parsed)
+
+	parsed, err = ParseShortChannelID("1729")
+	require.NoError(t, err)
+	require.Equal(t, ShortChannelID{OutputIndex: 1729}, parsed)
+
+	_, err = ParseShortChannelID("1x2")
+	require.Error(t, err)
+}
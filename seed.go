@@ -0,0 +1,70 @@
+package onion
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+var (
+	// nodeKeyType is used to derive node keys from a seed.
+	nodeKeyType = []byte("node")
+
+	// sessionKeyType is used to derive session keys from a seed.
+	sessionKeyType = []byte("session")
+)
+
+// MinSeedLen is the minimum length of a seed.
+const MinSeedLen = 16
+
+// SeedDeriver deterministically derives node keys and session keys from a
+// master seed so that the same onions are built every time.
+type SeedDeriver struct {
+	seed []byte
+}
+
+// NewSeedDeriver creates a SeedDeriver for the given seed.
+func NewSeedDeriver(seed []byte) (*SeedDeriver, error) {
+	if len(seed) < MinSeedLen {
+		return nil, fmt.Errorf("seed must be at least %d bytes",
+			MinSeedLen)
+	}
+
+	return &SeedDeriver{
+		seed: append([]byte{}, seed...),
+	}, nil
+}
+
+// NodeKey returns the node key with the given index.
+func (s *SeedDeriver) NodeKey(index uint32) *btcec.PrivateKey {
+	return s.deriveKey(nodeKeyType, index)
+}
+
+// SessionKey returns the session key with the given index.
+func (s *SeedDeriver) SessionKey(index uint32) *btcec.PrivateKey {
+	return s.deriveKey(sessionKeyType, index)
+}
+
+// deriveKey derives a key as HMAC-SHA256(seed, keyType || index || counter),
+// starting with a counter of zero and incrementing it in the unlikely case
+// that the result is not a valid private key.
+func (s *SeedDeriver) deriveKey(keyType []byte,
+	index uint32) *btcec.PrivateKey {
+
+	for counter := uint32(0); ; counter++ {
+		mac := hmac.New(sha256.New, s.seed)
+		mac.Write(keyType)
+		_ = binary.Write(mac, binary.BigEndian, index)
+		_ = binary.Write(mac, binary.BigEndian, counter)
+
+		var scalar btcec.ModNScalar
+		overflow := scalar.SetByteSlice(mac.Sum(nil))
+		if overflow || scalar.IsZero() {
+			continue
+		}
+
+		return btcec.PrivKeyFromScalar(&scalar)
+	}
+}
@@ -0,0 +1,78 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSeedDeriver(t *testing.T) {
+	_, err := NewSeedDeriver(make([]byte, MinSeedLen-1))
+	require.Error(t, err)
+
+	deriver, err := NewSeedDeriver(bytes.Repeat([]byte{0x42}, 32))
+	require.NoError(t, err)
+
+	// Keys are stable across runs.
+	require.Equal(t,
+		"ce5701c1facd863bd87b8bdc9abd022a99cb0f637adabd7cf6b78eb88c2b7881",
+		hex.EncodeToString(deriver.NodeKey(0).Serialize()),
+	)
+	require.Equal(t,
+		"98a3e6c6d6b38c347431790465fe3079d9769376b3e62c90a53ed973c3635dc2",
+		hex.EncodeToString(deriver.SessionKey(0).Serialize()),
+	)
+
+	// Every key is different.
+	seen := make(map[string]struct{})
+	for i := uint32(0); i < 10; i++ {
+		for _, key := range [][]byte{
+			deriver.NodeKey(i).Serialize(),
+			deriver.SessionKey(i).Serialize(),
+		} {
+			_, ok := seen[string(key)]
+			require.False(t, ok)
+			seen[string(key)] = struct{}{}
+		}
+	}
+
+	other, err := NewSeedDeriver(bytes.Repeat([]byte{0x43}, 32))
+	require.NoError(t, err)
+	require.NotEqual(t, deriver.NodeKey(0).Serialize(),
+		other.NodeKey(0).Serialize())
+}
+
+func TestSeededOnionIsStable(t *testing.T) {
+	deriver, err := NewSeedDeriver(bytes.Repeat([]byte{0x42}, 32))
+	require.NoError(t, err)
+
+	build := func() []byte {
+		onion, _, err := BuildOnion(deriver.SessionKey(0), []*HopData{
+			{
+				PubKey:    Users[Bob].PubKey,
+				ClearData: []byte("Hi Bob"),
+			},
+			{
+				PubKey:    Users[Charlie].PubKey,
+				ClearData: []byte("Hi Charlie"),
+			},
+		})
+		require.NoError(t, err)
+
+		return onion.Serialize()
+	}
+
+	onion := build()
+	require.Equal(t, onion, build())
+
+	// The CLI builds the same onion with:
+	//   --user=alice --seed=4242..42 build onion --hops=bob,charlie
+	//   --payloads="Hi Bob,Hi Charlie"
+	hash := sha256.Sum256(onion)
+	require.Equal(t,
+		"90ab8c44db9704b73da2c87429c2961e3b16c0dd054934e9daed8a1026cf153a",
+		hex.EncodeToString(hash[:]),
+	)
+}
@@ -0,0 +1,360 @@
+package onion
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"io"
+	"net"
+	"sync"
+)
+
+// Signer holds a node's private key and performs the key operations that the
+// node needs in order to process onions. This allows the key to live outside
+// of the process that handles the onions.
+type Signer interface {
+	// PubKey returns the node's public key.
+	PubKey() *btcec.PublicKey
+
+	// ECDH returns the shared secret between the node's key and the given
+	// key: SHA256(k * P).
+	ECDH(pub *btcec.PublicKey) ([32]byte, error)
+
+	// BlindedECDH returns the shared secret between the node's key,
+	// blinded with the given blinding factor, and the given key:
+	// SHA256(bf * k * P). This is used by nodes inside a blinded route.
+	BlindedECDH(bf [32]byte, pub *btcec.PublicKey) ([32]byte, error)
+}
+
+// PrivKeySigner is a Signer that keeps the private key in memory.
+type PrivKeySigner struct {
+	privKey *btcec.PrivateKey
+}
+
+// NewPrivKeySigner creates a Signer for the given private key.
+func NewPrivKeySigner(privKey *btcec.PrivateKey) *PrivKeySigner {
+	return &PrivKeySigner{
+		privKey: privKey,
+	}
+}
+
+// PubKey returns the public key of the private key.
+//
+// NOTE: This is part of the Signer interface.
+func (p *PrivKeySigner) PubKey() *btcec.PublicKey {
+	return p.privKey.PubKey()
+}
+
+// ECDH returns the shared secret with the given key.
+//
+// NOTE: This is part of the Signer interface.
+func (p *PrivKeySigner) ECDH(pub *btcec.PublicKey) ([32]byte, error) {
+	return sharedSecret(p.privKey, pub), nil
+}
+
+// BlindedECDH returns the shared secret between the blinded private key and
+// the given key.
+//
+// NOTE: This is part of the Signer interface.
+func (p *PrivKeySigner) BlindedECDH(bf [32]byte,
+	pub *btcec.PublicKey) ([32]byte, error) {
+
+	return sharedSecret(blindPriv(bf, p.privKey), pub), nil
+}
+
+// The operations supported by the signer protocol. Each request is the
+// operation byte followed by its arguments:
+//   - signerPubKey: no arguments
+//   - signerECDH: 33 byte pub key
+//   - signerBlindedECDH: 32 byte blinding factor and 33 byte pub key
+//
+// Each response starts with a status byte. On success it is followed by the
+// 33 byte pub key or the 32 byte shared secret. On failure it is followed by a
+// 2 byte length prefixed error message.
+const (
+	signerPubKey      byte = 0
+	signerECDH        byte = 1
+	signerBlindedECDH byte = 2
+
+	signerStatusOK  byte = 0
+	signerStatusErr byte = 1
+)
+
+// ErrNoSigner is returned when processing an onion as a user without a Signer,
+// such as a user that is only known by its pub key.
+var ErrNoSigner = errors.New("user has no signer")
+
+// errUnknownSignerOp is returned for a request with an unknown operation. The
+// length of its arguments is unknown too, so the rest of the stream can't be
+// read and the connection is closed after the error is sent.
+var errUnknownSignerOp = errors.New("unknown signer operation")
+
+// SignerServer serves the key operations of a Signer over a unix socket so
+// that it can be used by a RemoteSigner in another process.
+type SignerServer struct {
+	signer   Signer
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+
+	wg sync.WaitGroup
+}
+
+// NewSignerServer starts serving the given Signer on the unix socket at the
+// given path.
+func NewSignerServer(signer Signer, path string) (*SignerServer, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SignerServer{
+		signer:   signer,
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.acceptConns()
+
+	return s, nil
+}
+
+// acceptConns handles new connections until the listener is closed.
+func (s *SignerServer) acceptConns() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn serves requests on the connection until it is closed.
+func (s *SignerServer) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		resp, err := s.handleRequest(r)
+		if errors.Is(err, io.EOF) {
+			return
+		} else if err != nil {
+			msg := err.Error()
+			resp = []byte{signerStatusErr, 0, 0}
+			binary.BigEndian.PutUint16(resp[1:], uint16(len(msg)))
+			resp = append(resp, msg...)
+		}
+
+		if _, werr := conn.Write(resp); werr != nil {
+			return
+		}
+
+		if errors.Is(err, errUnknownSignerOp) {
+			return
+		}
+	}
+}
+
+// handleRequest reads a single request and returns the successful response.
+func (s *SignerServer) handleRequest(r io.Reader) ([]byte, error) {
+	var op [1]byte
+	if _, err := io.ReadFull(r, op[:]); err != nil {
+		return nil, err
+	}
+
+	var bf [32]byte
+	switch op[0] {
+	case signerPubKey:
+		resp := []byte{signerStatusOK}
+		return append(resp, s.signer.PubKey().SerializeCompressed()...),
+			nil
+
+	case signerBlindedECDH:
+		if _, err := io.ReadFull(r, bf[:]); err != nil {
+			return nil, err
+		}
+
+	case signerECDH:
+
+	default:
+		return nil, fmt.Errorf("%w: %d", errUnknownSignerOp, op[0])
+	}
+
+	var pubBytes [33]byte
+	if _, err := io.ReadFull(r, pubBytes[:]); err != nil {
+		return nil, err
+	}
+
+	pub, err := btcec.ParsePubKey(pubBytes[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var ss [32]byte
+	if op[0] == signerBlindedECDH {
+		ss, err = s.signer.BlindedECDH(bf, pub)
+	} else {
+		ss, err = s.signer.ECDH(pub)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{signerStatusOK}, ss[:]...), nil
+}
+
+// Stop stops the server and closes all open connections.
+func (s *SignerServer) Stop() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return err
+}
+
+// RemoteSigner is a Signer that asks a SignerServer in another process to
+// perform the key operations.
+type RemoteSigner struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	r      *bufio.Reader
+	pubKey *btcec.PublicKey
+}
+
+// NewRemoteSigner connects to the SignerServer listening on the unix socket at
+// the given path.
+func NewRemoteSigner(path string) (*RemoteSigner, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &RemoteSigner{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+
+	resp, err := s.request([]byte{signerPubKey}, 33)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s.pubKey, err = btcec.ParsePubKey(resp)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// request sends the request to the server and reads a successful response of
+// the given length.
+func (s *RemoteSigner) request(req []byte, respLen int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var status [1]byte
+	if _, err := io.ReadFull(s.r, status[:]); err != nil {
+		return nil, err
+	}
+
+	if status[0] != signerStatusOK {
+		var errLen uint16
+		if err := binary.Read(s.r, binary.BigEndian, &errLen); err != nil {
+			return nil, err
+		}
+
+		msg := make([]byte, errLen)
+		if _, err := io.ReadFull(s.r, msg); err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("remote signer: %s", msg)
+	}
+
+	resp := make([]byte, respLen)
+	if _, err := io.ReadFull(s.r, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// PubKey returns the public key of the remote signer.
+//
+// NOTE: This is part of the Signer interface.
+func (s *RemoteSigner) PubKey() *btcec.PublicKey {
+	return s.pubKey
+}
+
+// ECDH asks the remote signer for the shared secret with the given key.
+//
+// NOTE: This is part of the Signer interface.
+func (s *RemoteSigner) ECDH(pub *btcec.PublicKey) ([32]byte, error) {
+	req := append([]byte{signerECDH}, pub.SerializeCompressed()...)
+
+	return s.sharedSecret(req)
+}
+
+// BlindedECDH asks the remote signer for the blinded shared secret with the
+// given key.
+//
+// NOTE: This is part of the Signer interface.
+func (s *RemoteSigner) BlindedECDH(bf [32]byte,
+	pub *btcec.PublicKey) ([32]byte, error) {
+
+	req := append([]byte{signerBlindedECDH}, bf[:]...)
+	req = append(req, pub.SerializeCompressed()...)
+
+	return s.sharedSecret(req)
+}
+
+// sharedSecret sends a request for a shared secret to the remote signer.
+func (s *RemoteSigner) sharedSecret(req []byte) ([32]byte, error) {
+	var ss [32]byte
+
+	resp, err := s.request(req, 32)
+	if err != nil {
+		return ss, err
+	}
+	copy(ss[:], resp)
+
+	return ss, nil
+}
+
+// Close closes the connection to the remote signer.
+func (s *RemoteSigner) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,160 @@
+package onion
+
+import (
+	"encoding/binary"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// remoteUser returns a copy of the given user whose key operations are done by
+// a signer server listening on a unix socket.
+func remoteUser(t *testing.T, user *User) *User {
+	// Unix socket paths are limited in length so we don't use t.TempDir.
+	dir, err := os.MkdirTemp("", "signer")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	server, err := NewSignerServer(
+		user.Signer, filepath.Join(dir, "signer.sock"),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, server.Stop())
+	})
+
+	signer, err := NewRemoteSigner(filepath.Join(dir, "signer.sock"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		signer.Close()
+	})
+
+	remote := *user
+	remote.Signer = signer
+
+	return &remote
+}
+
+func TestRemoteSigner(t *testing.T) {
+	priv, _ := btcec.NewPrivateKey()
+	local := NewPrivKeySigner(priv)
+	remote := remoteUser(t, &User{Signer: local}).Signer
+
+	require.True(t, remote.PubKey().IsEqual(priv.PubKey()))
+
+	other, _ := btcec.NewPrivateKey()
+	ss, err := remote.ECDH(other.PubKey())
+	require.NoError(t, err)
+	require.Equal(t, sharedSecret(other, priv.PubKey()), ss)
+
+	bf := [32]byte{1, 2, 3}
+	ss, err = remote.BlindedECDH(bf, other.PubKey())
+	require.NoError(t, err)
+
+	expected, err := local.BlindedECDH(bf, other.PubKey())
+	require.NoError(t, err)
+	require.Equal(t, expected, ss)
+	require.Equal(
+		t, sharedSecret(other, blindPub(bf, priv.PubKey())), ss,
+	)
+}
+
+func TestSignerServerUnknownOp(t *testing.T) {
+	dir, err := os.MkdirTemp("", "signer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	priv, _ := btcec.NewPrivateKey()
+	path := filepath.Join(dir, "signer.sock")
+	server, err := NewSignerServer(NewPrivKeySigner(priv), path)
+	require.NoError(t, err)
+	defer server.Stop()
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The unknown op is followed by what would be a valid request if it
+	// was read as the next one.
+	req := []byte{0xff, signerECDH}
+	req = append(req, priv.PubKey().SerializeCompressed()...)
+	_, err = conn.Write(req)
+	require.NoError(t, err)
+
+	// The server reports the error and then closes the connection
+	// without serving the rest of the stream.
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, signerStatusErr, resp[0])
+	require.Contains(t, string(resp[3:]), "unknown signer operation")
+	require.EqualValues(
+		t, len(resp)-3, binary.BigEndian.Uint16(resp[1:3]),
+	)
+}
+
+func TestPeelWithRemoteSigner(t *testing.T) {
+	// A -> B -> C -> B(D) -> B(E) where every hop uses a remote signer.
+	users := map[string]*User{
+		Bob:     remoteUser(t, Users[Bob]),
+		Charlie: remoteUser(t, Users[Charlie]),
+		Dave:    remoteUser(t, Users[Dave]),
+		Eve:     remoteUser(t, Users[Eve]),
+	}
+
+	eveSessionKey, _ := btcec.NewPrivateKey()
+	bp, err := BuildBlindedPath(eveSessionKey, []*HopData{
+		{
+			PubKey:    Users[Charlie].PubKey,
+			ClearData: []byte("Hi Charlie, from Eve"),
+		},
+		{
+			PubKey:    Users[Dave].PubKey,
+			ClearData: []byte("Hi Dave, from Eve"),
+		},
+		{
+			PubKey:    Users[Eve].PubKey,
+			ClearData: []byte("Hi Me, from Me"),
+		},
+	})
+	require.NoError(t, err)
+
+	aliceSessionKey, _ := btcec.NewPrivateKey()
+	onion, _, err := BuildOnion(aliceSessionKey, []*HopData{
+		{
+			PubKey:    Users[Bob].PubKey,
+			ClearData: []byte("Hi Bob, from Alice"),
+		},
+		{
+			PubKey:        Users[Charlie].PubKey,
+			ClearData:     []byte("Hi Charlie, from Alice"),
+			EncryptedData: bp.EncryptedData[0],
+			EphemeralKey:  bp.FirstBlindingEphemeralKey,
+		},
+		{
+			PubKey:        bp.BlindedNodeIDs[0],
+			ClearData:     []byte("Hi B(D), from Alice"),
+			EncryptedData: bp.EncryptedData[1],
+		},
+		{
+			PubKey:        bp.BlindedNodeIDs[1],
+			ClearData:     []byte("Hi B(E), from Alice"),
+			EncryptedData: bp.EncryptedData[2],
+		},
+	})
+	require.NoError(t, err)
+
+	var payload *HopPayload
+	for _, name := range []string{Bob, Charlie, Dave, Eve} {
+		payload, onion, err = Peel(users[name], onion)
+		require.NoError(t, err)
+	}
+	require.Equal(t, []byte("Hi Me, from Me"),
+		payload.DecryptedDataFromRecipient)
+	require.Nil(t, payload.FwdTo)
+}
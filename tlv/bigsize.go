@@ -0,0 +1,109 @@
+package tlv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrBigSizeNotCanonical is returned when a BigSize integer is not encoded
+// using the minimum number of bytes.
+var ErrBigSizeNotCanonical = errors.New("decoded bigsize is not canonical")
+
+// BigSizeLen returns the number of bytes needed to BigSize encode v.
+func BigSizeLen(v uint64) int {
+	switch {
+	case v < 0xfd:
+		return 1
+	case v <= 0xffff:
+		return 3
+	case v <= 0xffffffff:
+		return 5
+	default:
+		return 9
+	}
+}
+
+// EncodeBigSize encodes v using the BigSize format from BOLT 1:
+//   - v < 0xfd: 1 byte
+//   - v <= 0xffff: 0xfd followed by a 2 byte big-endian value
+//   - v <= 0xffffffff: 0xfe followed by a 4 byte big-endian value
+//   - otherwise: 0xff followed by an 8 byte big-endian value
+func EncodeBigSize(v uint64) []byte {
+	b := make([]byte, BigSizeLen(v))
+
+	switch len(b) {
+	case 1:
+		b[0] = byte(v)
+	case 3:
+		b[0] = 0xfd
+		binary.BigEndian.PutUint16(b[1:], uint16(v))
+	case 5:
+		b[0] = 0xfe
+		binary.BigEndian.PutUint32(b[1:], uint32(v))
+	default:
+		b[0] = 0xff
+		binary.BigEndian.PutUint64(b[1:], v)
+	}
+
+	return b
+}
+
+// WriteBigSize writes the BigSize encoding of v to w.
+func WriteBigSize(w io.Writer, v uint64) error {
+	_, err := w.Write(EncodeBigSize(v))
+	return err
+}
+
+// ReadBigSize reads a BigSize integer from r. io.EOF is returned if r is empty
+// and io.ErrUnexpectedEOF if r ends part way through the integer.
+func ReadBigSize(r io.Reader) (uint64, error) {
+	var prefix [1]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return 0, err
+	}
+
+	var (
+		buf [8]byte
+		n   int
+		min uint64
+	)
+	switch prefix[0] {
+	case 0xff:
+		n, min = 8, 0x100000000
+	case 0xfe:
+		n, min = 4, 0x10000
+	case 0xfd:
+		n, min = 2, 0xfd
+	default:
+		return uint64(prefix[0]), nil
+	}
+
+	if _, err := io.ReadFull(r, buf[8-n:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return 0, err
+	}
+
+	v := binary.BigEndian.Uint64(buf[:])
+	if v < min {
+		return 0, ErrBigSizeNotCanonical
+	}
+
+	return v, nil
+}
+
+// DecodeBigSize decodes a BigSize integer from the start of b and returns it
+// along with the number of bytes it occupied.
+func DecodeBigSize(b []byte) (uint64, int, error) {
+	r := bytes.NewReader(b)
+	v, err := ReadBigSize(r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return v, len(b) - r.Len(), nil
+}
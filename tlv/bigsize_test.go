@@ -0,0 +1,67 @@
+package tlv
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+// TestBigSize checks the BigSize encoding against the test vectors in BOLT 1.
+func TestBigSize(t *testing.T) {
+	tests := []struct {
+		value uint64
+		bytes string
+	}{
+		{0, "00"},
+		{252, "fc"},
+		{253, "fd00fd"},
+		{65535, "fdffff"},
+		{65536, "fe00010000"},
+		{4294967295, "feffffffff"},
+		{4294967296, "ff0000000100000000"},
+		{18446744073709551615, "ffffffffffffffffff"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.bytes, func(t *testing.T) {
+			require.Equal(
+				t, test.bytes,
+				hex.EncodeToString(EncodeBigSize(test.value)),
+			)
+			require.Equal(t, len(test.bytes)/2, BigSizeLen(test.value))
+
+			b, _ := hex.DecodeString(test.bytes)
+			v, n, err := DecodeBigSize(b)
+			require.NoError(t, err)
+			require.Equal(t, test.value, v)
+			require.Equal(t, len(b), n)
+		})
+	}
+}
+
+func TestBigSizeDecodeErrors(t *testing.T) {
+	tests := []struct {
+		bytes string
+		err   error
+	}{
+		{"fd00fc", ErrBigSizeNotCanonical},
+		{"fe0000ffff", ErrBigSizeNotCanonical},
+		{"ff00000000ffffffff", ErrBigSizeNotCanonical},
+		{"fd00", io.ErrUnexpectedEOF},
+		{"feffff", io.ErrUnexpectedEOF},
+		{"ffffffffff", io.ErrUnexpectedEOF},
+		{"", io.EOF},
+		{"fd", io.ErrUnexpectedEOF},
+		{"fe", io.ErrUnexpectedEOF},
+		{"ff", io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.bytes, func(t *testing.T) {
+			b, _ := hex.DecodeString(test.bytes)
+			_, _, err := DecodeBigSize(b)
+			require.ErrorIs(t, err, test.err)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package tlv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrTruncatedNotMinimal is returned when a truncated integer has leading
+// zero bytes.
+var ErrTruncatedNotMinimal = errors.New("truncated integer not minimally " +
+	"encoded")
+
+// EncodeU16 encodes v as a 2 byte big-endian integer.
+func EncodeU16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+
+	return b
+}
+
+// DecodeU16 decodes a 2 byte big-endian integer.
+func DecodeU16(b []byte) (uint16, error) {
+	if len(b) != 2 {
+		return 0, fmt.Errorf("u16 must be 2 bytes, got %d", len(b))
+	}
+
+	return binary.BigEndian.Uint16(b), nil
+}
+
+// EncodeU32 encodes v as a 4 byte big-endian integer.
+func EncodeU32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+
+	return b
+}
+
+// DecodeU32 decodes a 4 byte big-endian integer.
+func DecodeU32(b []byte) (uint32, error) {
+	if len(b) != 4 {
+		return 0, fmt.Errorf("u32 must be 4 bytes, got %d", len(b))
+	}
+
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// EncodeU64 encodes v as an 8 byte big-endian integer.
+func EncodeU64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+
+	return b
+}
+
+// DecodeU64 decodes an 8 byte big-endian integer.
+func DecodeU64(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("u64 must be 8 bytes, got %d", len(b))
+	}
+
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// EncodeTu64 encodes v as a truncated integer: big-endian with all leading
+// zero bytes removed. Zero is encoded as an empty slice.
+func EncodeTu64(v uint64) []byte {
+	b := EncodeU64(v)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+
+	return b
+}
+
+// DecodeTu64 decodes a truncated integer of at most 8 bytes.
+func DecodeTu64(b []byte) (uint64, error) {
+	if len(b) > 8 {
+		return 0, fmt.Errorf("tu64 can be at most 8 bytes, got %d",
+			len(b))
+	}
+
+	if len(b) > 0 && b[0] == 0 {
+		return 0, ErrTruncatedNotMinimal
+	}
+
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+
+	return v, nil
+}
+
+// EncodeTu32 encodes v as a truncated integer.
+func EncodeTu32(v uint32) []byte {
+	return EncodeTu64(uint64(v))
+}
+
+// DecodeTu32 decodes a truncated integer of at most 4 bytes.
+func DecodeTu32(b []byte) (uint32, error) {
+	if len(b) > 4 {
+		return 0, fmt.Errorf("tu32 can be at most 4 bytes, got %d",
+			len(b))
+	}
+
+	v, err := DecodeTu64(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(v), nil
+}
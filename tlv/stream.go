@@ -0,0 +1,131 @@
+package tlv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var (
+	// ErrNotIncreasing is returned when the records of a stream are not
+	// sorted in strictly increasing type order.
+	ErrNotIncreasing = errors.New("tlv records not in increasing order")
+
+	// ErrDuplicateType is returned when a stream contains more than one
+	// record of the same type.
+	ErrDuplicateType = errors.New("tlv stream contains duplicate type")
+
+	// ErrValueTooLong is returned when the length of a record is longer
+	// than the remaining bytes in the stream.
+	ErrValueTooLong = errors.New("tlv value exceeds stream length")
+)
+
+// Type is the type of a TLV record.
+type Type uint64
+
+// IsOdd returns true if the type is odd. Following the "it's OK to be odd"
+// rule, unknown odd types may be ignored by a reader while unknown even types
+// must cause the stream to be rejected.
+func (t Type) IsOdd() bool {
+	return t%2 == 1
+}
+
+// ErrUnknownRequiredType is returned when a stream contains an even type that
+// the reader does not understand.
+type ErrUnknownRequiredType Type
+
+func (e ErrUnknownRequiredType) Error() string {
+	return fmt.Sprintf("unknown required (even) type: %d", Type(e))
+}
+
+// Stream is a set of TLV records keyed by their type.
+type Stream map[Type][]byte
+
+// Types returns the types present in the stream in increasing order.
+func (s Stream) Types() []Type {
+	types := make([]Type, 0, len(s))
+	for t := range s {
+		types = append(types, t)
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+
+	return types
+}
+
+// Encode serialises the stream. Records are written in strictly increasing
+// type order, each as:
+//   - BigSize type
+//   - BigSize length
+//   - value
+func (s Stream) Encode() []byte {
+	var b bytes.Buffer
+	for _, t := range s.Types() {
+		v := s[t]
+
+		b.Write(EncodeBigSize(uint64(t)))
+		b.Write(EncodeBigSize(uint64(len(v))))
+		b.Write(v)
+	}
+
+	return b.Bytes()
+}
+
+// DecodeStream parses a serialised TLV stream. The known types are the types
+// that the caller understands: any unknown even type results in an
+// ErrUnknownRequiredType error while unknown odd types are kept in the
+// returned Stream so that the caller may inspect them if it wishes.
+func DecodeStream(b []byte, known ...Type) (Stream, error) {
+	knownSet := make(map[Type]bool, len(known))
+	for _, t := range known {
+		knownSet[t] = true
+	}
+
+	var (
+		r       = bytes.NewReader(b)
+		s       = make(Stream)
+		lastT   Type
+		started bool
+	)
+	for {
+		t, err := ReadBigSize(r)
+		if err == io.EOF {
+			return s, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if started && Type(t) == lastT {
+			return nil, ErrDuplicateType
+		} else if started && Type(t) < lastT {
+			return nil, ErrNotIncreasing
+		}
+		lastT, started = Type(t), true
+
+		l, err := ReadBigSize(r)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+
+		if l > uint64(r.Len()) {
+			return nil, ErrValueTooLong
+		}
+
+		v := make([]byte, l)
+		if _, err := io.ReadFull(r, v); err != nil {
+			return nil, err
+		}
+
+		if !knownSet[Type(t)] && !Type(t).IsOdd() {
+			return nil, ErrUnknownRequiredType(t)
+		}
+
+		s[Type(t)] = v
+	}
+}
@@ -0,0 +1,84 @@
+package tlv
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestStreamEncodeDecode(t *testing.T) {
+	s := Stream{
+		1:     []byte{},
+		2:     EncodeTu64(15000),
+		65537: []byte("hello"),
+		254:   EncodeU32(7),
+	}
+
+	b := s.Encode()
+	require.Equal(
+		t, "010002023a98fd00fe0400000007fe0001000105"+
+			hex.EncodeToString([]byte("hello")),
+		hex.EncodeToString(b),
+	)
+
+	s2, err := DecodeStream(b, 2, 254)
+	require.NoError(t, err)
+	require.Equal(t, s, s2)
+}
+
+func TestStreamDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		bytes string
+		err   error
+	}{
+		{
+			name:  "not increasing",
+			bytes: "02000100",
+			err:   ErrNotIncreasing,
+		},
+		{
+			name:  "duplicate",
+			bytes: "0100010101",
+			err:   ErrDuplicateType,
+		},
+		{
+			name:  "value too long",
+			bytes: "010201",
+			err:   ErrValueTooLong,
+		},
+		{
+			name:  "unknown even type",
+			bytes: "0400",
+			err:   ErrUnknownRequiredType(4),
+		},
+		{
+			name:  "non-canonical type",
+			bytes: "fd000100",
+			err:   ErrBigSizeNotCanonical,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, _ := hex.DecodeString(test.bytes)
+			_, err := DecodeStream(b, 2)
+			require.ErrorIs(t, err, test.err)
+		})
+	}
+}
+
+func TestTruncatedInts(t *testing.T) {
+	require.Empty(t, EncodeTu64(0))
+	require.Equal(t, []byte{0x01, 0x00}, EncodeTu64(256))
+
+	v, err := DecodeTu64([]byte{0x01, 0x00})
+	require.NoError(t, err)
+	require.EqualValues(t, 256, v)
+
+	_, err = DecodeTu64([]byte{0x00, 0x01})
+	require.ErrorIs(t, err, ErrTruncatedNotMinimal)
+
+	_, err = DecodeTu32([]byte{1, 2, 3, 4, 5})
+	require.Error(t, err)
+}
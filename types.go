@@ -1,12 +1,126 @@
 package onion
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"github.com/btcsuite/btcd/btcec/v2"
+	"onion/tlv"
 )
 
+const (
+	// amtToForwardType is the type of the amt_to_forward record in a hop
+	// payload.
+	amtToForwardType tlv.Type = 2
+
+	// outgoingCLTVType is the type of the outgoing_cltv_value record in a
+	// hop payload.
+	outgoingCLTVType tlv.Type = 4
+
+	// shortChannelIDType is the type of the short_channel_id record in a
+	// hop payload.
+	shortChannelIDType tlv.Type = 6
+
+	// paymentDataType is the type of the payment_data record in a hop
+	// payload.
+	paymentDataType tlv.Type = 8
+
+	// encryptedDataType is the type of the encrypted_recipient_data
+	// record in a hop payload.
+	encryptedDataType tlv.Type = 10
+
+	// blindingPointType is the type of the current_blinding_point record
+	// in a hop payload.
+	blindingPointType tlv.Type = 12
+
+	// paymentMetadataType is the type of the payment_metadata record in a
+	// hop payload.
+	paymentMetadataType tlv.Type = 16
+
+	// totalAmountType is the type of the total_amount_msat record in a
+	// hop payload. It is given to the final hop of a blinded path.
+	totalAmountType tlv.Type = 18
+
+	// clearDataType is the type of the free-form message from the sender.
+	// It is a custom (odd) type so that nodes that don't know about it may
+	// ignore it.
+	clearDataType tlv.Type = 65537
+
+	// fwdToType is the type of the record holding the pub key of the next
+	// node in a hop payload.
+	fwdToType tlv.Type = 65539
+
+	// recipientPaddingType is the type of the padding record in the
+	// encrypted data from the recipient. It is used to give the data for
+	// each hop the same length and is ignored when decoding.
+	recipientPaddingType tlv.Type = 1
+
+	// recipientSCIDType is the type of the short_channel_id record in the
+	// encrypted data from the recipient.
+	recipientSCIDType tlv.Type = 2
+
+	// nextNodeIDType is the type of the next_node_id record in the
+	// encrypted data from the recipient.
+	nextNodeIDType tlv.Type = 4
+
+	// pathIDType is the type of the path_id record in the encrypted data
+	// from the recipient. It is only set for the final hop.
+	pathIDType tlv.Type = 6
+
+	// nextPathKeyOverrideType is the type of the next_path_key_override
+	// record in the encrypted data from the recipient. It is set for the
+	// last hop of a path that another blinded path is concatenated to.
+	nextPathKeyOverrideType tlv.Type = 8
+
+	// paymentRelayType is the type of the payment_relay record in the
+	// encrypted data from the recipient.
+	paymentRelayType tlv.Type = 10
+
+	// paymentConstraintsType is the type of the payment_constraints record
+	// in the encrypted data from the recipient.
+	paymentConstraintsType tlv.Type = 12
+
+	// allowedFeaturesType is the type of the allowed_features record in
+	// the encrypted data from the recipient.
+	allowedFeaturesType tlv.Type = 14
+
+	// recipientPayloadType is the type of the free-form message from the
+	// recipient in the encrypted data.
+	recipientPayloadType tlv.Type = 65537
+)
+
+var (
+	// hopPayloadTypes are the types that we understand in a hop payload.
+	hopPayloadTypes = []tlv.Type{
+		amtToForwardType, outgoingCLTVType, shortChannelIDType,
+		paymentDataType, encryptedDataType, blindingPointType,
+		paymentMetadataType, totalAmountType, clearDataType, fwdToType,
+	}
+
+	// recipientDataTypes are the types that we understand in the
+	// encrypted data from the recipient.
+	recipientDataTypes = []tlv.Type{
+		recipientPaddingType, recipientSCIDType, nextNodeIDType,
+		pathIDType, nextPathKeyOverrideType, paymentRelayType,
+		paymentConstraintsType, allowedFeaturesType,
+		recipientPayloadType,
+	}
+)
+
+// ErrInvalidRecord is returned when the value of a TLV record can't be
+// decoded.
+type ErrInvalidRecord struct {
+	Type tlv.Type
+	Err  error
+}
+
+func (e *ErrInvalidRecord) Error() string {
+	return fmt.Sprintf("invalid value for type %d: %v", e.Type, e.Err)
+}
+
+func (e *ErrInvalidRecord) Unwrap() error {
+	return e.Err
+}
+
 // HopData couples the payload we want to send to the peer we want to send it
 // to.
 type HopData struct {
@@ -23,82 +137,340 @@ type HopData struct {
 
 	// EphemeralKey is included only for the entry point hop.
 	EphemeralKey *btcec.PublicKey
+
+	// AmtToForward is the amount in msat that the hop should forward to
+	// the next hop or, for the final hop, the amount it should receive.
+	// Hops in a blinded path that are given a PaymentRelay don't get it
+	// from the sender, Peel works it out from the incoming HTLC instead.
+	AmtToForward uint64
+
+	// OutgoingCLTV is the CLTV value that the hop should use for the HTLC
+	// to the next hop or, for the final hop, the CLTV it should receive.
+	// Like AmtToForward, Peel works it out for hops in a blinded path
+	// that are given a PaymentRelay.
+	OutgoingCLTV uint32
+
+	// ShortChannelID is the channel over which the hop should forward the
+	// HTLC. It is not set for the final hop. If it is set, BuildOnion will
+	// not include the pub key of the next hop in the payload and the hop
+	// will instead use its channel table to find the next hop. When used
+	// to build a blinded path, it is used in place of the next node ID in
+	// the encrypted data.
+	ShortChannelID *ShortChannelID
+
+	// PaymentData is only set for the final hop.
+	PaymentData *PaymentData
+
+	// PaymentMetadata is opaque data from the invoice that is only set for
+	// the final hop.
+	PaymentMetadata []byte
+
+	// TotalAmountMsat is the total amount of a payment to a blinded path,
+	// which may be split over multiple HTLCs. It is only set for the
+	// final hop.
+	TotalAmountMsat uint64
+
+	// PaymentRelay is the policy that the hop applies when forwarding a
+	// payment. It is only used to build a blinded path, where it is put in
+	// the encrypted data for the hop.
+	PaymentRelay *PaymentRelay
+
+	// PaymentConstraints are the limits on the HTLCs that the hop accepts.
+	// It is only used to build a blinded path, where it is put in the
+	// encrypted data for the hop.
+	PaymentConstraints *PaymentConstraints
+
+	// HtlcMaximumMsat is the largest HTLC that the hop can forward. It is
+	// only used to work out the BlindedPayInfo of a blinded path, zero
+	// means that there is no maximum.
+	HtlcMaximumMsat uint64
+
+	// AllowedFeatures is the feature bit vector of the features that the
+	// hop allows the sender to use. It is only used to build a blinded
+	// path, where it is put in the encrypted data for the hop and added
+	// to the features of the BlindedPayInfo.
+	AllowedFeatures []byte
+}
+
+// PaymentData is the payment_data for the final hop of a payment.
+type PaymentData struct {
+	// PaymentSecret is the secret from the invoice.
+	PaymentSecret [32]byte
+
+	// TotalMsat is the total amount of the payment which may be split
+	// over multiple HTLCs.
+	TotalMsat uint64
+}
+
+// encode serialises the PaymentData as the 32 byte payment secret followed by
+// the truncated total amount.
+func (p *PaymentData) encode() []byte {
+	return append(p.PaymentSecret[:], tlv.EncodeTu64(p.TotalMsat)...)
+}
+
+func decodePaymentData(b []byte) (*PaymentData, error) {
+	if len(b) < 32 {
+		return nil, fmt.Errorf("payment_data too short: %d", len(b))
+	}
+
+	total, err := tlv.DecodeTu64(b[32:])
+	if err != nil {
+		return nil, err
+	}
+
+	data := &PaymentData{
+		TotalMsat: total,
+	}
+	copy(data.PaymentSecret[:], b[:32])
+
+	return data, nil
+}
+
+// PaymentRelay is the payment_relay that the recipient of a blinded path gives
+// each hop in the path. Since the sender doesn't know which channels the path
+// uses, the hops work out the amount and CLTV to forward from the incoming HTLC
+// with it.
+type PaymentRelay struct {
+	// FeeBaseMsat is the base fee that the hop charges.
+	FeeBaseMsat uint32
+
+	// FeeProportionalMillionths is the fee rate that the hop charges.
+	FeeProportionalMillionths uint32
+
+	// CltvExpiryDelta is the difference between the CLTV of the incoming
+	// and outgoing HTLC.
+	CltvExpiryDelta uint16
+}
+
+// ForwardAmount returns the amount that the hop should forward for an incoming
+// HTLC of the given amount. It is the largest amount that the hop's fee can be
+// taken from, rounded up.
+func (p *PaymentRelay) ForwardAmount(incoming uint64) (uint64, error) {
+	if incoming < uint64(p.FeeBaseMsat) {
+		return 0, fmt.Errorf("amount %d is below the base fee %d",
+			incoming, p.FeeBaseMsat)
+	}
+
+	rate := 1_000_000 + uint64(p.FeeProportionalMillionths)
+
+	return ((incoming-uint64(p.FeeBaseMsat))*1_000_000 + rate - 1) /
+		rate, nil
+}
+
+// Forward returns the amount and CLTV expiry that the hop should forward for an
+// incoming HTLC.
+func (p *PaymentRelay) Forward(incomingAmt uint64,
+	incomingCLTV uint32) (uint64, uint32, error) {
+
+	amt, err := p.ForwardAmount(incomingAmt)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	delta := uint32(p.CltvExpiryDelta)
+	if incomingCLTV < delta {
+		return 0, 0, fmt.Errorf("CLTV expiry %d is below the CLTV "+
+			"delta %d", incomingCLTV, delta)
+	}
+
+	return amt, incomingCLTV - delta, nil
+}
+
+// incomingAmount returns the smallest incoming HTLC for which the hop forwards
+// at least the given amount.
+func (p *PaymentRelay) incomingAmount(outgoing uint64) uint64 {
+	return outgoing + uint64(p.FeeBaseMsat) + ceilDiv(
+		outgoing*uint64(p.FeeProportionalMillionths), 1_000_000,
+	)
+}
+
+// ceilDiv returns a / b rounded up.
+func ceilDiv(a, b uint64) uint64 {
+	return (a + b - 1) / b
+}
+
+// encode serialises the PaymentRelay as the CLTV delta, the fee rate and the
+// truncated base fee.
+func (p *PaymentRelay) encode() []byte {
+	b := tlv.EncodeU16(p.CltvExpiryDelta)
+	b = append(b, tlv.EncodeU32(p.FeeProportionalMillionths)...)
+
+	return append(b, tlv.EncodeTu32(p.FeeBaseMsat)...)
+}
+
+func decodePaymentRelay(b []byte) (*PaymentRelay, error) {
+	if len(b) < 6 {
+		return nil, fmt.Errorf("payment_relay too short: %d", len(b))
+	}
+
+	delta, err := tlv.DecodeU16(b[:2])
+	if err != nil {
+		return nil, err
+	}
+
+	rate, err := tlv.DecodeU32(b[2:6])
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := tlv.DecodeTu32(b[6:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &PaymentRelay{
+		FeeBaseMsat:               base,
+		FeeProportionalMillionths: rate,
+		CltvExpiryDelta:           delta,
+	}, nil
+}
+
+// PaymentConstraints is the payment_constraints that the recipient of a
+// blinded path gives each hop in the path so that the path can't be used for
+// payments that the recipient didn't intend.
+type PaymentConstraints struct {
+	// MaxCltvExpiry is the largest CLTV expiry of an incoming HTLC that
+	// the hop accepts. It is the block height after which the path
+	// expires.
+	MaxCltvExpiry uint32
+
+	// HtlcMinimumMsat is the smallest incoming HTLC that the hop accepts.
+	HtlcMinimumMsat uint64
+}
+
+// encode serialises the PaymentConstraints as the max CLTV expiry followed by
+// the truncated HTLC minimum.
+func (p *PaymentConstraints) encode() []byte {
+	return append(
+		tlv.EncodeU32(p.MaxCltvExpiry),
+		tlv.EncodeTu64(p.HtlcMinimumMsat)...,
+	)
+}
+
+func decodePaymentConstraints(b []byte) (*PaymentConstraints, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("payment_constraints too short: %d",
+			len(b))
+	}
+
+	maxCltv, err := tlv.DecodeU32(b[:4])
+	if err != nil {
+		return nil, err
+	}
+
+	minHtlc, err := tlv.DecodeTu64(b[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &PaymentConstraints{
+		MaxCltvExpiry:   maxCltv,
+		HtlcMinimumMsat: minHtlc,
+	}, nil
 }
 
+// EncodePayload encodes the HopData fields as a TLV stream.
 func (h *HopData) EncodePayload() []byte {
-	/*
-		- 2 byte len(ClearData)
-		- ClearData
-		- 2 byte len(Encrypted Data)
-		- Encrypted Data
-		- 0/1 byte:
-			if 0-> no ephemeral key
-			if 1 -> ephemeral key
-	*/
+	s := make(tlv.Stream)
+
+	if h.AmtToForward != 0 {
+		s[amtToForwardType] = tlv.EncodeTu64(h.AmtToForward)
+	}
+
+	if h.OutgoingCLTV != 0 {
+		s[outgoingCLTVType] = tlv.EncodeTu32(h.OutgoingCLTV)
+	}
+
+	if h.ShortChannelID != nil {
+		s[shortChannelIDType] = tlv.EncodeU64(
+			h.ShortChannelID.ToUint64(),
+		)
+	}
+
+	if h.PaymentData != nil {
+		s[paymentDataType] = h.PaymentData.encode()
+	}
+
+	if len(h.PaymentMetadata) != 0 {
+		s[paymentMetadataType] = h.PaymentMetadata
+	}
+
+	if h.TotalAmountMsat != 0 {
+		s[totalAmountType] = tlv.EncodeTu64(h.TotalAmountMsat)
+	}
+
+	if len(h.ClearData) != 0 {
+		s[clearDataType] = h.ClearData
+	}
+
+	if len(h.EncryptedData) != 0 {
+		s[encryptedDataType] = h.EncryptedData
+	}
 
-	payloadLen := 2 + len(h.ClearData) + 2 + len(h.EncryptedData) + 1
-	if h.EphemeralKey != nil {
-		payloadLen += 33
-	}
-
-	payload := make([]byte, payloadLen)
-	offset := 0
-	binary.BigEndian.PutUint16(payload[:2], uint16(len(h.ClearData)))
-	offset += 2
-	copy(payload[offset:offset+len(h.ClearData)], h.ClearData)
-	offset += len(h.ClearData)
-	binary.BigEndian.PutUint16(payload[offset:offset+2], uint16(len(h.EncryptedData)))
-	offset += 2
-	copy(payload[offset:offset+len(h.EncryptedData)], h.EncryptedData)
-	offset += len(h.EncryptedData)
-	payload[offset] = 0
 	if h.EphemeralKey != nil {
-		payload[offset] = 1
-		offset += 1
-		copy(payload[offset:], h.EphemeralKey.SerializeCompressed())
+		s[blindingPointType] = h.EphemeralKey.SerializeCompressed()
 	}
 
-	return payload
+	return s.Encode()
 }
 
+// DecodeHopDataPayload decodes a TLV stream created by EncodePayload.
 func DecodeHopDataPayload(b []byte) (*HopData, error) {
-	/*
-		- 2 byte len(ClearData)
-		- ClearData
-		- 2 byte len(Encrypted Data)
-		- Encrypted Data
-		- 0/1 byte:
-			if 0-> no ephemeral key
-			if 1 -> ephemeral key
-	*/
+	s, err := tlv.DecodeStream(b, hopPayloadTypes...)
+	if err != nil {
+		return nil, err
+	}
 
-	offset := 0
-	clearDataLen := binary.BigEndian.Uint16(b[offset : offset+2])
-	offset += 2
+	data := &HopData{
+		ClearData:       s[clearDataType],
+		EncryptedData:   s[encryptedDataType],
+		PaymentMetadata: s[paymentMetadataType],
+	}
+
+	if k, ok := s[blindingPointType]; ok {
+		key, err := btcec.ParsePubKey(k)
+		if err != nil {
+			return nil, &ErrInvalidRecord{blindingPointType, err}
+		}
+		data.EphemeralKey = key
+	}
+
+	if v, ok := s[amtToForwardType]; ok {
+		data.AmtToForward, err = tlv.DecodeTu64(v)
+		if err != nil {
+			return nil, &ErrInvalidRecord{amtToForwardType, err}
+		}
+	}
 
-	clearData := make([]byte, clearDataLen)
-	copy(clearData[:], b[offset:offset+int(clearDataLen)])
-	offset += int(clearDataLen)
+	if v, ok := s[outgoingCLTVType]; ok {
+		data.OutgoingCLTV, err = tlv.DecodeTu32(v)
+		if err != nil {
+			return nil, &ErrInvalidRecord{outgoingCLTVType, err}
+		}
+	}
 
-	encryptedDataLen := binary.BigEndian.Uint16(b[offset : offset+2])
-	offset += 2
+	if v, ok := s[shortChannelIDType]; ok {
+		scid, err := tlv.DecodeU64(v)
+		if err != nil {
+			return nil, &ErrInvalidRecord{shortChannelIDType, err}
+		}
 
-	encryptedData := make([]byte, encryptedDataLen)
-	copy(encryptedData[:], b[offset:offset+int(encryptedDataLen)])
-	offset += int(encryptedDataLen)
+		chanID := NewShortChannelIDFromInt(scid)
+		data.ShortChannelID = &chanID
+	}
 
-	data := &HopData{
-		ClearData:     clearData,
-		EncryptedData: encryptedData,
+	if v, ok := s[paymentDataType]; ok {
+		data.PaymentData, err = decodePaymentData(v)
+		if err != nil {
+			return nil, &ErrInvalidRecord{paymentDataType, err}
+		}
 	}
 
-	if b[offset] != 0 {
-		offset++
-		key, err := btcec.ParsePubKey(b[offset:])
+	if v, ok := s[totalAmountType]; ok {
+		data.TotalAmountMsat, err = tlv.DecodeTu64(v)
 		if err != nil {
-			return nil, err
+			return nil, &ErrInvalidRecord{totalAmountType, err}
 		}
-		data.EphemeralKey = key
 	}
 
 	return data, nil
@@ -108,7 +480,8 @@ func DecodeHopDataPayload(b []byte) (*HopData, error) {
 // It contains the general payload along with which pubkey it should forward
 // the reset of the onion to.
 type HopPayload struct {
-	// Payload is the payload for this hop.
+	// Payload is the TLV stream for this hop, excluding the forwarding
+	// info.
 	Payload []byte
 
 	// FwdTo is the pub key of the node to which the packet should be
@@ -119,72 +492,240 @@ type HopPayload struct {
 	// the decrypted message from the recipient.
 	// NOTE: This is not included in the serialization of the HopPayload.
 	DecryptedDataFromRecipient []byte
-}
 
-// Serialize the HopPayload. Since this is just an example, let's use a very
-// basic encoding:
-//  	- 2 byte len field for payload len
-// 	- payload
-// 	- 33 byte for FwdTo pub key. Set to all zeros for final hop.
-func (h *HopPayload) Serialize() []byte {
-	b := make([]byte, 2+len(h.Payload)+33)
+	// Data is the decoded Payload.
+	// NOTE: This is not included in the serialization of the HopPayload.
+	Data *HopData
+
+	// SharedSecret is the shared secret that the hop derived from the
+	// onion. It is used to send failures back to the origin of the onion.
+	// NOTE: This is not included in the serialization of the HopPayload.
+	SharedSecret [32]byte
+
+	// PathID is the path ID that the recipient of a blinded path set for
+	// itself in the encrypted data of the final hop.
+	// NOTE: This is not included in the serialization of the HopPayload.
+	PathID []byte
+
+	// RecipientData is the decrypted EncryptedData of a hop in a blinded
+	// path.
+	// NOTE: This is not included in the serialization of the HopPayload.
+	RecipientData *RecipientData
+}
 
-	payloadLen := make([]byte, 2)
-	binary.BigEndian.PutUint16(payloadLen, uint16(len(h.Payload)))
+// ErrorEncrypter returns an ErrorEncrypter that the hop can use to create or
+// forward a failure packet for the onion that this payload came from.
+func (h *HopPayload) ErrorEncrypter() *ErrorEncrypter {
+	return NewErrorEncrypter(h.SharedSecret)
+}
 
-	copy(b[:2], payloadLen)
-	copy(b[2:2+len(h.Payload)], h.Payload)
+// Serialize the HopPayload. The FwdTo record is merged into the Payload TLV
+// stream so that the hop sees a single TLV stream.
+func (h *HopPayload) Serialize() ([]byte, error) {
+	s, err := tlv.DecodeStream(h.Payload, hopPayloadTypes...)
+	if err != nil {
+		return nil, err
+	}
 
 	if h.FwdTo != nil {
-		copy(b[2+len(h.Payload):], h.FwdTo.SerializeCompressed())
-	} else {
-		var empty [33]byte
-		copy(b[2+len(h.Payload):], empty[:])
+		s[fwdToType] = h.FwdTo.SerializeCompressed()
 	}
 
-	return b
+	return s.Encode(), nil
 }
 
 func DeserializeHopPayload(b []byte) (*HopPayload, error) {
-	if len(b) < 2+33 {
-		return nil, fmt.Errorf("insufficient length")
+	s, err := tlv.DecodeStream(b, hopPayloadTypes...)
+	if err != nil {
+		return nil, err
 	}
 
-	payloadLen := binary.BigEndian.Uint16(b[:2])
-
-	payload := make([]byte, payloadLen)
-	copy(payload[:], b[2:2+payloadLen])
-
-	pubkey := b[2+payloadLen:]
-	var (
-		temp [33]byte
-		pk   *btcec.PublicKey
-		err  error
-	)
-	if !bytes.Equal(pubkey, temp[:]) {
-		pk, err = btcec.ParsePubKey(pubkey)
+	var pk *btcec.PublicKey
+	if k, ok := s[fwdToType]; ok {
+		pk, err = btcec.ParsePubKey(k)
 		if err != nil {
-			return nil, err
+			return nil, &ErrInvalidRecord{fwdToType, err}
 		}
+
+		delete(s, fwdToType)
 	}
 
 	return &HopPayload{
 		FwdTo:   pk,
-		Payload: payload,
+		Payload: s.Encode(),
 	}, nil
 }
 
+// RecipientData is the data that the recipient of a blinded path encrypts for
+// each hop in the path.
+type RecipientData struct {
+	// Payload is the message from the recipient for this hop.
+	Payload []byte
+
+	// NextNodeID is the pub key of the node to which the packet should be
+	// forwarded to. It is nil for the final hop.
+	NextNodeID *btcec.PublicKey
+
+	// ShortChannelID may be used instead of NextNodeID to identify the
+	// channel over which the packet should be forwarded.
+	ShortChannelID *ShortChannelID
+
+	// PathID is set by the recipient for itself in the final hop so that
+	// it can tell that the onion was built from a path that it issued.
+	PathID []byte
+
+	// NextPathKeyOverride replaces the path key that the hop would derive
+	// for the next node. It joins the path to another blinded path that
+	// starts at the next node.
+	NextPathKeyOverride *btcec.PublicKey
+
+	// PaymentRelay is the policy that the hop uses to work out the amount
+	// and CLTV to forward.
+	PaymentRelay *PaymentRelay
+
+	// PaymentConstraints are the limits on the HTLCs that the hop accepts
+	// over the path.
+	PaymentConstraints *PaymentConstraints
+
+	// AllowedFeatures is the feature bit vector of the features that a
+	// payment over the path may use. Payments don't use any features, so
+	// it is only carried along.
+	AllowedFeatures []byte
+}
+
+// Encode encodes the RecipientData as a TLV stream.
+func (r *RecipientData) Encode() []byte {
+	s := make(tlv.Stream)
+
+	if r.ShortChannelID != nil {
+		s[recipientSCIDType] = tlv.EncodeU64(
+			r.ShortChannelID.ToUint64(),
+		)
+	}
+
+	if r.NextNodeID != nil {
+		s[nextNodeIDType] = r.NextNodeID.SerializeCompressed()
+	}
+
+	if len(r.PathID) != 0 {
+		s[pathIDType] = r.PathID
+	}
+
+	if r.NextPathKeyOverride != nil {
+		s[nextPathKeyOverrideType] =
+			r.NextPathKeyOverride.SerializeCompressed()
+	}
+
+	if r.PaymentRelay != nil {
+		s[paymentRelayType] = r.PaymentRelay.encode()
+	}
+
+	if r.PaymentConstraints != nil {
+		s[paymentConstraintsType] = r.PaymentConstraints.encode()
+	}
+
+	if r.AllowedFeatures != nil {
+		s[allowedFeaturesType] = r.AllowedFeatures
+	}
+
+	if len(r.Payload) != 0 {
+		s[recipientPayloadType] = r.Payload
+	}
+
+	return s.Encode()
+}
+
+// DecodeRecipientData decodes a TLV stream created by RecipientData.Encode.
+func DecodeRecipientData(b []byte) (*RecipientData, error) {
+	s, err := tlv.DecodeStream(b, recipientDataTypes...)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &RecipientData{
+		Payload:         s[recipientPayloadType],
+		PathID:          s[pathIDType],
+		AllowedFeatures: s[allowedFeaturesType],
+	}
+
+	if k, ok := s[nextNodeIDType]; ok {
+		data.NextNodeID, err = btcec.ParsePubKey(k)
+		if err != nil {
+			return nil, &ErrInvalidRecord{nextNodeIDType, err}
+		}
+	}
+
+	if v, ok := s[recipientSCIDType]; ok {
+		scid, err := tlv.DecodeU64(v)
+		if err != nil {
+			return nil, &ErrInvalidRecord{recipientSCIDType, err}
+		}
+
+		chanID := NewShortChannelIDFromInt(scid)
+		data.ShortChannelID = &chanID
+	}
+
+	if k, ok := s[nextPathKeyOverrideType]; ok {
+		data.NextPathKeyOverride, err = btcec.ParsePubKey(k)
+		if err != nil {
+			return nil, &ErrInvalidRecord{nextPathKeyOverrideType, err}
+		}
+	}
+
+	if v, ok := s[paymentRelayType]; ok {
+		data.PaymentRelay, err = decodePaymentRelay(v)
+		if err != nil {
+			return nil, &ErrInvalidRecord{paymentRelayType, err}
+		}
+	}
+
+	if v, ok := s[paymentConstraintsType]; ok {
+		data.PaymentConstraints, err = decodePaymentConstraints(v)
+		if err != nil {
+			return nil, &ErrInvalidRecord{paymentConstraintsType, err}
+		}
+	}
+
+	return data, nil
+}
+
 type BlindedPath struct {
 	EntryNodeID               *btcec.PublicKey
 	BlindedNodeIDs            []*btcec.PublicKey
 	EncryptedData             [][]byte
 	FirstBlindingEphemeralKey *btcec.PublicKey
+
+	// EntryBlindedNodeID is the blinded node ID of the entry node. Onion
+	// messages are sent to the entry node encrypted to this key, while
+	// payments use the EntryNodeID and give the entry node the blinding
+	// point in its payload. It is optional so that it is only encoded if
+	// it is set.
+	EntryBlindedNodeID *btcec.PublicKey
+
+	// EntrySCIDDir identifies the entry node by one of its channels
+	// instead of its pub key. If it is set, the path is encoded in the
+	// compact form and the EntryNodeID of the decoded path is nil until
+	// the sender resolves it with ResolveEntryNode.
+	EntrySCIDDir *SCIDDir
+
+	// PayInfo is what it costs to pay over the path. It is set by
+	// BuildBlindedPath.
+	// NOTE: This is not included in the encoding of the BlindedPath, it
+	// is encoded separately and given to the sender alongside the path.
+	PayInfo *BlindedPayInfo
 }
 
 func (b *BlindedPath) String() string {
-	entryUser := UserIndex[string(b.EntryNodeID.SerializeCompressed())]
-	str := fmt.Sprintf("Entry Node: %x - %s\n",
-		b.EntryNodeID.SerializeCompressed(), entryUser)
+	var str string
+	if b.EntryNodeID != nil {
+		entryNode := b.EntryNodeID.SerializeCompressed()
+		str += fmt.Sprintf("Entry Node: %x - %s\n", entryNode,
+			UserIndex[string(entryNode)])
+	}
+
+	if b.EntrySCIDDir != nil {
+		str += fmt.Sprintf("Entry Node Channel: %s\n", b.EntrySCIDDir)
+	}
 
 	str += "Blinded Node IDs:\n"
 	for _, b := range b.BlindedNodeIDs {
@@ -199,14 +740,46 @@ func (b *BlindedPath) String() string {
 	str += fmt.Sprintf("First Blinding Ephemeral Key: %x\n",
 		b.FirstBlindingEphemeralKey.SerializeCompressed())
 
+	if b.EntryBlindedNodeID != nil {
+		str += fmt.Sprintf("Entry Blinded Node ID: %x\n",
+			b.EntryBlindedNodeID.SerializeCompressed())
+	}
+
 	str += fmt.Sprintf("Encoded: %x\n", b.Encode())
 
+	if b.PayInfo != nil {
+		str += b.PayInfo.String()
+	}
+
 	return str
 }
 
+// ResolveEntryNode sets the EntryNodeID of a path in the compact form to the
+// node that its EntrySCIDDir identifies in the given channel table. It does
+// nothing if the EntryNodeID is already known.
+func (b *BlindedPath) ResolveEntryNode(channels *ChannelTable) error {
+	if b.EntryNodeID != nil {
+		return nil
+	}
+
+	if b.EntrySCIDDir == nil {
+		return fmt.Errorf("blinded path has no entry node")
+	}
+
+	entryNode, err := channels.Node(*b.EntrySCIDDir)
+	if err != nil {
+		return fmt.Errorf("unable to resolve entry node: %w", err)
+	}
+	b.EntryNodeID = entryNode
+
+	return nil
+}
+
 func (b *BlindedPath) Encode() []byte {
 	/*
-		33 byte -> entry node pub key
+		33 byte -> entry node pub key, or in the compact form:
+			1 byte -> direction of the entry node
+			8 byte -> short channel ID of the entry node
 		2 byte (numBlind) -> num of blinded keys
 		33 * numBlind -> blinded keys
 		numBlind + 1{
@@ -214,18 +787,34 @@ func (b *BlindedPath) Encode() []byte {
 			encrypted data
 		}
 		33 byte -> first ephemeral key
+		optional 33 byte -> entry blinded node ID
 	*/
-	totalLen := 33 + 2 + (33 * len(b.BlindedNodeIDs)) + 33
+	entryLen := 33
+	if b.EntrySCIDDir != nil {
+		entryLen = 9
+	}
+
+	totalLen := entryLen + 2 + (33 * len(b.BlindedNodeIDs)) + 33
 	for _, data := range b.EncryptedData {
 		totalLen += 2 + len(data)
 	}
+	if b.EntryBlindedNodeID != nil {
+		totalLen += 33
+	}
 
 	payload := make([]byte, totalLen)
-	copy(payload[:33], b.EntryNodeID.SerializeCompressed())
+	if b.EntrySCIDDir != nil {
+		payload[0] = b.EntrySCIDDir.Direction
+		binary.BigEndian.PutUint64(
+			payload[1:9], b.EntrySCIDDir.SCID.ToUint64(),
+		)
+	} else {
+		copy(payload[:33], b.EntryNodeID.SerializeCompressed())
+	}
 	binary.BigEndian.PutUint16(
-		payload[33:35], uint16(len(b.BlindedNodeIDs)),
+		payload[entryLen:entryLen+2], uint16(len(b.BlindedNodeIDs)),
 	)
-	offset := 35
+	offset := entryLen + 2
 	for _, b := range b.BlindedNodeIDs {
 		copy(
 			payload[offset:offset+33],
@@ -242,14 +831,24 @@ func (b *BlindedPath) Encode() []byte {
 		offset += len(b)
 	}
 
-	copy(payload[offset:], b.FirstBlindingEphemeralKey.SerializeCompressed())
+	copy(
+		payload[offset:offset+33],
+		b.FirstBlindingEphemeralKey.SerializeCompressed(),
+	)
+	offset += 33
+
+	if b.EntryBlindedNodeID != nil {
+		copy(payload[offset:], b.EntryBlindedNodeID.SerializeCompressed())
+	}
 
 	return payload
 }
 
 func DecodeBlindedPath(b []byte) (*BlindedPath, error) {
 	/*
-		33 byte -> entry node pub key
+		33 byte -> entry node pub key, or in the compact form:
+			1 byte -> direction of the entry node
+			8 byte -> short channel ID of the entry node
 		2 byte (numBlind) -> num of blinded keys
 		33 * numBlind -> blinded keys
 		numBlind + 1{
@@ -257,17 +856,54 @@ func DecodeBlindedPath(b []byte) (*BlindedPath, error) {
 			encrypted data
 		}
 		33 byte -> first ephemeral key
+		optional 33 byte -> entry blinded node ID
 	*/
-	entryNode, err := btcec.ParsePubKey(b[:33])
-	if err != nil {
-		return nil, err
+	// The path may come from an untrusted peer, such as the reply path in
+	// an onion message, so every length is checked before it is used.
+	errTooShort := fmt.Errorf("blinded path too short: %d bytes", len(b))
+	if len(b) < 1 {
+		return nil, errTooShort
+	}
+
+	// A compressed pub key starts with 2 or 3, so a 0 or 1 is the
+	// direction of the compact form.
+	var (
+		entryNode    *btcec.PublicKey
+		entrySCIDDir *SCIDDir
+		err          error
+	)
+	entryLen := 33
+	if b[0] == 0 || b[0] == 1 {
+		entryLen = 9
+	}
+
+	if len(b) < entryLen+2 {
+		return nil, errTooShort
 	}
 
-	numBlinded := binary.BigEndian.Uint16(b[33:35])
+	if entryLen == 9 {
+		entrySCIDDir = &SCIDDir{
+			SCID: NewShortChannelIDFromInt(
+				binary.BigEndian.Uint64(b[1:9]),
+			),
+			Direction: b[0],
+		}
+	} else {
+		entryNode, err = btcec.ParsePubKey(b[:33])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	numBlinded := binary.BigEndian.Uint16(b[entryLen : entryLen+2])
 	blindedPoints := make([]*btcec.PublicKey, numBlinded)
 
-	offset := 35
+	offset := entryLen + 2
 	for i := 0; i < int(numBlinded); i++ {
+		if len(b) < offset+33 {
+			return nil, errTooShort
+		}
+
 		point, err := btcec.ParsePubKey(b[offset : offset+33])
 		if err != nil {
 			return nil, err
@@ -279,9 +915,17 @@ func DecodeBlindedPath(b []byte) (*BlindedPath, error) {
 
 	encryptedData := make([][]byte, numBlinded+1)
 	for i := 0; i < int(numBlinded)+1; i++ {
+		if len(b) < offset+2 {
+			return nil, errTooShort
+		}
+
 		l := binary.BigEndian.Uint16(b[offset : offset+2])
 		offset += 2
 
+		if len(b) < offset+int(l) {
+			return nil, errTooShort
+		}
+
 		data := make([]byte, l)
 		copy(data[:], b[offset:offset+int(l)])
 		offset += int(l)
@@ -289,6 +933,16 @@ func DecodeBlindedPath(b []byte) (*BlindedPath, error) {
 		encryptedData[i] = data
 	}
 
+	var entryBlindedNodeID *btcec.PublicKey
+	if len(b) == offset+66 {
+		entryBlindedNodeID, err = btcec.ParsePubKey(b[offset+33:])
+		if err != nil {
+			return nil, err
+		}
+
+		b = b[:offset+33]
+	}
+
 	point, err := btcec.ParsePubKey(b[offset:])
 	if err != nil {
 		return nil, err
@@ -299,5 +953,215 @@ func DecodeBlindedPath(b []byte) (*BlindedPath, error) {
 		BlindedNodeIDs:            blindedPoints,
 		EncryptedData:             encryptedData,
 		FirstBlindingEphemeralKey: point,
+		EntryBlindedNodeID:        entryBlindedNodeID,
+		EntrySCIDDir:              entrySCIDDir,
 	}, nil
 }
+
+// EncodeBlindedPaths encodes a list of blinded paths, such as the paths in an
+// invoice, along with the pay info of each path.
+func EncodeBlindedPaths(paths []*BlindedPath) []byte {
+	/*
+		2 byte (numPaths) -> num of paths
+		numPaths {
+			2 byte len -> len of encoded path
+			encoded path
+			2 byte len -> len of encoded pay info, 0 if none
+			encoded pay info
+		}
+	*/
+	b := tlv.EncodeU16(uint16(len(paths)))
+	for _, path := range paths {
+		encoded := path.Encode()
+		b = append(b, tlv.EncodeU16(uint16(len(encoded)))...)
+		b = append(b, encoded...)
+
+		var payInfo []byte
+		if path.PayInfo != nil {
+			payInfo = path.PayInfo.Encode()
+		}
+		b = append(b, tlv.EncodeU16(uint16(len(payInfo)))...)
+		b = append(b, payInfo...)
+	}
+
+	return b
+}
+
+// DecodeBlindedPaths decodes a list of blinded paths created by
+// EncodeBlindedPaths.
+func DecodeBlindedPaths(b []byte) ([]*BlindedPath, error) {
+	errTooShort := fmt.Errorf("blinded paths too short: %d bytes", len(b))
+	if len(b) < 2 {
+		return nil, errTooShort
+	}
+
+	numPaths := binary.BigEndian.Uint16(b[:2])
+	offset := 2
+
+	// readRecord reads a record with a 2 byte length prefix.
+	readRecord := func() ([]byte, error) {
+		if len(b) < offset+2 {
+			return nil, errTooShort
+		}
+
+		l := int(binary.BigEndian.Uint16(b[offset : offset+2]))
+		offset += 2
+
+		if len(b) < offset+l {
+			return nil, errTooShort
+		}
+
+		record := b[offset : offset+l]
+		offset += l
+
+		return record, nil
+	}
+
+	paths := make([]*BlindedPath, numPaths)
+	for i := range paths {
+		encoded, err := readRecord()
+		if err != nil {
+			return nil, err
+		}
+
+		paths[i], err = DecodeBlindedPath(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %d: %w", i, err)
+		}
+
+		payInfo, err := readRecord()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(payInfo) == 0 {
+			continue
+		}
+
+		paths[i].PayInfo, err = DecodeBlindedPayInfo(payInfo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pay info for path %d: "+
+				"%w", i, err)
+		}
+	}
+
+	if offset != len(b) {
+		return nil, fmt.Errorf("%d trailing bytes after blinded paths",
+			len(b)-offset)
+	}
+
+	return paths, nil
+}
+
+// BlindedPayInfo is the blinded_payinfo of a blinded path. It aggregates the
+// payment relay and constraints of the hops in the path so that the sender can
+// pay over the path as if it were a single hop without learning the policy of
+// each hop.
+type BlindedPayInfo struct {
+	// FeeBaseMsat is the base fee for the whole path.
+	FeeBaseMsat uint32
+
+	// FeeProportionalMillionths is the fee rate for the whole path.
+	FeeProportionalMillionths uint32
+
+	// CltvExpiryDelta is the sum of the CLTV deltas of the hops in the
+	// path.
+	CltvExpiryDelta uint16
+
+	// HtlcMinimumMsat is the smallest HTLC that the introduction node
+	// accepts over the path.
+	HtlcMinimumMsat uint64
+
+	// HtlcMaximumMsat is the largest HTLC that the introduction node
+	// accepts over the path.
+	HtlcMaximumMsat uint64
+
+	// Features are the features that the sender must support to pay over
+	// the path.
+	Features []byte
+}
+
+// IntroductionHTLC returns the amount and CLTV expiry of the HTLC that must be
+// delivered to the introduction node of the path for the recipient to receive
+// the given amount and CLTV expiry.
+func (p *BlindedPayInfo) IntroductionHTLC(amt uint64,
+	cltv uint32) (uint64, uint32, error) {
+
+	introAmt := amt + uint64(p.FeeBaseMsat) + ceilDiv(
+		amt*uint64(p.FeeProportionalMillionths), 1_000_000,
+	)
+
+	if introAmt < p.HtlcMinimumMsat || introAmt > p.HtlcMaximumMsat {
+		return 0, 0, fmt.Errorf("amount %d for the introduction node "+
+			"is outside of the path's range [%d, %d]", introAmt,
+			p.HtlcMinimumMsat, p.HtlcMaximumMsat)
+	}
+
+	return introAmt, cltv + uint32(p.CltvExpiryDelta), nil
+}
+
+func (p *BlindedPayInfo) String() string {
+	str := fmt.Sprintf("Pay Info: fee base %d msat, fee rate %d ppm, "+
+		"cltv delta %d, htlc range [%d, %d] msat\n", p.FeeBaseMsat,
+		p.FeeProportionalMillionths, p.CltvExpiryDelta,
+		p.HtlcMinimumMsat, p.HtlcMaximumMsat)
+
+	if len(p.Features) != 0 {
+		str += fmt.Sprintf("Features: %x\n", p.Features)
+	}
+
+	str += fmt.Sprintf("Encoded Pay Info: %x\n", p.Encode())
+
+	return str
+}
+
+// Encode serialises the BlindedPayInfo in the blinded_payinfo format of BOLT
+// 12.
+func (p *BlindedPayInfo) Encode() []byte {
+	/*
+		4 byte -> fee base
+		4 byte -> fee rate
+		2 byte -> cltv expiry delta
+		8 byte -> htlc minimum
+		8 byte -> htlc maximum
+		2 byte -> len of features
+		features
+	*/
+	b := tlv.EncodeU32(p.FeeBaseMsat)
+	b = append(b, tlv.EncodeU32(p.FeeProportionalMillionths)...)
+	b = append(b, tlv.EncodeU16(p.CltvExpiryDelta)...)
+	b = append(b, tlv.EncodeU64(p.HtlcMinimumMsat)...)
+	b = append(b, tlv.EncodeU64(p.HtlcMaximumMsat)...)
+	b = append(b, tlv.EncodeU16(uint16(len(p.Features)))...)
+
+	return append(b, p.Features...)
+}
+
+// DecodeBlindedPayInfo decodes a BlindedPayInfo created by Encode.
+func DecodeBlindedPayInfo(b []byte) (*BlindedPayInfo, error) {
+	if len(b) < 28 {
+		return nil, fmt.Errorf("blinded pay info too short: %d bytes",
+			len(b))
+	}
+
+	featuresLen := int(binary.BigEndian.Uint16(b[26:28]))
+	if len(b) != 28+featuresLen {
+		return nil, fmt.Errorf("blinded pay info has %d bytes of "+
+			"features, expected %d", len(b)-28, featuresLen)
+	}
+
+	p := &BlindedPayInfo{
+		FeeBaseMsat:               binary.BigEndian.Uint32(b[:4]),
+		FeeProportionalMillionths: binary.BigEndian.Uint32(b[4:8]),
+		CltvExpiryDelta:           binary.BigEndian.Uint16(b[8:10]),
+		HtlcMinimumMsat:           binary.BigEndian.Uint64(b[10:18]),
+		HtlcMaximumMsat:           binary.BigEndian.Uint64(b[18:26]),
+	}
+
+	if featuresLen > 0 {
+		p.Features = make([]byte, featuresLen)
+		copy(p.Features, b[28:])
+	}
+
+	return p, nil
+}
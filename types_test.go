@@ -12,12 +12,17 @@ import (
 func TestSerializeDeserializeHopPayload(t *testing.T) {
 	pk, _ := btcec.NewPrivateKey()
 
+	hopData := &HopData{
+		ClearData: []byte("a message for you"),
+	}
+
 	hopPayload := &HopPayload{
-		Payload: []byte("a message for you"),
+		Payload: hopData.EncodePayload(),
 		FwdTo:   pk.PubKey(),
 	}
 
-	b := hopPayload.Serialize()
+	b, err := hopPayload.Serialize()
+	require.NoError(t, err)
 
 	hp2, err := DeserializeHopPayload(b)
 	require.NoError(t, err)
@@ -27,16 +32,111 @@ func TestSerializeDeserializeHopPayload(t *testing.T) {
 
 	// Also test empty FwdTo:
 	hopPayload = &HopPayload{
-		Payload: []byte("a message for you"),
+		Payload: hopData.EncodePayload(),
 	}
 
-	b = hopPayload.Serialize()
+	b, err = hopPayload.Serialize()
+	require.NoError(t, err)
 
 	hp2, err = DeserializeHopPayload(b)
 	require.NoError(t, err)
 
 	require.True(t, bytes.Equal(hopPayload.Payload[:], hp2.Payload[:]))
 	require.Nil(t, hp2.FwdTo)
+
+	// A payload that is not a valid TLV stream should be rejected.
+	hopPayload = &HopPayload{
+		Payload: []byte("a message for you"),
+	}
+
+	_, err = hopPayload.Serialize()
+	require.Error(t, err)
+}
+
+func TestEncodeDecodeRecipientData(t *testing.T) {
+	pk, _ := btcec.NewPrivateKey()
+
+	tests := []*RecipientData{
+		{
+			Payload: []byte("hi from the recipient"),
+		},
+		{
+			Payload:    []byte("hi from the recipient"),
+			NextNodeID: pk.PubKey(),
+		},
+		{
+			NextNodeID: pk.PubKey(),
+			PaymentRelay: &PaymentRelay{
+				FeeBaseMsat:               1000,
+				FeeProportionalMillionths: 100,
+				CltvExpiryDelta:           40,
+			},
+			PaymentConstraints: &PaymentConstraints{
+				MaxCltvExpiry:   800000,
+				HtlcMinimumMsat: 1,
+			},
+		},
+		{
+			PathID:             []byte("path id"),
+			PaymentRelay:       &PaymentRelay{},
+			PaymentConstraints: &PaymentConstraints{},
+		},
+		{
+			NextNodeID:          pk.PubKey(),
+			NextPathKeyOverride: pk.PubKey(),
+		},
+		{
+			PathID:          []byte("path id"),
+			AllowedFeatures: []byte{},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			rd, err := DecodeRecipientData(test.Encode())
+			require.NoError(t, err)
+			require.Equal(t, test, rd)
+		})
+	}
+}
+
+func TestPaymentRelayForwardAmount(t *testing.T) {
+	tests := []struct {
+		relay    PaymentRelay
+		incoming uint64
+		expected uint64
+	}{
+		{PaymentRelay{}, 1000, 1000},
+		{PaymentRelay{FeeBaseMsat: 1000}, 5000, 4000},
+		{PaymentRelay{FeeProportionalMillionths: 1_000_000}, 2000, 1000},
+		{PaymentRelay{FeeProportionalMillionths: 1_000_000}, 2001, 1001},
+		{PaymentRelay{
+			FeeBaseMsat:               500,
+			FeeProportionalMillionths: 200,
+		}, 100520, 100000},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			amt, err := test.relay.ForwardAmount(test.incoming)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, amt)
+		})
+	}
+
+	// The incoming amount must at least cover the base fee.
+	_, err := (&PaymentRelay{FeeBaseMsat: 1000}).ForwardAmount(999)
+	require.Error(t, err)
+
+	// The CLTV delta is taken off the incoming CLTV expiry.
+	relay := &PaymentRelay{FeeBaseMsat: 1000, CltvExpiryDelta: 40}
+	amt, cltv, err := relay.Forward(5000, 1040)
+	require.NoError(t, err)
+	require.EqualValues(t, 4000, amt)
+	require.EqualValues(t, 1000, cltv)
+
+	_, _, err = relay.Forward(5000, 39)
+	require.Error(t, err)
 }
 
 func TestBlindedPathEncodeDecode(t *testing.T) {
@@ -65,6 +165,105 @@ func TestBlindedPathEncodeDecode(t *testing.T) {
 	require.NoError(t, err)
 
 	require.Equal(t, bp, bp2)
+
+	// A truncated path is rejected.
+	for i := 0; i < len(b); i++ {
+		_, err := DecodeBlindedPath(b[:i])
+		require.Error(t, err)
+	}
+
+	// The entry node's blinded node ID is optional.
+	pk5, _ := btcec.NewPrivateKey()
+	bp.EntryBlindedNodeID = pk5.PubKey()
+
+	b2 := bp.Encode()
+	require.Len(t, b2, len(b)+33)
+
+	bp2, err = DecodeBlindedPath(b2)
+	require.NoError(t, err)
+	require.Equal(t, bp, bp2)
+
+	// In the compact form, the entry node is only given by one of its
+	// channels and must be resolved by the sender.
+	table := NewChannelTable()
+	table.AddChannel(ShortChannelID{BlockHeight: 1}, pk1.PubKey(),
+		pk5.PubKey())
+
+	dir, ok := table.SCIDDir(pk1.PubKey())
+	require.True(t, ok)
+	bp.EntrySCIDDir = &dir
+
+	b3 := bp.Encode()
+	require.Len(t, b3, len(b2)-24)
+
+	bp2, err = DecodeBlindedPath(b3)
+	require.NoError(t, err)
+	require.Nil(t, bp2.EntryNodeID)
+	require.Equal(t, bp.EntrySCIDDir, bp2.EntrySCIDDir)
+
+	require.Error(t, bp2.ResolveEntryNode(NewChannelTable()))
+	require.NoError(t, bp2.ResolveEntryNode(table))
+	require.Equal(t, bp, bp2)
+
+	_, err = DecodeBlindedPath(b3[:10])
+	require.Error(t, err)
+}
+
+func TestBlindedPayInfoEncodeDecode(t *testing.T) {
+	payInfo := &BlindedPayInfo{
+		FeeBaseMsat:               1501,
+		FeeProportionalMillionths: 301,
+		CltvExpiryDelta:           60,
+		HtlcMinimumMsat:           2502,
+		HtlcMaximumMsat:           1000000,
+		Features:                  []byte{0x01, 0x02},
+	}
+
+	b := payInfo.Encode()
+	require.Len(t, b, 30)
+
+	decoded, err := DecodeBlindedPayInfo(b)
+	require.NoError(t, err)
+	require.Equal(t, payInfo, decoded)
+
+	for i := 0; i < len(b); i++ {
+		_, err := DecodeBlindedPayInfo(b[:i])
+		require.Error(t, err)
+	}
+
+	_, err = DecodeBlindedPayInfo(append(b, 0x00))
+	require.Error(t, err)
+}
+
+func TestBlindedPathsEncodeDecode(t *testing.T) {
+	sessionKey, _ := btcec.NewPrivateKey()
+	withPayInfo, err := BuildBlindedPath(sessionKey, []*HopData{
+		{PubKey: Users[Charlie].PubKey},
+		{PubKey: Users[Dave].PubKey},
+	})
+	require.NoError(t, err)
+
+	withoutPayInfo, err := BuildBlindedPath(sessionKey, []*HopData{
+		{PubKey: Users[Bob].PubKey},
+		{PubKey: Users[Dave].PubKey},
+	})
+	require.NoError(t, err)
+	withoutPayInfo.PayInfo = nil
+
+	paths := []*BlindedPath{withPayInfo, withoutPayInfo}
+	b := EncodeBlindedPaths(paths)
+
+	decoded, err := DecodeBlindedPaths(b)
+	require.NoError(t, err)
+	require.Equal(t, paths, decoded)
+
+	for i := 0; i < len(b); i++ {
+		_, err := DecodeBlindedPaths(b[:i])
+		require.Error(t, err)
+	}
+
+	_, err = DecodeBlindedPaths(append(b, 0x00))
+	require.Error(t, err)
 }
 
 func TestBlindedPathEncodeDecode2(t *testing.T) {
@@ -119,6 +318,24 @@ func TestEncodeDecodeHopDataPayload(t *testing.T) {
 			EncryptedData: []byte("encrypted data"),
 			EphemeralKey:  pk1.PubKey(),
 		},
+		{
+			AmtToForward: 15000,
+			OutgoingCLTV: 1500,
+			ShortChannelID: &ShortChannelID{
+				BlockHeight: 700000,
+				TxIndex:     12,
+				OutputIndex: 1,
+			},
+		},
+		{
+			AmtToForward: 10000,
+			OutgoingCLTV: 1000,
+			PaymentData: &PaymentData{
+				PaymentSecret: [32]byte{1, 2, 3},
+				TotalMsat:     20000,
+			},
+			PaymentMetadata: []byte("metadata"),
+		},
 	}
 
 	for i, test := range tests {
@@ -129,6 +346,13 @@ func TestEncodeDecodeHopDataPayload(t *testing.T) {
 
 			require.True(t, bytes.Equal(test.EncryptedData, hd.EncryptedData))
 			require.True(t, bytes.Equal(test.ClearData, hd.ClearData))
+			require.Equal(t, test.AmtToForward, hd.AmtToForward)
+			require.Equal(t, test.OutgoingCLTV, hd.OutgoingCLTV)
+			require.Equal(t, test.ShortChannelID, hd.ShortChannelID)
+			require.Equal(t, test.PaymentData, hd.PaymentData)
+			require.True(
+				t, bytes.Equal(test.PaymentMetadata, hd.PaymentMetadata),
+			)
 			if test.EphemeralKey == nil {
 				require.Nil(t, hd.EphemeralKey)
 			} else {
@@ -137,3 +361,34 @@ func TestEncodeDecodeHopDataPayload(t *testing.T) {
 		})
 	}
 }
+
+// TestHopDataPayloadEncoding checks that the standard BOLT 4 fields are encoded
+// as expected using the first hop payload from the BOLT 4 test vector.
+func TestHopDataPayloadEncoding(t *testing.T) {
+	hd := &HopData{
+		AmtToForward:   15000,
+		OutgoingCLTV:   1500,
+		ShortChannelID: &ShortChannelID{OutputIndex: 1},
+	}
+
+	require.Equal(
+		t, "02023a98040205dc06080000000000000001",
+		hex.EncodeToString(hd.EncodePayload()),
+	)
+
+	// The final hop of a blinded path is given the total amount.
+	hd = &HopData{
+		AmtToForward:    100000,
+		OutgoingCLTV:    749000,
+		TotalAmountMsat: 150000,
+	}
+
+	b := hd.EncodePayload()
+	require.Equal(
+		t, "02030186a004030b6dc812030249f0", hex.EncodeToString(b),
+	)
+
+	decoded, err := DecodeHopDataPayload(b)
+	require.NoError(t, err)
+	require.Equal(t, hd, decoded)
+}
@@ -2,7 +2,6 @@ package onion
 
 import (
 	"encoding/hex"
-	"fmt"
 	"github.com/btcsuite/btcd/btcec/v2"
 	"strings"
 )
@@ -22,72 +21,99 @@ const (
 )
 
 var (
+	// DefaultRegistry holds the example users along with any users that
+	// are loaded from a keystore.
+	DefaultRegistry *Registry
+
+	// Users and UserIndex are the maps of DefaultRegistry.
 	Users     map[string]*User
 	UserIndex map[string]string
+
+	// Channels is the channel table for the example channel graph:
+	// 	Alice <-> Bob <-> Charlie <-> Dave <-> Eve
+	Channels *ChannelTable
 )
 
 type User struct {
-	Name    string
-	privKey *btcec.PrivateKey
-	PubKey  *btcec.PublicKey
+	Name   string
+	PubKey *btcec.PublicKey
+
+	// Signer performs the operations with the user's private key that are
+	// needed to process onions.
+	Signer Signer
+
+	// Channels is the user's local channel table which is used to resolve
+	// the short channel ID that an onion should be forwarded over.
+	Channels *ChannelTable
+
+	// ReplayLog is used to detect onions that the user has already
+	// processed. If it is nil, replays are not detected.
+	ReplayLog ReplayLog
+
+	// MessageHandler is given the onion messages that the user is the
+	// final hop of. If it is nil, such messages are only returned by
+	// PeelMessage.
+	MessageHandler MessageHandler
+
+	// PathStore holds the path IDs of the blinded paths that the user has
+	// issued. If it is set, payment onions that reach the user over a
+	// blinded path must carry one of them. If it is nil, path IDs are not
+	// checked. Onion messages are not checked, since every message
+	// travels over a blinded path that the sender may have built itself.
+	PathStore PathStore
 }
 
-func GetUser(username string) (*User, error) {
-	user, ok := Users[strings.ToUpper(username)]
-	if !ok {
-		return nil, fmt.Errorf("no user named %s", username)
+// NewUser creates a user with the given alias whose key is held by the signer.
+func NewUser(name string, signer Signer) *User {
+	return &User{
+		Name:     strings.ToUpper(name),
+		PubKey:   signer.PubKey(),
+		Signer:   signer,
+		Channels: Channels,
 	}
+}
 
-	return user, nil
+// GetUser returns the user in the DefaultRegistry with the given alias or pub
+// key.
+func GetUser(username string) (*User, error) {
+	return DefaultRegistry.Get(username)
 }
 
 func init() {
-	Users = make(map[string]*User)
-	UserIndex = make(map[string]string)
-
-	// Read alice pubkey.
-	ab, _ := hex.DecodeString(alicePk)
-	priv, pub := btcec.PrivKeyFromBytes(ab)
-	UserIndex[string(pub.SerializeCompressed())] = Alice
-	Users[Alice] = &User{
-		Name:    Alice,
-		privKey: priv,
-		PubKey:  pub,
-	}
+	DefaultRegistry = NewRegistry()
+	Users = DefaultRegistry.Users
+	UserIndex = DefaultRegistry.UserIndex
 
-	bb, _ := hex.DecodeString(bobPk)
-	priv, pub = btcec.PrivKeyFromBytes(bb)
-	UserIndex[string(pub.SerializeCompressed())] = Bob
-	Users[Bob] = &User{
-		Name:    Bob,
-		privKey: priv,
-		PubKey:  pub,
-	}
+	for name, pk := range map[string]string{
+		Alice:   alicePk,
+		Bob:     bobPk,
+		Charlie: charliePk,
+		Dave:    davePk,
+		Eve:     evePk,
+	} {
+		b, _ := hex.DecodeString(pk)
+		priv, _ := btcec.PrivKeyFromBytes(b)
 
-	cb, _ := hex.DecodeString(charliePk)
-	priv, pub = btcec.PrivKeyFromBytes(cb)
-	UserIndex[string(pub.SerializeCompressed())] = Charlie
-	Users[Charlie] = &User{
-		Name:    Charlie,
-		privKey: priv,
-		PubKey:  pub,
+		err := DefaultRegistry.Add(NewUser(name, NewPrivKeySigner(priv)))
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	db, _ := hex.DecodeString(davePk)
-	priv, pub = btcec.PrivKeyFromBytes(db)
-	UserIndex[string(pub.SerializeCompressed())] = Dave
-	Users[Dave] = &User{
-		Name:    Dave,
-		privKey: priv,
-		PubKey:  pub,
+	Channels = NewChannelTable()
+	line := []string{Alice, Bob, Charlie, Dave, Eve}
+	for i := 0; i < len(line)-1; i++ {
+		scid := ShortChannelID{
+			BlockHeight: 100 + uint32(i),
+			TxIndex:     1,
+		}
+
+		Channels.AddChannel(
+			scid, Users[line[i]].PubKey, Users[line[i+1]].PubKey,
+		)
 	}
 
-	eb, _ := hex.DecodeString(evePk)
-	priv, pub = btcec.PrivKeyFromBytes(eb)
-	UserIndex[string(pub.SerializeCompressed())] = Eve
-	Users[Eve] = &User{
-		Name:    Eve,
-		privKey: priv,
-		PubKey:  pub,
+	for _, user := range Users {
+		user.Channels = Channels
 	}
 }
@@ -0,0 +1,992 @@
+package onion
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"onion/tlv"
+	"strconv"
+)
+
+const (
+	// vectorHTLCAmount and vectorHTLCExpiry are the HTLC that is sent over
+	// the blinded path of a route blinding test vector. The test vectors
+	// don't come with a payment, so it is an HTLC that the payment
+	// constraints of every hop in the path accept.
+	vectorHTLCAmount = 1_000_000
+	vectorHTLCExpiry = 748005
+)
+
+// VectorMismatch is returned when a value computed by the library does not
+// match the value in a test vector.
+type VectorMismatch struct {
+	// Section is the section of the test vector, such as "generate" or
+	// "decode".
+	Section string
+
+	// Hop is the index of the hop in the section or -1 if the value does
+	// not belong to a hop.
+	Hop int
+
+	// Field is the name of the mismatching field in the test vector.
+	Field string
+
+	// Expected is the value in the test vector.
+	Expected string
+
+	// Actual is the value computed by the library.
+	Actual string
+}
+
+func (m *VectorMismatch) Error() string {
+	pos := vectorPos{section: m.Section, hop: m.Hop}
+
+	return fmt.Sprintf("%v: %s does not match", pos, m.Field)
+}
+
+// TestVector is a BOLT 4 JSON test vector, either from the spec or generated
+// from a Scenario. Only the sections that belong to the kind of test vector
+// are set.
+type TestVector struct {
+	Comment string `json:"comment,omitempty"`
+
+	// Generate holds the inputs for constructing an onion or blinded path
+	// along with the expected intermediate values.
+	Generate *vectorSection `json:"generate,omitempty"`
+
+	// Onion and Decode are set for onion construction vectors. Decode is
+	// the list of node keys that process the onion in turn.
+	Onion  string   `json:"onion,omitempty"`
+	Decode []string `json:"decode,omitempty"`
+
+	// Route and Unblind are set for route blinding vectors.
+	Route   *vectorSection `json:"route,omitempty"`
+	Unblind *vectorSection `json:"unblind,omitempty"`
+
+	// Decrypt is set for onion vectors that pay to a blinded path.
+	Decrypt *vectorSection `json:"decrypt,omitempty"`
+
+	// SessionKey, Hops, ErringNode, FailureMessage and Return are set for
+	// error obfuscation vectors.
+	SessionKey     string         `json:"session_key,omitempty"`
+	Hops           []*vectorHop   `json:"hops,omitempty"`
+	ErringNode     int            `json:"erring_node,omitempty"`
+	FailureMessage string         `json:"failure_message,omitempty"`
+	Return         *vectorSection `json:"return,omitempty"`
+}
+
+// vectorSection is a section of a test vector.
+type vectorSection struct {
+	Comment            string         `json:"comment,omitempty"`
+	SessionKey         string         `json:"session_key,omitempty"`
+	AssociatedData     string         `json:"associated_data,omitempty"`
+	IntroductionNodeID string         `json:"introduction_node_id,omitempty"`
+	Blinding           string         `json:"blinding,omitempty"`
+	Hops               []*vectorHop   `json:"hops,omitempty"`
+	Filler             string         `json:"filler,omitempty"`
+	BlindedRoute       *vectorSection `json:"blinded_route,omitempty"`
+	FullRoute          *vectorSection `json:"full_route,omitempty"`
+	Onion              string         `json:"onion,omitempty"`
+}
+
+// vectorHop is a hop in a section of a test vector. Each kind of test vector
+// only sets the fields that it uses.
+type vectorHop struct {
+	Alias               string `json:"alias,omitempty"`
+	PubKey              string `json:"pubkey,omitempty"`
+	NodeID              string `json:"node_id,omitempty"`
+	Payload             string `json:"payload,omitempty"`
+	SessionKey          string `json:"session_key,omitempty"`
+	EncodedTLVs         string `json:"encoded_tlvs,omitempty"`
+	EphemeralPrivKey    string `json:"ephemeral_privkey,omitempty"`
+	EphemeralPubKey     string `json:"ephemeral_pubkey,omitempty"`
+	SharedSecret        string `json:"shared_secret,omitempty"`
+	Rho                 string `json:"rho,omitempty"`
+	Mu                  string `json:"mu,omitempty"`
+	Um                  string `json:"um,omitempty"`
+	Pad                 string `json:"pad,omitempty"`
+	BlindingFactor      string `json:"blinding_factor,omitempty"`
+	EncryptedData       string `json:"encrypted_data,omitempty"`
+	BlindedNodeID       string `json:"blinded_node_id,omitempty"`
+	NodePrivKey         string `json:"node_privkey,omitempty"`
+	BlindedPrivKey      string `json:"blinded_privkey,omitempty"`
+	DecryptedData       string `json:"decrypted_data,omitempty"`
+	NextEphemeralPubKey string `json:"next_ephemeral_pubkey,omitempty"`
+	Onion               string `json:"onion,omitempty"`
+	HMAC                string `json:"hmac,omitempty"`
+	NextBlinding        string `json:"next_blinding,omitempty"`
+	AmmagKey            string `json:"ammag_key,omitempty"`
+	Stream              string `json:"stream,omitempty"`
+	Packet              string `json:"packet,omitempty"`
+
+	NextEphemeralPubKeyOverride string `json:"next_ephemeral_pubkey_override,omitempty"`
+
+	// TLVs holds the decoded records of the hop that the BOLT test vectors
+	// give alongside the encoded ones.
+	TLVs json.RawMessage `json:"tlvs,omitempty"`
+}
+
+// ParseTestVector parses a BOLT 4 JSON test vector.
+func ParseTestVector(b []byte) (*TestVector, error) {
+	var v TestVector
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, fmt.Errorf("invalid test vector: %w", err)
+	}
+
+	return &v, nil
+}
+
+// Verify drives the test vector through the library and returns a
+// VectorMismatch for the first value that differs from the test vector.
+func (v *TestVector) Verify() error {
+	switch {
+	case v.Generate != nil && v.Generate.FullRoute != nil:
+		return v.verifyBlindedOnion()
+
+	case v.Generate != nil && v.Unblind != nil:
+		return v.verifyRouteBlinding()
+
+	case v.Generate != nil && v.Onion != "":
+		return v.verifyOnion()
+
+	case v.Return != nil:
+		return v.verifyErrorObfuscation()
+
+	default:
+		return errors.New("unknown test vector format")
+	}
+}
+
+// verifyOnion checks an onion construction vector. The onion is built from
+// the hops' payloads and then processed by each of the hops with Peel.
+func (v *TestVector) verifyOnion() error {
+	pos := vectorPos{section: "generate", hop: -1}
+
+	onion, err := pos.buildOnion(v.Generate, v.Generate.Hops, v.Onion)
+	if err != nil {
+		return err
+	}
+
+	if err := pos.compare("onion", v.Onion, onion.Serialize()); err != nil {
+		return err
+	}
+
+	if len(v.Decode) != len(v.Generate.Hops) {
+		return fmt.Errorf("expected %d decode keys, got %d",
+			len(v.Generate.Hops), len(v.Decode))
+	}
+
+	users := make([]*User, len(v.Decode))
+	for i, key := range v.Decode {
+		users[i], err = vectorPos{section: "decode", hop: i}.user(
+			"node key", key,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return peelRoute("decode", users, v.Generate.Hops, nil, onion)
+}
+
+// verifyRouteBlinding checks a route blinding vector. The blinded path is
+// built with BuildBlindedPath from the hops' encoded TLVs and a payment over
+// the path is then processed by each of the hops with Peel.
+func (v *TestVector) verifyRouteBlinding() error {
+	path, err := buildVectorPath(v.Generate.Hops)
+	if err != nil {
+		return err
+	}
+
+	blindedNodeIDs := append(
+		[]*btcec.PublicKey{path.EntryBlindedNodeID},
+		path.BlindedNodeIDs...,
+	)
+
+	if v.Route != nil {
+		pos := vectorPos{section: "route", hop: -1}
+
+		err := pos.compareAll([]vectorField{
+			{"introduction_node_id", v.Route.IntroductionNodeID,
+				path.EntryNodeID.SerializeCompressed()},
+			{"blinding", v.Route.Blinding,
+				path.FirstBlindingEphemeralKey.SerializeCompressed()},
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(v.Route.Hops) != len(v.Generate.Hops) {
+			return fmt.Errorf("expected %d route hops, got %d",
+				len(v.Generate.Hops), len(v.Route.Hops))
+		}
+
+		for i, hop := range v.Route.Hops {
+			err := pos.at(i).compareAll([]vectorField{
+				{"blinded_node_id", hop.BlindedNodeID,
+					blindedNodeIDs[i].SerializeCompressed()},
+				{"encrypted_data", hop.EncryptedData,
+					path.EncryptedData[i]},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(v.Unblind.Hops) != len(v.Generate.Hops) {
+		return fmt.Errorf("expected %d unblind hops, got %d",
+			len(v.Generate.Hops), len(v.Unblind.Hops))
+	}
+
+	users := make([]*User, len(v.Unblind.Hops))
+	for i, hop := range v.Unblind.Hops {
+		pos := vectorPos{section: "unblind", hop: i}
+
+		users[i], err = pos.user("node_privkey", hop.NodePrivKey)
+		if err != nil {
+			return err
+		}
+
+		// The blinded private key is only known to the hop, so it is
+		// checked against the blinded node ID in the path.
+		if hop.BlindedPrivKey != "" {
+			blindedKey, err := pos.privKey(
+				"blinded_privkey", hop.BlindedPrivKey,
+			)
+			if err != nil {
+				return err
+			}
+
+			err = pos.compare(
+				"blinded_privkey",
+				hexKey(blindedKey.PubKey()),
+				blindedNodeIDs[i].SerializeCompressed(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	channels, err := routeChannels(users, v.Generate.Hops)
+	if err != nil {
+		return err
+	}
+
+	// The test vectors don't come with a payment, so the introduction
+	// node is given an HTLC that the constraints of every hop accept.
+	selected := &SelectedPath{
+		Path:        path,
+		Route:       []*btcec.PublicKey{path.EntryNodeID},
+		IntroAmount: vectorHTLCAmount,
+		IntroCLTV:   vectorHTLCExpiry,
+	}
+	sessionKey, err := vectorPos{section: "generate", hop: 0}.privKey(
+		"session_key", v.Generate.Hops[0].SessionKey,
+	)
+	if err != nil {
+		return err
+	}
+
+	onion, _, err := selected.BuildOnion(sessionKey, &HopData{})
+	if err != nil {
+		return err
+	}
+	onion.IncomingAmount = selected.IntroAmount
+	onion.IncomingCLTV = selected.IntroCLTV
+
+	for i, hop := range v.Unblind.Hops {
+		pos := vectorPos{section: "unblind", hop: i}
+
+		users[i].Channels = channels
+		payload, next, err := pos.peel(users, i, onion)
+		if err != nil {
+			return err
+		}
+
+		expected, err := pos.bytes("decrypted_data", hop.DecryptedData)
+		if err != nil {
+			return err
+		}
+
+		data, err := DecodeRecipientData(expected)
+		if err != nil {
+			return fmt.Errorf("%v: invalid decrypted_data: %w", pos,
+				err)
+		}
+
+		// Peel only gives us the records that it knows about, so the
+		// decrypted data from the test vector is compared with them.
+		err = pos.compare(
+			"decrypted_data", hex.EncodeToString(data.Encode()),
+			payload.RecipientData.Encode(),
+		)
+		if err != nil {
+			return err
+		}
+
+		// The path key for the next node is replaced if the next node
+		// starts another path.
+		field, nextPathKey := "next_ephemeral_pubkey",
+			hop.NextEphemeralPubKey
+		if hop.NextEphemeralPubKeyOverride != "" {
+			field, nextPathKey = "next_ephemeral_pubkey_override",
+				hop.NextEphemeralPubKeyOverride
+		}
+
+		err = pos.compareAll([]vectorField{
+			{field, nextPathKey, keyBytes(next.EphemeralKey)},
+		})
+		if err != nil {
+			return err
+		}
+
+		onion = next
+	}
+
+	return nil
+}
+
+// verifyBlindedOnion checks an onion vector that pays to a blinded path. The
+// onion is built from the full route's payloads and then processed by each of
+// the hops with Peel, with the hops in the blinded path using the path key
+// that the previous hop passed on or that is in their payload.
+func (v *TestVector) verifyBlindedOnion() error {
+	hops := v.Generate.FullRoute.Hops
+
+	pos := vectorPos{section: "generate", hop: -1}
+	onion, err := pos.buildOnion(v.Generate, hops, v.Generate.Onion)
+	if err != nil {
+		return err
+	}
+
+	err = pos.compare("onion", v.Generate.Onion, onion.Serialize())
+	if err != nil {
+		return err
+	}
+
+	if len(v.Decrypt.Hops) != len(hops) {
+		return fmt.Errorf("expected %d decrypt hops, got %d",
+			len(hops), len(v.Decrypt.Hops))
+	}
+
+	users := make([]*User, len(v.Decrypt.Hops))
+	for i, hop := range v.Decrypt.Hops {
+		users[i], err = vectorPos{section: "decrypt", hop: i}.user(
+			"node_privkey", hop.NodePrivKey,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return peelRoute("decrypt", users, hops, v.Decrypt.Hops, onion)
+}
+
+// verifyErrorObfuscation checks an error obfuscation vector. The erring node
+// creates the failure packet, each hop on the way back obfuscates it and the
+// sender then attributes it to the erring node.
+func (v *TestVector) verifyErrorObfuscation() error {
+	pos := vectorPos{section: "generate", hop: -1}
+
+	sessionKey, err := pos.privKey("session_key", v.SessionKey)
+	if err != nil {
+		return err
+	}
+
+	pubKeys := make([]*btcec.PublicKey, len(v.Hops))
+	for i, hop := range v.Hops {
+		pubKeys[i], err = pos.at(i).pubKey("pubkey", hop.PubKey)
+		if err != nil {
+			return err
+		}
+	}
+	hops := DeriveHops(sessionKey, pubKeys)
+
+	msg, err := pos.bytes("failure_message", v.FailureMessage)
+	if err != nil {
+		return err
+	}
+
+	if v.ErringNode < 0 || v.ErringNode >= len(hops) ||
+		len(v.Return.Hops) != v.ErringNode+1 {
+
+		return fmt.Errorf("invalid erring node %d", v.ErringNode)
+	}
+
+	packet, err := NewErrorEncrypter(hops[v.ErringNode].SS).failurePacket(
+		msg,
+	)
+	if err != nil {
+		return err
+	}
+
+	for i, hop := range v.Return.Hops {
+		node := v.ErringNode - i
+		pos := vectorPos{section: "return", hop: i}
+
+		encrypter := NewErrorEncrypter(hops[node].SS)
+		packet = encrypter.ObfuscateError(packet)
+
+		err := pos.compareAll([]vectorField{
+			{"shared_secret", hop.SharedSecret, hops[node].SS[:]},
+			{"ammag_key", hop.AmmagKey, encrypter.ammag[:]},
+			{"stream", hop.Stream,
+				pSByteStream(encrypter.ammag[:], len(packet))},
+			{"packet", hop.Packet, packet},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	decrypted, err := NewErrorDecrypter(hops).DecryptError(packet)
+	if err != nil {
+		return err
+	}
+
+	if decrypted.Index != v.ErringNode {
+		return &VectorMismatch{
+			Section:  "decrypt",
+			Hop:      -1,
+			Field:    "erring_node",
+			Expected: strconv.Itoa(v.ErringNode),
+			Actual:   strconv.Itoa(decrypted.Index),
+		}
+	}
+
+	return pos.compare("failure_message", v.FailureMessage, decrypted.Message)
+}
+
+// vectorPos is the position in a test vector of the values being checked.
+type vectorPos struct {
+	section string
+	hop     int
+}
+
+func (p vectorPos) String() string {
+	if p.hop < 0 {
+		return p.section
+	}
+
+	return fmt.Sprintf("%s hop %d", p.section, p.hop)
+}
+
+// at returns the position of the given hop in the same section.
+func (p vectorPos) at(hop int) vectorPos {
+	return vectorPos{section: p.section, hop: hop}
+}
+
+// bytes decodes a hex encoded field.
+func (p vectorPos) bytes(field, value string) ([]byte, error) {
+	b, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("%v: invalid %s: %w", p, field, err)
+	}
+
+	return b, nil
+}
+
+// privKey decodes a hex encoded private key field.
+func (p vectorPos) privKey(field, value string) (*btcec.PrivateKey, error) {
+	b, err := p.bytes(field, value)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) != btcec.PrivKeyBytesLen {
+		return nil, fmt.Errorf("%v: invalid %s: must be %d bytes", p,
+			field, btcec.PrivKeyBytesLen)
+	}
+
+	privKey, _ := btcec.PrivKeyFromBytes(b)
+
+	return privKey, nil
+}
+
+// pubKey decodes a hex encoded public key field.
+func (p vectorPos) pubKey(field, value string) (*btcec.PublicKey, error) {
+	b, err := p.bytes(field, value)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, err := btcec.ParsePubKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%v: invalid %s: %w", p, field, err)
+	}
+
+	return pubKey, nil
+}
+
+// compare returns a VectorMismatch if the hex encoded value from the test
+// vector differs from the value computed by the library.
+func (p vectorPos) compare(field, expected string, actual []byte) error {
+	b, err := p.bytes(field, expected)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(b, actual) {
+		return nil
+	}
+
+	return &VectorMismatch{
+		Section:  p.section,
+		Hop:      p.hop,
+		Field:    field,
+		Expected: expected,
+		Actual:   hex.EncodeToString(actual),
+	}
+}
+
+// vectorField is a field of a test vector along with the value computed by
+// the library.
+type vectorField struct {
+	name     string
+	expected string
+	actual   []byte
+}
+
+// compareAll compares the fields in order and returns the first mismatch.
+// Fields that are not set in the test vector are skipped.
+func (p vectorPos) compareAll(fields []vectorField) error {
+	for _, f := range fields {
+		if f.expected == "" {
+			continue
+		}
+
+		if err := p.compare(f.name, f.expected, f.actual); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildOnion builds an onion from the raw payloads of the given hops with the
+// packet size of the expected onion. Any of the intermediate values of each
+// hop that are set in the test vector are checked along the way.
+func (p vectorPos) buildOnion(gen *vectorSection, vectorHops []*vectorHop,
+	expectedOnion string) (*Onion, error) {
+
+	sessionKey, err := p.privKey("session_key", gen.SessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ad, err := p.bytes("associated_data", gen.AssociatedData)
+	if err != nil {
+		return nil, err
+	}
+
+	packetSize := len(expectedOnion)/2 - onionOverhead
+	if packetSize <= 0 {
+		return nil, fmt.Errorf("%v: invalid onion", p)
+	}
+
+	pubKeys := make([]*btcec.PublicKey, len(vectorHops))
+	for i, hop := range vectorHops {
+		pubKeys[i], err = p.at(i).pubKey("pubkey", hop.PubKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hops := DeriveHops(sessionKey, pubKeys)
+	for i, hop := range vectorHops {
+		hops[i].Payload, err = p.at(i).payload(hop)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.at(i).compareHop(hop, hops[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	err = p.compareAll([]vectorField{
+		{"filler", gen.Filler, genFiller(hops, packetSize)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buildPacket(sessionKey, hops, packetSize, ad)
+}
+
+// compareHop compares the keys derived for a hop with the test vector.
+func (p vectorPos) compareHop(vectorHop *vectorHop, hop *Hop) error {
+	return p.compareAll([]vectorField{
+		{"ephemeral_privkey", vectorHop.EphemeralPrivKey,
+			hop.E.Serialize()},
+		{"ephemeral_pubkey", vectorHop.EphemeralPubKey,
+			hop.E.PubKey().SerializeCompressed()},
+		{"shared_secret", vectorHop.SharedSecret, hop.SS[:]},
+		{"rho", vectorHop.Rho, hop.Rho[:]},
+		{"mu", vectorHop.Mu, hop.Mu[:]},
+		{"um", vectorHop.Um, hop.Um[:]},
+		{"pad", vectorHop.Pad, hop.Pad[:]},
+		{"blinding_factor", vectorHop.BlindingFactor, hop.BF[:]},
+	})
+}
+
+// payload decodes the payload of the hop. The payloads in the test vectors
+// include their length.
+func (p vectorPos) payload(hop *vectorHop) ([]byte, error) {
+	frame, err := p.bytes("payload", hop.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadLen, n, err := tlv.DecodeBigSize(frame)
+	if err != nil || payloadLen != uint64(len(frame)-n) {
+		return nil, fmt.Errorf("%v: invalid payload length", p)
+	}
+
+	return frame[n:], nil
+}
+
+// user returns a user with the hex encoded private key field as its key.
+func (p vectorPos) user(field, value string) (*User, error) {
+	privKey, err := p.privKey(field, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &User{
+		PubKey: privKey.PubKey(),
+		Signer: NewPrivKeySigner(privKey),
+	}, nil
+}
+
+// peel processes the onion with Peel as the user at the given index of the
+// route and checks that it forwards to the next user. The returned onion
+// comes with the HTLC that the user forwards.
+func (p vectorPos) peel(users []*User, i int,
+	onion *Onion) (*HopPayload, *Onion, error) {
+
+	payload, next, err := Peel(users[i], onion)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v: unable to process onion: %w",
+			p, err)
+	}
+
+	final := i == len(users)-1
+	if err := p.checkFinal(final, next); err != nil {
+		return nil, nil, err
+	}
+
+	if !final && (payload.FwdTo == nil ||
+		!payload.FwdTo.IsEqual(users[i+1].PubKey)) {
+
+		return nil, nil, fmt.Errorf("%v: not forwarded to the next "+
+			"hop", p)
+	}
+
+	next.IncomingAmount = payload.Data.AmtToForward
+	next.IncomingCLTV = payload.Data.OutgoingCLTV
+
+	return payload, next, nil
+}
+
+// comparePayload compares the payload that Peel returned with the payload of
+// the hop. The next node is only part of the payload if the hop was given it
+// in its payload rather than a channel to forward over.
+func (p vectorPos) comparePayload(hop *vectorHop, payload *HopPayload) error {
+	b, err := p.payload(hop)
+	if err != nil {
+		return err
+	}
+
+	expected, err := DeserializeHopPayload(b)
+	if err != nil {
+		return fmt.Errorf("%v: invalid payload: %w", p, err)
+	}
+
+	actual := &HopPayload{Payload: payload.Payload}
+	if expected.FwdTo != nil {
+		actual.FwdTo = payload.FwdTo
+	}
+
+	b, err = actual.Serialize()
+	if err != nil {
+		return fmt.Errorf("%v: invalid payload: %w", p, err)
+	}
+
+	return p.compare("payload", hop.Payload, payloadFrame(b))
+}
+
+// peelRoute processes the onion with Peel as each of the users in turn and
+// checks the payload that each of them gets against the hops of the route. If
+// decrypt hops are given, the onion that each user receives and the path key
+// that it passes on are checked against them as well.
+func peelRoute(section string, users []*User, route, decrypt []*vectorHop,
+	onion *Onion) error {
+
+	channels, err := routeChannels(users, route)
+	if err != nil {
+		return err
+	}
+
+	for i, user := range users {
+		pos := vectorPos{section: section, hop: i}
+
+		err := vectorPos{section: "generate", hop: i}.compareAll(
+			[]vectorField{
+				{"onion", route[i].Onion, onion.Serialize()},
+				{"hmac", route[i].HMAC, onion.HMAC[:]},
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		if decrypt != nil {
+			err := pos.compareAll([]vectorField{
+				{"onion", decrypt[i].Onion, onion.Serialize()},
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		user.Channels = channels
+		payload, next, err := pos.peel(users, i, onion)
+		if err != nil {
+			return err
+		}
+
+		if err := pos.comparePayload(route[i], payload); err != nil {
+			return err
+		}
+
+		if decrypt != nil {
+			err := pos.compareAll([]vectorField{
+				{"next_blinding", decrypt[i].NextBlinding,
+					keyBytes(next.EphemeralKey)},
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		onion = next
+	}
+
+	return nil
+}
+
+// routeChannels returns a channel table with a channel between each of the
+// users and the next one if the hop is told to forward over a channel. The
+// channel is taken from the hop's payload or, for hops in a blinded path, from
+// the decoded records that the test vector gives alongside the hop.
+func routeChannels(users []*User, route []*vectorHop) (*ChannelTable,
+	error) {
+
+	channels := NewChannelTable()
+	for i := 0; i < len(route)-1; i++ {
+		pos := vectorPos{section: "generate", hop: i}
+
+		scid, err := pos.channel(route[i])
+		if err != nil {
+			return nil, err
+		}
+
+		if scid != nil {
+			channels.AddChannel(
+				*scid, users[i].PubKey, users[i+1].PubKey,
+			)
+		}
+	}
+
+	return channels, nil
+}
+
+// channel returns the channel that the hop is told to forward over or nil if
+// it is told the next node instead.
+func (p vectorPos) channel(hop *vectorHop) (*ShortChannelID, error) {
+	if scid := vectorChannelID(hop.TLVs); scid != "" {
+		chanID, err := ParseShortChannelID(scid)
+		if err != nil {
+			return nil, fmt.Errorf("%v: invalid short_channel_id: "+
+				"%w", p, err)
+		}
+
+		return &chanID, nil
+	}
+
+	if hop.Payload == "" {
+		return nil, nil
+	}
+
+	payload, err := p.payload(hop)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := DecodeHopDataPayload(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%v: invalid payload: %w", p, err)
+	}
+
+	return data.ShortChannelID, nil
+}
+
+// vectorTLVs holds the records that the BOLT test vectors give in decoded form
+// alongside a hop's payload or encrypted data. Only the channel that the hop
+// forwards over is used.
+type vectorTLVs struct {
+	ShortChannelID         string          `json:"short_channel_id"`
+	OutgoingChannelID      string          `json:"outgoing_channel_id"`
+	EncryptedRecipientData json.RawMessage `json:"encrypted_recipient_data"`
+}
+
+// vectorChannelID returns the channel in the decoded records or an empty
+// string if there is none.
+func vectorChannelID(raw json.RawMessage) string {
+	var tlvs vectorTLVs
+	if len(raw) == 0 || json.Unmarshal(raw, &tlvs) != nil {
+		return ""
+	}
+
+	switch {
+	case tlvs.ShortChannelID != "":
+		return tlvs.ShortChannelID
+
+	case tlvs.OutgoingChannelID != "":
+		return tlvs.OutgoingChannelID
+
+	default:
+		return vectorChannelID(tlvs.EncryptedRecipientData)
+	}
+}
+
+// buildVectorPath builds the blinded path of a route blinding vector with
+// BuildBlindedPath. A hop with its own session key starts another path that is
+// concatenated to the previous one, so the paths are built from the last one
+// back. The keys that are derived for each hop are checked along with its
+// blinded node ID and encrypted data.
+func buildVectorPath(vectorHops []*vectorHop) (*BlindedPath, error) {
+	if len(vectorHops) == 0 || vectorHops[0].SessionKey == "" {
+		return nil, fmt.Errorf("%v: missing session_key",
+			vectorPos{section: "generate", hop: 0})
+	}
+
+	var (
+		path    *BlindedPath
+		derived = make([]*Hop, len(vectorHops))
+		end     = len(vectorHops)
+	)
+	for start := end - 1; start >= 0; start-- {
+		if vectorHops[start].SessionKey == "" {
+			continue
+		}
+
+		pos := vectorPos{section: "generate", hop: start}
+		sessionKey, err := pos.privKey(
+			"session_key", vectorHops[start].SessionKey,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		hopsData := make([]*HopData, end-start)
+		pubKeys := make([]*btcec.PublicKey, end-start)
+		tlvs := make([][]byte, end-start)
+		for i, hop := range vectorHops[start:end] {
+			pos := pos.at(start + i)
+
+			pubKeys[i], err = pos.pubKey("node_id", hop.NodeID)
+			if err != nil {
+				return nil, err
+			}
+			hopsData[i] = &HopData{PubKey: pubKeys[i]}
+
+			tlvs[i], err = pos.bytes("encoded_tlvs", hop.EncodedTLVs)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		opts := []BlindedPathOption{withRecipientData(tlvs)}
+		if path != nil {
+			opts = append(opts, WithNextPath(path))
+		}
+
+		path, err = BuildBlindedPath(sessionKey, hopsData, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("%v: unable to build blinded "+
+				"path: %w", pos, err)
+		}
+		copy(derived[start:end], DeriveHops(sessionKey, pubKeys))
+
+		end = start
+	}
+
+	blindedNodeIDs := append(
+		[]*btcec.PublicKey{path.EntryBlindedNodeID},
+		path.BlindedNodeIDs...,
+	)
+	for i, hop := range vectorHops {
+		pos := vectorPos{section: "generate", hop: i}
+
+		err := pos.compareAll([]vectorField{
+			{"ephemeral_privkey", hop.EphemeralPrivKey,
+				derived[i].E.Serialize()},
+			{"ephemeral_pubkey", hop.EphemeralPubKey,
+				derived[i].E.PubKey().SerializeCompressed()},
+			{"shared_secret", hop.SharedSecret, derived[i].SS[:]},
+			{"rho", hop.Rho, derived[i].Rho[:]},
+			{"encrypted_data", hop.EncryptedData,
+				path.EncryptedData[i]},
+			{"blinded_node_id", hop.BlindedNodeID,
+				blindedNodeIDs[i].SerializeCompressed()},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return path, nil
+}
+
+// checkFinal checks that only the final hop gets an all zero HMAC for the next
+// onion.
+func (p vectorPos) checkFinal(final bool, next *Onion) error {
+	if final == (next.HMAC == [32]byte{}) {
+		return nil
+	}
+
+	mismatch := &VectorMismatch{
+		Section:  p.section,
+		Hop:      p.hop,
+		Field:    "hmac",
+		Expected: "non-zero hmac",
+		Actual:   hex.EncodeToString(next.HMAC[:]),
+	}
+	if final {
+		mismatch.Expected = hex.EncodeToString(make([]byte, 32))
+	}
+
+	return mismatch
+}
+
+// payloadFrame prefixes the payload with its BigSize encoded length as it
+// appears in the test vectors.
+func payloadFrame(payload []byte) []byte {
+	return append(tlv.EncodeBigSize(uint64(len(payload))), payload...)
+}
+
+// keyBytes returns the compressed pub key or nil if there is no key.
+func keyBytes(pubKey *btcec.PublicKey) []byte {
+	if pubKey == nil {
+		return nil
+	}
+
+	return pubKey.SerializeCompressed()
+}
@@ -0,0 +1,87 @@
+package onion
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadTestVector(t *testing.T, name string) *TestVector {
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+
+	v, err := ParseTestVector(b)
+	require.NoError(t, err)
+
+	return v
+}
+
+func TestVectors(t *testing.T) {
+	files := []string{
+		"onion-test.json",
+		"error-obfuscation-test.json",
+		"route-blinding-test.json",
+		"onion-route-blinding-test.json",
+	}
+
+	for _, file := range files {
+		file := file
+		t.Run(file, func(t *testing.T) {
+			require.NoError(t, loadTestVector(t, file).Verify())
+		})
+	}
+}
+
+func TestVectorMismatch(t *testing.T) {
+	v := loadTestVector(t, "onion-test.json")
+
+	// A different payload for the third hop changes the onion.
+	payload := v.Generate.Hops[2].Payload
+	v.Generate.Hops[2].Payload = payload[:len(payload)-2] + "ff"
+
+	var mismatch *VectorMismatch
+	require.ErrorAs(t, v.Verify(), &mismatch)
+	require.Equal(t, "generate", mismatch.Section)
+	require.Equal(t, "onion", mismatch.Field)
+	require.Equal(t, v.Onion, mismatch.Expected)
+
+	// The first mismatching hop and field is reported.
+	v = loadTestVector(t, "error-obfuscation-test.json")
+	v.Return.Hops[3].Stream = v.Return.Hops[3].Stream[2:] + "00"
+	v.Return.Hops[2].Packet = v.Return.Hops[2].Packet[2:] + "00"
+
+	require.ErrorAs(t, v.Verify(), &mismatch)
+	require.Equal(t, "return", mismatch.Section)
+	require.Equal(t, 2, mismatch.Hop)
+	require.Equal(t, "packet", mismatch.Field)
+	require.EqualError(t, mismatch, "return hop 2: packet does not match")
+
+	require.Error(t, (&TestVector{}).Verify())
+}
+
+func TestVectorPathKeyOverride(t *testing.T) {
+	// Carol's data tells her to pass on the path key of Dave's path, so
+	// the path key that she would otherwise derive doesn't match.
+	v := loadTestVector(t, "route-blinding-test.json")
+	carol := v.Unblind.Hops[1]
+	override := carol.NextEphemeralPubKeyOverride
+	carol.NextEphemeralPubKeyOverride = carol.NextEphemeralPubKey
+
+	var mismatch *VectorMismatch
+	require.ErrorAs(t, v.Verify(), &mismatch)
+	require.Equal(t, "unblind", mismatch.Section)
+	require.Equal(t, 1, mismatch.Hop)
+	require.Equal(t, "next_ephemeral_pubkey_override", mismatch.Field)
+	require.Equal(t, override, mismatch.Actual)
+
+	v = loadTestVector(t, "onion-route-blinding-test.json")
+	carol = v.Decrypt.Hops[2]
+	carol.NextBlinding = v.Decrypt.Hops[1].NextBlinding
+
+	require.ErrorAs(t, v.Verify(), &mismatch)
+	require.Equal(t, "decrypt", mismatch.Section)
+	require.Equal(t, 2, mismatch.Hop)
+	require.Equal(t, "next_blinding", mismatch.Field)
+	require.Equal(t, override, mismatch.Actual)
+}